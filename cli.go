@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/discovery"
+	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
+	"github.com/VladMinzatu/ebpf-profiler/internal/exporter"
+)
+
+const (
+	formatPprof  = "pprof"
+	formatOtlp   = "otlp"
+	formatFolded = "folded"
+)
+
+// where --pin pins the BPF objects, in a directory of the given name
+const bpffsRoot = "/sys/fs/bpf"
+
+// how user stacks are unwound
+const (
+	unwindFramePointers = "fp"    // in BPF, following frame pointers
+	unwindDwarf         = "dwarf" // in userspace, with the .eh_frame/.debug_frame of the binaries (x86-64 only)
+)
+
+type config struct {
+	pid             int
+	systemWide      bool
+	cgroup          string
+	discover        discovery.Matcher // processes to find and profile as they come and go, instead of a fixed target
+	profileType     ebpf.ProfileType
+	event           ebpf.PerfEvent
+	frequency       int
+	collectInterval time.Duration
+	duration        time.Duration
+	format          string
+	output          string
+	stacks          exporter.StackSelection
+	mapSizes        ebpf.Options
+	unwind          string
+	samplesOutput   string   // JSON Lines file every sample is streamed to as it is taken; disabled if empty
+	allowComms      []string // comm prefixes of the only processes to sample
+	denyComms       []string // comm prefixes of processes never to sample
+
+	// kubeletURL enables pod and container names from the kubelet's pod list, e.g. https://$NODE_IP:10250
+	kubeletURL         string
+	kubeletInsecureTLS bool
+
+	// command is set in record mode: the command line to launch and profile instead of an existing pid
+	command []string
+}
+
+// parses either `[flags]` to profile an existing process, or `record [flags] -- <cmd> [args...]` to launch one
+func parseConfig(args []string, errOut io.Writer) (*config, error) {
+	record := len(args) > 0 && args[0] == "record"
+	name := "ebpf-profiler"
+	if record {
+		args = args[1:]
+		name = "ebpf-profiler record"
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(errOut)
+
+	var cfg config
+	var stacks, profileType, event, pin, allowComms, denyComms, cmdline string
+	if !record {
+		fs.IntVar(&cfg.pid, "pid", 0, "PID of the process to profile (required unless --system-wide, --cgroup, --exe, --cmdline or --unit is set)")
+		fs.BoolVar(&cfg.systemWide, "system-wide", false, "profile every process on the host")
+		fs.StringVar(&cfg.cgroup, "cgroup", "", "cgroup v2 to profile, including its descendants (e.g. system.slice/nginx.service)")
+		fs.StringVar(&cfg.discover.Exe, "exe", "", "profile the processes running this executable (base name), following them across restarts")
+		fs.StringVar(&cmdline, "cmdline", "", "profile the processes whose command line matches this regular expression, following them across restarts")
+		fs.StringVar(&cfg.discover.Unit, "unit", "", "profile the processes of this systemd unit (e.g. nginx.service), following them across restarts")
+		fs.StringVar(&allowComms, "allow-comm", "", "comma-separated comm prefixes: only sample processes whose comm starts with one of them")
+		fs.StringVar(&denyComms, "deny-comm", "", "comma-separated comm prefixes: never sample processes whose comm starts with one of them")
+		fs.StringVar(&pin, "pin", "", "pin the counts and the attached programs under "+bpffsRoot+"/<name>, so that profiling continues across restarts (disabled if empty)")
+	}
+	fs.StringVar(&profileType, "profile-type", "cpu", "what to profile: cpu (on-CPU samples) or off-cpu (time spent blocked)")
+	fs.StringVar(&event, "event", ebpf.CPUClock.Name, "perf event to sample on (cpu profiles only): "+perfEventNames())
+	fs.IntVar(&cfg.frequency, "frequency", 99, "sampling frequency in Hz (cpu profiles only)")
+	fs.DurationVar(&cfg.collectInterval, "collect-interval", 1*time.Second, "how often counts are collected from the BPF maps")
+	if !record {
+		fs.DurationVar(&cfg.duration, "duration", 0, "how long to profile for; 0 means until interrupted")
+	}
+	fs.StringVar(&cfg.format, "format", formatPprof, "output format: pprof, otlp or folded")
+	fs.StringVar(&cfg.output, "output", "", "output file (default profile.pb for pprof/otlp, stacks.txt for folded)")
+	fs.StringVar(&stacks, "stacks", "both", "which stacks to include: user, kernel or both")
+	fs.IntVar(&cfg.mapSizes.StackMapSize, "stack-map-size", ebpf.DefaultStackMapSize, "number of distinct stacks that can be stored")
+	fs.IntVar(&cfg.mapSizes.CountsMapSize, "counts-map-size", ebpf.DefaultCountsMapSize, "number of distinct (thread, stack) entries per collection interval")
+	fs.IntVar(&cfg.mapSizes.StackFrames, "stack-depth", ebpf.DefaultStackFrames, "maximum number of frames captured per stack")
+	fs.StringVar(&cfg.mapSizes.KernelBTF, "kernel-btf", "", "BTF file of the running kernel (e.g. from BTFHub), for kernels without /sys/kernel/btf/vmlinux")
+	fs.BoolVar(&cfg.mapSizes.VerboseVerifierLog, "verifier-log", false, "if the kernel rejects the BPF programs, print the verifier's complete log")
+	fs.StringVar(&cfg.unwind, "unwind", unwindFramePointers, "how user stacks are unwound: fp (frame pointers) or dwarf (.eh_frame, for binaries without frame pointers; cpu profiles on x86-64 only)")
+	fs.StringVar(&cfg.samplesOutput, "samples-output", "", "also stream every sample with its timestamp and CPU to this file as JSON Lines (disabled if empty)")
+	fs.StringVar(&cfg.kubeletURL, "kubelet-url", "", "kubelet to fetch pod and container names from, e.g. https://$NODE_IP:10250 (disabled if empty)")
+	fs.BoolVar(&cfg.kubeletInsecureTLS, "kubelet-insecure-tls", false, "don't verify the kubelet's serving certificate")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if record {
+		if fs.NArg() == 0 {
+			return nil, errors.New("record requires a command to run: record [flags] -- <cmd> [args...]")
+		}
+		cfg.command = fs.Args()
+	} else {
+		if fs.NArg() > 0 {
+			return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+		}
+		if cmdline != "" {
+			re, err := regexp.Compile(cmdline)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --cmdline: %w", err)
+			}
+			cfg.discover.Cmdline = re
+		}
+		targets := 0
+		for _, set := range []bool{cfg.pid != 0, cfg.systemWide, cfg.cgroup != "", !cfg.discover.IsZero()} {
+			if set {
+				targets++
+			}
+		}
+		if targets > 1 {
+			return nil, errors.New("--pid, --system-wide, --cgroup and --exe/--cmdline/--unit are mutually exclusive")
+		}
+		if !cfg.discover.IsZero() && allowComms != "" {
+			return nil, errors.New("--allow-comm can't be combined with --exe, --cmdline or --unit, which only allow the processes they find")
+		}
+		if targets == 0 || cfg.pid < 0 {
+			return nil, errors.New("--pid is required and must be > 0")
+		}
+	}
+
+	if cfg.frequency <= 0 {
+		return nil, errors.New("--frequency must be > 0")
+	}
+	if cfg.duration < 0 {
+		return nil, errors.New("--duration must not be negative")
+	}
+	if cfg.mapSizes.StackMapSize <= 0 || cfg.mapSizes.CountsMapSize <= 0 || cfg.mapSizes.StackFrames <= 0 {
+		return nil, errors.New("--stack-map-size, --counts-map-size and --stack-depth must be > 0")
+	}
+
+	var err error
+	if cfg.allowComms, err = parseCommPrefixes("--allow-comm", allowComms); err != nil {
+		return nil, err
+	}
+	if cfg.denyComms, err = parseCommPrefixes("--deny-comm", denyComms); err != nil {
+		return nil, err
+	}
+	if pin != "" {
+		// bpffs doesn't allow dots in names
+		if strings.ContainsAny(pin, "/.") {
+			return nil, fmt.Errorf("invalid --pin %q; must be a name without '/' or '.'", pin)
+		}
+		cfg.mapSizes.PinPath = bpffsRoot + "/" + pin
+	}
+
+	switch cfg.format {
+	case formatPprof, formatOtlp:
+		if cfg.output == "" {
+			cfg.output = "profile.pb"
+		}
+	case formatFolded:
+		if cfg.output == "" {
+			cfg.output = "stacks.txt"
+		}
+	default:
+		return nil, fmt.Errorf("unknown --format %q; must be one of pprof, otlp, folded", cfg.format)
+	}
+
+	sel, err := parseStackSelection(stacks)
+	if err != nil {
+		return nil, err
+	}
+	cfg.stacks = sel
+
+	pt, err := parseProfileType(profileType)
+	if err != nil {
+		return nil, err
+	}
+	cfg.profileType = pt
+
+	switch cfg.unwind {
+	case unwindFramePointers:
+	case unwindDwarf:
+		if cfg.profileType != ebpf.OnCPU {
+			return nil, errors.New("--unwind dwarf is only supported for --profile-type cpu")
+		}
+		if cfg.samplesOutput != "" {
+			return nil, fmt.Errorf("--samples-output is not supported with --unwind dwarf: %w", ebpf.ErrStreamingUnwoundStacks)
+		}
+		if runtime.GOARCH != "amd64" {
+			return nil, fmt.Errorf("--unwind dwarf is not supported on %s", runtime.GOARCH)
+		}
+	default:
+		return nil, fmt.Errorf("unknown --unwind %q; must be one of fp, dwarf", cfg.unwind)
+	}
+
+	ev, ok := ebpf.PerfEventByName(event)
+	if !ok {
+		return nil, fmt.Errorf("unknown --event %q; must be one of %s", event, perfEventNames())
+	}
+	cfg.event = ev
+
+	return &cfg, nil
+}
+
+func parseCommPrefixes(flag, s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	prefixes := strings.Split(s, ",")
+	for _, p := range prefixes {
+		if p == "" || len(p) > ebpf.MaxCommPrefix {
+			return nil, fmt.Errorf("invalid %s prefix %q; must be 1 to %d bytes", flag, p, ebpf.MaxCommPrefix)
+		}
+	}
+	return prefixes, nil
+}
+
+func parseStackSelection(s string) (exporter.StackSelection, error) {
+	switch s {
+	case "user":
+		return exporter.User, nil
+	case "kernel":
+		return exporter.Kernel, nil
+	case "both":
+		return exporter.Both, nil
+	default:
+		return 0, fmt.Errorf("unknown --stacks %q; must be one of user, kernel, both", s)
+	}
+}
+
+func parseProfileType(s string) (ebpf.ProfileType, error) {
+	switch s {
+	case "cpu":
+		return ebpf.OnCPU, nil
+	case "off-cpu":
+		return ebpf.OffCPU, nil
+	default:
+		return 0, fmt.Errorf("unknown --profile-type %q; must be one of cpu, off-cpu", s)
+	}
+}
+
+func perfEventNames() string {
+	names := make([]string, len(ebpf.PerfEvents))
+	for i, ev := range ebpf.PerfEvents {
+		names[i] = ev.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
+	"github.com/VladMinzatu/ebpf-profiler/internal/exporter"
+	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
+	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
+)
+
+func TestParseConfig_Defaults(t *testing.T) {
+	cfg, err := parseConfig([]string{"--pid", "42"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.pid != 42 {
+		t.Fatalf("unexpected pid: %d", cfg.pid)
+	}
+	if cfg.frequency != 99 {
+		t.Fatalf("unexpected default frequency: %d", cfg.frequency)
+	}
+	if cfg.collectInterval != time.Second {
+		t.Fatalf("unexpected default collect interval: %v", cfg.collectInterval)
+	}
+	if cfg.duration != 0 {
+		t.Fatalf("unexpected default duration: %v", cfg.duration)
+	}
+	if cfg.format != formatPprof || cfg.output != "profile.pb" {
+		t.Fatalf("unexpected default output: %s -> %s", cfg.format, cfg.output)
+	}
+	if cfg.stacks != exporter.Both {
+		t.Fatalf("unexpected default stack selection: %v", cfg.stacks)
+	}
+	if cfg.profileType != ebpf.OnCPU {
+		t.Fatalf("unexpected default profile type: %v", cfg.profileType)
+	}
+	if cfg.event != ebpf.CPUClock {
+		t.Fatalf("unexpected default event: %v", cfg.event)
+	}
+	if cfg.unwind != unwindFramePointers {
+		t.Fatalf("unexpected default unwinding: %s", cfg.unwind)
+	}
+}
+
+func TestParseConfig_AllFlags(t *testing.T) {
+	args := []string{
+		"--pid", "7",
+		"--frequency", "1000",
+		"--collect-interval", "500ms",
+		"--duration", "30s",
+		"--format", "folded",
+		"--output", "out.txt",
+		"--stacks", "kernel",
+		"--profile-type", "off-cpu",
+		"--event", "major-faults",
+		"--kubelet-url", "https://10.0.0.1:10250",
+		"--kubelet-insecure-tls",
+		"--stack-map-size", "131072",
+		"--counts-map-size", "1024",
+		"--stack-depth", "64",
+		"--samples-output", "samples.jsonl",
+		"--verifier-log",
+		"--kernel-btf", "/var/lib/btf/5.4.0-generic.btf",
+		"--pin", "ebpf-profiler",
+		"--allow-comm", "java,python3",
+		"--deny-comm", "kworker/",
+	}
+	cfg, err := parseConfig(args, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	want := config{
+		pid:             7,
+		frequency:       1000,
+		collectInterval: 500 * time.Millisecond,
+		duration:        30 * time.Second,
+		format:          formatFolded,
+		output:          "out.txt",
+		stacks:          exporter.Kernel,
+		profileType:     ebpf.OffCPU,
+		event:           ebpf.MajorFaults,
+		mapSizes:        ebpf.Options{StackMapSize: 131072, CountsMapSize: 1024, StackFrames: 64, VerboseVerifierLog: true, KernelBTF: "/var/lib/btf/5.4.0-generic.btf", PinPath: "/sys/fs/bpf/ebpf-profiler"},
+		unwind:          unwindFramePointers,
+		samplesOutput:   "samples.jsonl",
+		allowComms:      []string{"java", "python3"},
+		denyComms:       []string{"kworker/"},
+
+		kubeletURL:         "https://10.0.0.1:10250",
+		kubeletInsecureTLS: true,
+	}
+	if !reflect.DeepEqual(*cfg, want) {
+		t.Fatalf("unexpected config: got %+v want %+v", *cfg, want)
+	}
+}
+
+func TestParseConfig_SystemWide(t *testing.T) {
+	cfg, err := parseConfig([]string{"--system-wide"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if !cfg.systemWide || cfg.pid != 0 {
+		t.Fatalf("unexpected target: pid=%d system-wide=%v", cfg.pid, cfg.systemWide)
+	}
+}
+
+func TestParseConfig_Cgroup(t *testing.T) {
+	cfg, err := parseConfig([]string{"--cgroup", "system.slice/nginx.service"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.cgroup != "system.slice/nginx.service" || cfg.pid != 0 || cfg.systemWide {
+		t.Fatalf("unexpected target: pid=%d system-wide=%v cgroup=%q", cfg.pid, cfg.systemWide, cfg.cgroup)
+	}
+}
+
+func TestParseConfig_Discovery(t *testing.T) {
+	cfg, err := parseConfig([]string{"--exe", "java", "--cmdline", `-jar \S*orders`, "--unit", "orders"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	d := cfg.discover
+	if d.Exe != "java" || d.Cmdline == nil || d.Cmdline.String() != `-jar \S*orders` || d.Unit != "orders" {
+		t.Fatalf("unexpected discovery: %v", d)
+	}
+	target, err := resolveTarget(cfg)
+	if err != nil {
+		t.Fatalf("resolveTarget: %v", err)
+	}
+	if target != (ebpf.Target{PID: ebpf.AllProcesses, AllowedOnly: true}) {
+		t.Fatalf("unexpected target: %+v", target)
+	}
+}
+
+func TestParseConfig_UnwindDwarf(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("dwarf unwinding is only supported on amd64")
+	}
+	cfg, err := parseConfig([]string{"--pid", "1", "--unwind", "dwarf"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.unwind != unwindDwarf {
+		t.Fatalf("unexpected unwinding: %s", cfg.unwind)
+	}
+}
+
+func TestParseConfig_FoldedDefaultOutput(t *testing.T) {
+	cfg, err := parseConfig([]string{"--pid", "1", "--format", "folded"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if cfg.output != "stacks.txt" {
+		t.Fatalf("unexpected default folded output: %s", cfg.output)
+	}
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"missing pid", []string{}},
+		{"negative pid", []string{"--pid", "-1"}},
+		{"zero frequency", []string{"--pid", "1", "--frequency", "0"}},
+		{"negative duration", []string{"--pid", "1", "--duration", "-1s"}},
+		{"unknown format", []string{"--pid", "1", "--format", "json"}},
+		{"unknown stacks", []string{"--pid", "1", "--stacks", "all"}},
+		{"unknown profile type", []string{"--pid", "1", "--profile-type", "heap"}},
+		{"unknown event", []string{"--pid", "1", "--event", "llc-misses"}},
+		{"zero stack map size", []string{"--pid", "1", "--stack-map-size", "0"}},
+		{"negative stack depth", []string{"--pid", "1", "--stack-depth", "-1"}},
+		{"unknown unwind", []string{"--pid", "1", "--unwind", "lbr"}},
+		{"dwarf unwinding off-cpu", []string{"--pid", "1", "--unwind", "dwarf", "--profile-type", "off-cpu"}},
+		{"dwarf unwinding with samples output", []string{"--pid", "1", "--unwind", "dwarf", "--samples-output", "samples.jsonl"}},
+		{"unknown flag", []string{"--pid", "1", "--nope"}},
+		{"positional args", []string{"--pid", "1", "extra"}},
+		{"pid and system-wide", []string{"--pid", "1", "--system-wide"}},
+		{"pid and cgroup", []string{"--pid", "1", "--cgroup", "system.slice"}},
+		{"system-wide and cgroup", []string{"--system-wide", "--cgroup", "system.slice"}},
+		{"pin path", []string{"--pid", "1", "--pin", "../profiler"}},
+		{"pin name with dot", []string{"--pid", "1", "--pin", "profiler.v2"}},
+		{"empty comm prefix", []string{"--system-wide", "--deny-comm", "java,"}},
+		{"invalid cmdline regexp", []string{"--cmdline", "java ("}},
+		{"pid and exe", []string{"--pid", "1", "--exe", "java"}},
+		{"exe and allowed comm", []string{"--exe", "java", "--allow-comm", "python3"}},
+		{"long comm prefix", []string{"--system-wide", "--allow-comm", "more-than-15-bytes"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseConfig(tt.args, io.Discard); err == nil {
+				t.Fatalf("expected error for args %v", tt.args)
+			}
+		})
+	}
+}
+
+func TestSelectStacks(t *testing.T) {
+	samples := []profiler.Sample{
+		{
+			UserStack:   []symbolizer.Symbol{{Name: "u"}},
+			KernelStack: []symbolizer.Symbol{{Name: "k"}},
+			Count:       1,
+		},
+	}
+
+	user := selectStacks(samples, exporter.User)
+	if len(user[0].UserStack) != 1 || user[0].KernelStack != nil {
+		t.Fatalf("expected only the user stack, got %+v", user[0])
+	}
+	kernel := selectStacks(samples, exporter.Kernel)
+	if kernel[0].UserStack != nil || len(kernel[0].KernelStack) != 1 {
+		t.Fatalf("expected only the kernel stack, got %+v", kernel[0])
+	}
+	both := selectStacks(samples, exporter.Both)
+	if len(both[0].UserStack) != 1 || len(both[0].KernelStack) != 1 {
+		t.Fatalf("expected both stacks, got %+v", both[0])
+	}
+	if len(samples[0].KernelStack) != 1 {
+		t.Fatalf("input samples must not be modified")
+	}
+}
+
+func TestParseConfig_Record(t *testing.T) {
+	cfg, err := parseConfig([]string{"record", "--format", "otlp", "--", "sleep", "1"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig: %v", err)
+	}
+	if len(cfg.command) != 2 || cfg.command[0] != "sleep" || cfg.command[1] != "1" {
+		t.Fatalf("unexpected command: %v", cfg.command)
+	}
+	if cfg.format != formatOtlp || cfg.output != "profile.pb" {
+		t.Fatalf("unexpected output: %s -> %s", cfg.format, cfg.output)
+	}
+}
+
+func TestParseConfig_RecordInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"missing command", []string{"record"}},
+		{"missing command after separator", []string{"record", "--"}},
+		{"pid not allowed", []string{"record", "--pid", "1", "--", "true"}},
+		{"duration not allowed", []string{"record", "--duration", "1s", "--", "true"}},
+		{"cgroup not allowed", []string{"record", "--cgroup", "system.slice", "--", "true"}},
+		{"pin not allowed", []string{"record", "--pin", "profiler", "--", "true"}},
+		{"exe not allowed", []string{"record", "--exe", "java", "--", "true"}},
+		{"comm filters not allowed", []string{"record", "--deny-comm", "kworker", "--", "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseConfig(tt.args, io.Discard); err == nil {
+				t.Fatalf("expected error for args %v", tt.args)
+			}
+		})
+	}
+}
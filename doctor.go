@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cilium/ebpf/btf"
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
+	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
+)
+
+type checkStatus int
+
+const (
+	statusOK checkStatus = iota
+	statusWarn
+	statusFail
+)
+
+func (s checkStatus) String() string {
+	switch s {
+	case statusOK:
+		return "  OK"
+	case statusWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+type checkResult struct {
+	name   string
+	status checkStatus
+	detail string
+	remedy string // what to do about a warning or failure
+}
+
+// where the checks read the host's state from, so that tests can point them at fixtures
+type host struct {
+	procRoot  string // /proc
+	sysRoot   string // /sys
+	kernelBTF string // see --kernel-btf
+	// loads and unloads the BPF objects, which is the one check that can't be faked with files
+	loadBPF func() error
+	// the symbol tables of a binary mapped by pid
+	inspectBinary func(pid int, path string) (symbolizer.BinarySymbols, error)
+}
+
+func defaultHost(kernelBTF string) host {
+	return host{
+		procRoot:  "/proc",
+		sysRoot:   "/sys",
+		kernelBTF: kernelBTF,
+		loadBPF: func() error {
+			backend, err := ebpf.NewEbpfBackend(ebpf.Options{KernelBTF: kernelBTF})
+			if err != nil {
+				return err
+			}
+			return backend.Stop()
+		},
+		inspectBinary: symbolizer.InspectBinary,
+	}
+}
+
+// runs `doctor [--pid <pid>] [--kernel-btf <file>]`, which checks whether profiling can work on this host and, with a
+// pid, how well the target's frames can be symbolized. Returns the exit code: 1 if any check failed, 0 otherwise.
+func doctor(args []string, out, errOut io.Writer) int {
+	fs := flag.NewFlagSet("ebpf-profiler doctor", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	pid := fs.Int("pid", 0, "also check the binaries of this process for symbols")
+	kernelBTF := fs.String("kernel-btf", "", "BTF file to use for kernels without /sys/kernel/btf/vmlinux, as the profiler would")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(errOut, "unexpected arguments: %v\n", fs.Args())
+		return 2
+	}
+
+	results := runChecks(defaultHost(*kernelBTF), *pid)
+	failed := false
+	for _, r := range results {
+		fmt.Fprintf(out, "[%s] %s: %s\n", r.status, r.name, r.detail)
+		if r.status != statusOK && r.remedy != "" {
+			fmt.Fprintf(out, "       fix: %s\n", r.remedy)
+		}
+		failed = failed || r.status == statusFail
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func runChecks(h host, pid int) []checkResult {
+	caps, capsResult := h.checkCapabilities()
+	results := []checkResult{
+		capsResult,
+		h.checkPerfEventParanoid(caps),
+		h.checkKallsyms(),
+		h.checkBTF(),
+		h.checkBpffs(),
+		h.checkLoad(),
+	}
+	if pid > 0 {
+		results = append(results, h.checkBinaries(pid)...)
+	}
+	return results
+}
+
+// the effective capabilities of this process, as a bit set indexed by capability number
+type capabilities uint64
+
+func (c capabilities) has(capability int) bool {
+	return c&(1<<capability) != 0
+}
+
+// loading the BPF programs and opening system-wide perf events needs CAP_BPF and CAP_PERFMON, or CAP_SYS_ADMIN on
+// kernels older than 5.8, which don't have the finer grained capabilities
+func (c capabilities) canProfile() bool {
+	return c.has(unix.CAP_SYS_ADMIN) || (c.has(unix.CAP_BPF) && c.has(unix.CAP_PERFMON))
+}
+
+func (h host) checkCapabilities() (capabilities, checkResult) {
+	r := checkResult{name: "capabilities"}
+	caps, err := h.readCapabilities()
+	if err != nil {
+		r.status, r.detail = statusWarn, fmt.Sprintf("could not read the effective capabilities: %v", err)
+		return 0, r
+	}
+
+	var have []string
+	for _, c := range []struct {
+		name string
+		bit  int
+	}{{"CAP_BPF", unix.CAP_BPF}, {"CAP_PERFMON", unix.CAP_PERFMON}, {"CAP_SYS_ADMIN", unix.CAP_SYS_ADMIN}, {"CAP_SYS_PTRACE", unix.CAP_SYS_PTRACE}, {"CAP_SYSLOG", unix.CAP_SYSLOG}} {
+		if caps.has(c.bit) {
+			have = append(have, c.name)
+		}
+	}
+	r.detail = "none of CAP_BPF, CAP_PERFMON, CAP_SYS_ADMIN"
+	if len(have) > 0 {
+		r.detail = strings.Join(have, ", ")
+	}
+	if !caps.canProfile() {
+		r.status = statusFail
+		r.detail += "; loading BPF programs needs CAP_BPF and CAP_PERFMON, or CAP_SYS_ADMIN"
+		r.remedy = "run as root (sudo), or grant the capabilities: sudo setcap cap_bpf,cap_perfmon,cap_sys_ptrace,cap_syslog+ep ./ebpf-profiler (kernels older than 5.8 need cap_sys_admin instead of cap_bpf,cap_perfmon)"
+	}
+	return caps, r
+}
+
+func (h host) readCapabilities() (capabilities, error) {
+	f, err := os.Open(filepath.Join(h.procRoot, "self/status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			if err != nil {
+				return 0, fmt.Errorf("parsing CapEff %q: %w", v, err)
+			}
+			return capabilities(caps), nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no CapEff in status")
+}
+
+// the perf events are opened per CPU for all processes, which unprivileged users can only do with
+// kernel.perf_event_paranoid <= 0; CAP_PERFMON bypasses it
+func (h host) checkPerfEventParanoid(caps capabilities) checkResult {
+	r := checkResult{name: "kernel.perf_event_paranoid"}
+	level, err := h.readSysctlInt("kernel/perf_event_paranoid")
+	if err != nil {
+		r.status, r.detail = statusWarn, fmt.Sprintf("could not be read: %v", err)
+		return r
+	}
+	r.detail = strconv.Itoa(level)
+	switch {
+	case caps.has(unix.CAP_PERFMON) || caps.has(unix.CAP_SYS_ADMIN):
+		r.detail += " (does not apply with CAP_PERFMON or CAP_SYS_ADMIN)"
+	case level > 0:
+		r.status = statusFail
+		r.detail += "; system-wide perf events need <= 0 without CAP_PERFMON"
+		r.remedy = "run as root, or sudo sysctl kernel.perf_event_paranoid=0"
+	}
+	return r
+}
+
+// with kernel.kptr_restrict, /proc/kallsyms lists every address as 0, so kernel frames can't be symbolized
+func (h host) checkKallsyms() checkResult {
+	r := checkResult{name: "kernel symbols"}
+	restrict, err := h.readSysctlInt("kernel/kptr_restrict")
+	restrictDesc := "kernel.kptr_restrict=" + strconv.Itoa(restrict)
+	if err != nil {
+		restrictDesc = "kernel.kptr_restrict unknown"
+	}
+
+	f, err := os.Open(filepath.Join(h.procRoot, "kallsyms"))
+	if err != nil {
+		r.status = statusWarn
+		r.detail = fmt.Sprintf("/proc/kallsyms could not be read: %v; kernel frames will not be symbolized", err)
+		return r
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	seen, nonZero := 0, false
+	for sc.Scan() && seen < 100 && !nonZero {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		seen++
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		nonZero = err == nil && addr != 0
+	}
+	switch {
+	case seen == 0:
+		r.status, r.detail = statusWarn, "/proc/kallsyms is empty; kernel frames will not be symbolized"
+	case !nonZero:
+		r.status = statusWarn
+		r.detail = "/proc/kallsyms addresses are all zero (" + restrictDesc + "); kernel frames will not be symbolized"
+		r.remedy = "run as root (kptr_restrict=1 only hides addresses from processes without CAP_SYSLOG), or sudo sysctl kernel.kptr_restrict=0"
+	default:
+		r.detail = "/proc/kallsyms addresses are visible (" + restrictDesc + ")"
+	}
+	return r
+}
+
+// the BPF programs are compiled once and relocated against the running kernel's BTF (CO-RE)
+func (h host) checkBTF() checkResult {
+	r := checkResult{name: "kernel BTF"}
+	path := filepath.Join(h.sysRoot, "kernel/btf/vmlinux")
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		r.detail = "/sys/kernel/btf/vmlinux is present"
+		if h.kernelBTF != "" {
+			r.detail += ", --kernel-btf is not needed"
+		}
+	case h.kernelBTF != "":
+		if _, err := btf.LoadSpec(h.kernelBTF); err != nil {
+			r.status = statusFail
+			r.detail = fmt.Sprintf("/sys/kernel/btf/vmlinux not found and %s could not be loaded: %v", h.kernelBTF, err)
+			r.remedy = "pass the BTF file for exactly this kernel (uname -r), e.g. from BTFHub"
+			return r
+		}
+		r.status = statusWarn
+		r.detail = "/sys/kernel/btf/vmlinux not found, using " + h.kernelBTF + "; off-CPU profiles and --unwind dwarf need the kernel's own BTF"
+		r.remedy = "use a kernel built with CONFIG_DEBUG_INFO_BTF=y for off-CPU profiles and --unwind dwarf"
+	default:
+		r.status = statusFail
+		if errors.Is(err, os.ErrNotExist) {
+			r.detail = "/sys/kernel/btf/vmlinux not found; the kernel was built without BTF, which the BPF programs are relocated against"
+		} else {
+			r.detail = fmt.Sprintf("/sys/kernel/btf/vmlinux could not be read: %v", err)
+		}
+		r.remedy = "use a kernel built with CONFIG_DEBUG_INFO_BTF=y, which most distributions enable since 5.4, or pass --kernel-btf with a BTF file for this kernel (e.g. from BTFHub)"
+	}
+	return r
+}
+
+func (h host) checkBpffs() checkResult {
+	r := checkResult{name: "bpffs"}
+	mounts, err := os.ReadFile(filepath.Join(h.procRoot, "self/mounts"))
+	if err != nil {
+		r.status, r.detail = statusWarn, fmt.Sprintf("could not read the mounts: %v", err)
+		return r
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		// device mountpoint fstype options dump pass
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[2] == "bpf" {
+			r.detail = "mounted at " + fields[1]
+			return r
+		}
+	}
+	r.status = statusWarn
+	r.detail = "not mounted; BPF objects can't be pinned or inspected with bpftool"
+	r.remedy = "sudo mount -t bpf bpf /sys/fs/bpf"
+	return r
+}
+
+// loading the BPF objects covers whatever the other checks missed, e.g. kernels that are too old
+func (h host) checkLoad() checkResult {
+	r := checkResult{name: "BPF programs"}
+	err := h.loadBPF()
+	if err == nil {
+		r.detail = "loaded and verified"
+		return r
+	}
+	r.status = statusFail
+	r.detail = fmt.Sprintf("could not be loaded: %v", err)
+	var le *ebpf.LoadError
+	isLoadError := errors.As(err, &le)
+	switch {
+	case isLoadError && len(le.Missing) > 0:
+		r.remedy = "upgrade to a kernel that has " + strings.Join(le.Missing, ", ")
+	case isLoadError && len(le.VerifierLog) > 0:
+		r.remedy = "the verifier rejected the programs; run the profiler with --verifier-log to see why"
+	case errors.Is(err, os.ErrPermission):
+		r.remedy = "run as root; on kernels older than 5.11 BPF memory is also limited by RLIMIT_MEMLOCK, raise it with ulimit -l unlimited"
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOTSUP):
+		r.remedy = "the kernel may be too old for the BPF features used; ring buffers alone need 5.8 or later"
+	}
+	return r
+}
+
+// checks which symbol tables the executables pid has mapped carry
+func (h host) checkBinaries(pid int) []checkResult {
+	maps, err := symbolizer.NewProcMaps(symbolizer.NewDataLoader(filepath.Join(h.procRoot, strconv.Itoa(pid), "maps")))
+	if err != nil {
+		return []checkResult{{
+			name:   fmt.Sprintf("process %d", pid),
+			status: statusFail,
+			detail: fmt.Sprintf("could not read its memory maps: %v", err),
+			remedy: "check that the process exists; processes of other users need root or CAP_SYS_PTRACE",
+		}}
+	}
+
+	var results []checkResult
+	seen := make(map[string]bool)
+	for _, region := range maps.Regions() {
+		// only executable code ends up in stacks; [vdso] and the like have no file to read
+		if !strings.Contains(region.Perms, "x") || region.Path == "" || strings.HasPrefix(region.Path, "[") || seen[region.Path] {
+			continue
+		}
+		seen[region.Path] = true
+		results = append(results, h.checkBinary(pid, region.Path))
+	}
+	return results
+}
+
+func (h host) checkBinary(pid int, path string) checkResult {
+	r := checkResult{name: path}
+	syms, err := h.inspectBinary(pid, path)
+	if err != nil {
+		r.status = statusWarn
+		r.detail = fmt.Sprintf("could not be opened: %v; its frames will not be symbolized", err)
+		r.remedy = "binaries are opened at the path the process mapped them from, which has to exist for the profiler too (e.g. not only inside a container)"
+		return r
+	}
+
+	var tables []string
+	for _, t := range []struct {
+		name string
+		has  bool
+	}{{".gopclntab", syms.GoPclntab}, {"DWARF", syms.DWARF}, {".symtab", syms.Symtab}, {".dynsym", syms.Dynsym}} {
+		if t.has {
+			tables = append(tables, t.name)
+		}
+	}
+	switch {
+	case len(tables) == 0:
+		r.status = statusWarn
+		r.detail = "no symbol tables; its frames will be shown as addresses"
+		r.remedy = "build it without stripping the symbols; separate debug info files (e.g. in /usr/lib/debug) are not read"
+	case !syms.GoPclntab && !syms.DWARF && !syms.Symtab:
+		// only the exported functions are in .dynsym, the frames of the others resolve to the one before them
+		r.status = statusWarn
+		r.detail = strings.Join(tables, ", ") + "; only its exported functions can be symbolized"
+		r.remedy = "build it without stripping .symtab; separate debug info files (e.g. in /usr/lib/debug) are not read"
+	default:
+		r.detail = strings.Join(tables, ", ")
+	}
+	return r
+}
+
+func (h host) readSysctlInt(name string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(h.procRoot, "sys", name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
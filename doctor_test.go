@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf/btf"
+	"golang.org/x/sys/unix"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
+	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
+)
+
+// CapEff of root: every capability up to CAP_CHECKPOINT_RESTORE
+const rootCaps = "000001ffffffffff"
+
+// lays out a fake /proc and /sys, with files relative to the host root (e.g. "proc/kallsyms")
+func fakeHost(t *testing.T, files map[string]string) host {
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return host{
+		procRoot: filepath.Join(root, "proc"),
+		sysRoot:  filepath.Join(root, "sys"),
+		loadBPF:  func() error { return nil },
+		inspectBinary: func(pid int, path string) (symbolizer.BinarySymbols, error) {
+			return symbolizer.BinarySymbols{}, fmt.Errorf("no binary %s", path)
+		},
+	}
+}
+
+func healthyHostFiles() map[string]string {
+	return map[string]string{
+		"proc/self/status":                    "Name:\tebpf-profiler\nCapEff:\t" + rootCaps + "\n",
+		"proc/sys/kernel/perf_event_paranoid": "2\n",
+		"proc/sys/kernel/kptr_restrict":       "1\n",
+		"proc/kallsyms":                       "0000000000000000 A fixed_percpu_data\nffffffff81000000 T _stext\n",
+		"proc/self/mounts":                    "sysfs /sys sysfs rw 0 0\nbpf /sys/fs/bpf bpf rw 0 0\n",
+		"sys/kernel/btf/vmlinux":              "BTF",
+	}
+}
+
+func findResult(t *testing.T, results []checkResult, name string) checkResult {
+	t.Helper()
+	for _, r := range results {
+		if r.name == name {
+			return r
+		}
+	}
+	t.Fatalf("no %q check in %+v", name, results)
+	return checkResult{}
+}
+
+func TestRunChecks_HealthyHost(t *testing.T) {
+	results := runChecks(fakeHost(t, healthyHostFiles()), 0)
+	for _, r := range results {
+		if r.status != statusOK {
+			t.Fatalf("expected every check to pass, got %+v", r)
+		}
+	}
+	if r := findResult(t, results, "capabilities"); !strings.Contains(r.detail, "CAP_BPF") {
+		t.Fatalf("expected the capabilities to be listed, got %q", r.detail)
+	}
+}
+
+func TestRunChecks_Unprivileged(t *testing.T) {
+	files := healthyHostFiles()
+	files["proc/self/status"] = "CapEff:\t0000000000000000\n"
+	files["proc/kallsyms"] = "0000000000000000 A fixed_percpu_data\n0000000000000000 T _stext\n"
+	files["proc/self/mounts"] = "sysfs /sys sysfs rw 0 0\n"
+	delete(files, "sys/kernel/btf/vmlinux")
+	h := fakeHost(t, files)
+	h.loadBPF = func() error { return fmt.Errorf("loading bpf objects: %w", os.ErrPermission) }
+
+	results := runChecks(h, 0)
+	for name, want := range map[string]checkStatus{
+		"capabilities":               statusFail,
+		"kernel.perf_event_paranoid": statusFail,
+		"kernel symbols":             statusWarn,
+		"kernel BTF":                 statusFail,
+		"bpffs":                      statusWarn,
+		"BPF programs":               statusFail,
+	} {
+		r := findResult(t, results, name)
+		if r.status != want {
+			t.Fatalf("expected %s to be %v, got %+v", name, want, r)
+		}
+		if r.remedy == "" {
+			t.Fatalf("expected a remedy for %s, got %+v", name, r)
+		}
+	}
+	if r := findResult(t, results, "kernel symbols"); !strings.Contains(r.detail, "kptr_restrict=1") {
+		t.Fatalf("expected kptr_restrict to be reported, got %q", r.detail)
+	}
+}
+
+func TestRunChecks_Binaries(t *testing.T) {
+	files := healthyHostFiles()
+	files["proc/42/maps"] = strings.Join([]string{
+		"00400000-00500000 r-xp 00000000 08:01 1 /usr/bin/app",
+		"00500000-00600000 r--p 00100000 08:01 1 /usr/bin/app",
+		"7f0000000000-7f0000100000 r-xp 00000000 08:01 2 /usr/lib/libc.so.6",
+		"7f0000200000-7f0000300000 r--p 00000000 08:01 3 /usr/share/locale/data",
+		"7fff00000000-7fff00002000 r-xp 00000000 00:00 0 [vdso]",
+		"7fff00010000-7fff00020000 rw-p 00000000 00:00 0 [stack]",
+	}, "\n")
+	h := fakeHost(t, files)
+	var inspected []string
+	h.inspectBinary = func(pid int, path string) (symbolizer.BinarySymbols, error) {
+		if pid != 42 {
+			t.Fatalf("unexpected pid %d", pid)
+		}
+		inspected = append(inspected, path)
+		switch path {
+		case "/usr/bin/app":
+			return symbolizer.BinarySymbols{GoPclntab: true, Symtab: true}, nil
+		case "/usr/lib/libc.so.6":
+			return symbolizer.BinarySymbols{Dynsym: true}, nil
+		}
+		return symbolizer.BinarySymbols{}, errors.New("unexpected")
+	}
+
+	results := runChecks(h, 42)
+	if len(inspected) != 2 {
+		t.Fatalf("expected each executable mapping to be inspected once, got %v", inspected)
+	}
+	if r := findResult(t, results, "/usr/bin/app"); r.status != statusOK || r.detail != ".gopclntab, .symtab" {
+		t.Fatalf("unexpected result for the Go binary: %+v", r)
+	}
+	if r := findResult(t, results, "/usr/lib/libc.so.6"); r.status != statusWarn || !strings.Contains(r.detail, "only its exported functions") {
+		t.Fatalf("unexpected result for libc: %+v", r)
+	}
+}
+
+func TestRunChecks_MissingProcess(t *testing.T) {
+	results := runChecks(fakeHost(t, healthyHostFiles()), 42)
+	if r := findResult(t, results, "process 42"); r.status != statusFail || r.remedy == "" {
+		t.Fatalf("unexpected result for a missing process: %+v", r)
+	}
+}
+
+func TestRunChecks_MissingKernelFeatures(t *testing.T) {
+	h := fakeHost(t, healthyHostFiles())
+	h.loadBPF = func() error {
+		return &ebpf.LoadError{Err: unix.EINVAL, Missing: []string{"map type LRUCPUHash"}, VerifierLog: []string{"0: (b7) r0 = 0"}}
+	}
+	r := findResult(t, runChecks(h, 0), "BPF programs")
+	if r.status != statusFail || !strings.Contains(r.remedy, "map type LRUCPUHash") {
+		t.Fatalf("expected the missing feature to be the remedy, got %+v", r)
+	}
+}
+
+func TestRunChecks_KernelBTFFile(t *testing.T) {
+	files := healthyHostFiles()
+	delete(files, "sys/kernel/btf/vmlinux")
+	h := fakeHost(t, files)
+
+	h.kernelBTF = filepath.Join(t.TempDir(), "missing.btf")
+	if r := findResult(t, runChecks(h, 0), "kernel BTF"); r.status != statusFail {
+		t.Fatalf("expected a missing BTF file to fail, got %+v", r)
+	}
+
+	b, err := btf.NewBuilder([]btf.Type{&btf.Int{Name: "int", Size: 4, Encoding: btf.Signed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := b.Marshal(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.kernelBTF = filepath.Join(t.TempDir(), "kernel.btf")
+	if err := os.WriteFile(h.kernelBTF, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// usable, but not for everything
+	if r := findResult(t, runChecks(h, 0), "kernel BTF"); r.status != statusWarn || !strings.Contains(r.detail, h.kernelBTF) {
+		t.Fatalf("expected the BTF file to be used, got %+v", r)
+	}
+}
@@ -0,0 +1,160 @@
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// where the unified (v2) hierarchy is mounted on practically every modern distro
+const DefaultRoot = "/sys/fs/cgroup"
+
+// a cgroup v2 directory, as the BPF programs see it
+type Cgroup struct {
+	ID    uint64 // what bpf_get_current_cgroup_id returns, which is the inode number of the directory
+	Path  string // relative to the root of the hierarchy, e.g. /system.slice/nginx.service
+	Level int    // depth below the root (0 for the root itself), needed to match processes in descendant cgroups
+}
+
+// checks that root is the mount point of a cgroup v2 hierarchy; on hybrid/v1 setups cgroup ids don't mean anything
+func CheckV2(root string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(root, &st); err != nil {
+		return fmt.Errorf("statfs %s: %w", root, err)
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return fmt.Errorf("%s is not a cgroup v2 mount", root)
+	}
+	return nil
+}
+
+// path can be absolute (below root) or relative to root, so both /sys/fs/cgroup/system.slice and system.slice work
+func Lookup(root, path string) (Cgroup, error) {
+	rel := path
+	if filepath.IsAbs(path) {
+		r, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(r, "..") {
+			return Cgroup{}, fmt.Errorf("cgroup %s is not below %s", path, root)
+		}
+		rel = r
+	}
+	rel = "/" + strings.Trim(filepath.Clean("/"+rel), "/")
+
+	id, err := inode(filepath.Join(root, rel))
+	if err != nil {
+		return Cgroup{}, err
+	}
+	level := 0
+	if rel != "/" {
+		level = strings.Count(rel, "/")
+	}
+	return Cgroup{ID: id, Path: rel, Level: level}, nil
+}
+
+// returns the cgroup v2 path of a process, relative to the root of the hierarchy, as listed in /proc/<pid>/cgroup
+func ProcessPath(pid int) (string, error) {
+	return ProcessPathIn("/proc", pid)
+}
+
+// like ProcessPath, with procfs mounted at procRoot
+func ProcessPathIn(procRoot string, pid int) (string, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return parseProcCgroup(f, pid)
+}
+
+// the v2 entry is the one with hierarchy id 0 and no controllers: "0::/system.slice/nginx.service"
+func parseProcCgroup(r io.Reader, pid int) (string, error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if path, ok := strings.CutPrefix(sc.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("process %d is not in a cgroup v2 hierarchy", pid)
+}
+
+func inode(dir string) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return 0, fmt.Errorf("stat %s: %w", dir, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return 0, fmt.Errorf("%s is not a cgroup directory", dir)
+	}
+	return st.Ino, nil
+}
+
+// maps cgroup ids back to paths. The hierarchy is walked again whenever an id is not known yet, because cgroups are
+// created all the time (every container, every transient systemd unit); ids are never reused, so an id that is still
+// not found after that belongs to a cgroup that is already gone and is remembered as such.
+type Resolver struct {
+	root  string
+	mu    sync.Mutex
+	paths map[uint64]string
+}
+
+func NewResolver(root string) *Resolver {
+	return &Resolver{root: root, paths: make(map[uint64]string)}
+}
+
+func (r *Resolver) Path(id uint64) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.paths[id]; ok {
+		return pathOrErr(id, p)
+	}
+	if err := r.walk(); err != nil {
+		return "", err
+	}
+	p, ok := r.paths[id]
+	if !ok {
+		r.paths[id] = ""
+	}
+	return pathOrErr(id, p)
+}
+
+func pathOrErr(id uint64, p string) (string, error) {
+	if p == "" {
+		return "", fmt.Errorf("cgroup %d not found", id)
+	}
+	return p, nil
+}
+
+func (r *Resolver) walk() error {
+	return filepath.WalkDir(r.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// cgroups can disappear while we walk
+			if errors.Is(err, fs.ErrNotExist) && path != r.root {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		id, err := inode(path)
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(r.root, path)
+		r.paths[id] = "/" + strings.TrimPrefix(filepath.ToSlash(rel), ".")
+		return nil
+	})
+}
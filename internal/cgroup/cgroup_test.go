@@ -0,0 +1,129 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func mkCgroups(t *testing.T, dirs ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	return root
+}
+
+func inodeOf(t *testing.T, path string) uint64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestLookup(t *testing.T) {
+	root := mkCgroups(t, "system.slice/nginx.service")
+	wantID := inodeOf(t, filepath.Join(root, "system.slice/nginx.service"))
+
+	tests := []struct {
+		name string
+		path string
+		want Cgroup
+	}{
+		{"relative", "system.slice/nginx.service", Cgroup{ID: wantID, Path: "/system.slice/nginx.service", Level: 2}},
+		{"trailing slash", "system.slice/nginx.service/", Cgroup{ID: wantID, Path: "/system.slice/nginx.service", Level: 2}},
+		{"absolute", filepath.Join(root, "system.slice/nginx.service"), Cgroup{ID: wantID, Path: "/system.slice/nginx.service", Level: 2}},
+		{"root", root, Cgroup{ID: inodeOf(t, root), Path: "/", Level: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Lookup(root, tt.path)
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("unexpected cgroup: got %+v want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookup_Invalid(t *testing.T) {
+	root := mkCgroups(t, "system.slice")
+	if err := os.WriteFile(filepath.Join(root, "cgroup.procs"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	for _, path := range []string{"missing.slice", "cgroup.procs", "/somewhere/else"} {
+		if _, err := Lookup(root, path); err == nil {
+			t.Fatalf("expected error for %q", path)
+		}
+	}
+}
+
+func TestResolver_Path(t *testing.T) {
+	root := mkCgroups(t, "system.slice/nginx.service")
+	r := NewResolver(root)
+
+	got, err := r.Path(inodeOf(t, filepath.Join(root, "system.slice/nginx.service")))
+	if err != nil {
+		t.Fatalf("Path: %v", err)
+	}
+	if got != "/system.slice/nginx.service" {
+		t.Fatalf("unexpected path: %q", got)
+	}
+
+	got, err = r.Path(inodeOf(t, root))
+	if err != nil || got != "/" {
+		t.Fatalf("unexpected root path: %q, %v", got, err)
+	}
+}
+
+func TestResolver_PicksUpNewCgroups(t *testing.T) {
+	root := mkCgroups(t, "system.slice")
+	r := NewResolver(root)
+	if _, err := r.Path(inodeOf(t, filepath.Join(root, "system.slice"))); err != nil {
+		t.Fatalf("Path: %v", err)
+	}
+
+	dir := filepath.Join(root, "system.slice/run-u42.scope")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	got, err := r.Path(inodeOf(t, dir))
+	if err != nil {
+		t.Fatalf("Path: %v", err)
+	}
+	if got != "/system.slice/run-u42.scope" {
+		t.Fatalf("unexpected path: %q", got)
+	}
+}
+
+func TestResolver_UnknownID(t *testing.T) {
+	r := NewResolver(mkCgroups(t))
+	if _, err := r.Path(1); err == nil {
+		t.Fatal("expected error for unknown cgroup id")
+	}
+}
+
+func TestParseProcCgroup(t *testing.T) {
+	hybrid := "12:memory:/system.slice/nginx.service\n1:name=systemd:/system.slice/nginx.service\n0::/system.slice/nginx.service\n"
+	got, err := parseProcCgroup(strings.NewReader(hybrid), 1)
+	if err != nil {
+		t.Fatalf("parseProcCgroup: %v", err)
+	}
+	if got != "/system.slice/nginx.service" {
+		t.Fatalf("unexpected path: %q", got)
+	}
+
+	if _, err := parseProcCgroup(strings.NewReader("4:cpu,cpuacct:/docker/abc\n"), 1); err == nil {
+		t.Fatal("expected error for a cgroup v1 only process")
+	}
+}
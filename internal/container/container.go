@@ -0,0 +1,86 @@
+package container
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// identifies the container a sample was taken in and, on Kubernetes, the pod it belongs to. The zero value means the
+// process was not running in a (recognised) container.
+type Metadata struct {
+	ContainerID   string
+	ContainerName string
+	PodName       string
+	PodUID        string
+	Namespace     string
+}
+
+// provides the names that container runtimes don't put into cgroup paths
+type Source interface {
+	// ok is false if the source doesn't know the container (yet)
+	Lookup(containerID string) (md Metadata, ok bool, err error)
+}
+
+var (
+	// the last component of a container's cgroup, e.g. cri-containerd-<id>.scope with the systemd cgroup driver or
+	// just <id> with cgroupfs
+	containerIDRe = regexp.MustCompile(`^(?:(?:docker|cri-containerd|crio|libpod)-)?([0-9a-f]{64})(?:\.scope)?$`)
+	// kubepods-burstable-pod<uid>.slice (systemd, with the dashes of the uid turned into underscores) or pod<uid>
+	podUIDRe = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.slice)?$`)
+)
+
+// extracts what can be told from the cgroup path alone: the container id and, for Kubernetes pods, the pod uid
+func ParseCgroupPath(cgroupPath string) Metadata {
+	parts := strings.Split(strings.Trim(cgroupPath, "/"), "/")
+	var md Metadata
+	if m := containerIDRe.FindStringSubmatch(parts[len(parts)-1]); m != nil {
+		md.ContainerID = m[1]
+	}
+	for _, p := range parts {
+		if m := podUIDRe.FindStringSubmatch(p); m != nil {
+			md.PodUID = strings.ReplaceAll(m[1], "_", "-")
+		}
+	}
+	return md
+}
+
+// resolves cgroup paths to container metadata, filling in names from the source where it knows the container
+type Resolver struct {
+	source Source
+	mu     sync.Mutex
+	cache  map[string]Metadata // by cgroup path, only complete entries
+}
+
+// source can be nil, in which case only what's in the cgroup paths is reported
+func NewResolver(source Source) *Resolver {
+	return &Resolver{source: source, cache: make(map[string]Metadata)}
+}
+
+// returns the zero Metadata for cgroups that don't belong to a container
+func (r *Resolver) Resolve(cgroupPath string) (Metadata, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if md, ok := r.cache[cgroupPath]; ok {
+		return md, nil
+	}
+
+	md := ParseCgroupPath(cgroupPath)
+	if md.ContainerID == "" || r.source == nil {
+		r.cache[cgroupPath] = md
+		return md, nil
+	}
+
+	// containers we don't know about yet are looked up again next time, as the source may just be lagging behind
+	found, ok, err := r.source.Lookup(md.ContainerID)
+	if err != nil || !ok {
+		return md, err
+	}
+	if found.PodUID == "" {
+		found.PodUID = md.PodUID
+	}
+	found.ContainerID = md.ContainerID
+	r.cache[cgroupPath] = found
+	return found, nil
+}
@@ -0,0 +1,134 @@
+package container
+
+import (
+	"errors"
+	"testing"
+)
+
+const testID = "3f4e1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f"
+
+func TestParseCgroupPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want Metadata
+	}{
+		{
+			"systemd driver with containerd",
+			"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod8f2c3a1e_4b5d_4c6e_9f7a_1b2c3d4e5f6a.slice/cri-containerd-" + testID + ".scope",
+			Metadata{ContainerID: testID, PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"},
+		},
+		{
+			"systemd driver with cri-o, guaranteed qos",
+			"/kubepods.slice/kubepods-pod8f2c3a1e_4b5d_4c6e_9f7a_1b2c3d4e5f6a.slice/crio-" + testID + ".scope",
+			Metadata{ContainerID: testID, PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"},
+		},
+		{
+			"cgroupfs driver",
+			"/kubepods/besteffort/pod8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a/" + testID,
+			Metadata{ContainerID: testID, PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"},
+		},
+		{
+			"plain docker",
+			"/system.slice/docker-" + testID + ".scope",
+			Metadata{ContainerID: testID},
+		},
+		{
+			"pod sandbox slice",
+			"/kubepods.slice/kubepods-pod8f2c3a1e_4b5d_4c6e_9f7a_1b2c3d4e5f6a.slice",
+			Metadata{PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"},
+		},
+		{"systemd service", "/system.slice/nginx.service", Metadata{}},
+		{"root", "/", Metadata{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseCgroupPath(tt.path); got != tt.want {
+				t.Fatalf("unexpected metadata: got %+v want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver_FillsInNamesFromSource(t *testing.T) {
+	src := &fakeSource{containers: map[string]Metadata{
+		testID: {ContainerName: "app", PodName: "web-7d9f", Namespace: "shop", PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"},
+	}}
+	r := NewResolver(src)
+
+	path := "/kubepods/besteffort/pod8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a/" + testID
+	want := Metadata{ContainerID: testID, ContainerName: "app", PodName: "web-7d9f", Namespace: "shop", PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"}
+	for i := 0; i < 2; i++ {
+		got, err := r.Resolve(path)
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if got != want {
+			t.Fatalf("unexpected metadata: got %+v want %+v", got, want)
+		}
+	}
+	if src.lookups != 1 {
+		t.Fatalf("expected resolved containers to be cached, got %d lookups", src.lookups)
+	}
+}
+
+func TestResolver_RetriesUnknownContainers(t *testing.T) {
+	src := &fakeSource{containers: map[string]Metadata{}}
+	r := NewResolver(src)
+	path := "/system.slice/docker-" + testID + ".scope"
+
+	got, err := r.Resolve(path)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if got != (Metadata{ContainerID: testID}) {
+		t.Fatalf("expected only the container id, got %+v", got)
+	}
+
+	src.containers[testID] = Metadata{ContainerName: "app"}
+	got, err = r.Resolve(path)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if got.ContainerName != "app" {
+		t.Fatalf("expected the container to be looked up again, got %+v", got)
+	}
+}
+
+func TestResolver_SourceError(t *testing.T) {
+	r := NewResolver(&fakeSource{err: errors.New("kubelet down")})
+	got, err := r.Resolve("/system.slice/docker-" + testID + ".scope")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got.ContainerID != testID {
+		t.Fatalf("expected what's known from the cgroup path despite the error, got %+v", got)
+	}
+}
+
+func TestResolver_NoSource(t *testing.T) {
+	r := NewResolver(nil)
+	got, err := r.Resolve("/system.slice/docker-" + testID + ".scope")
+	if err != nil || got != (Metadata{ContainerID: testID}) {
+		t.Fatalf("unexpected result: %+v, %v", got, err)
+	}
+	got, err = r.Resolve("/user.slice/user-1000.slice")
+	if err != nil || got != (Metadata{}) {
+		t.Fatalf("expected no container outside of containers, got %+v, %v", got, err)
+	}
+}
+
+type fakeSource struct {
+	containers map[string]Metadata
+	err        error
+	lookups    int
+}
+
+func (f *fakeSource) Lookup(containerID string) (Metadata, bool, error) {
+	f.lookups++
+	if f.err != nil {
+		return Metadata{}, false, f.err
+	}
+	md, ok := f.containers[containerID]
+	return md, ok, nil
+}
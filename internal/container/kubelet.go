@@ -0,0 +1,135 @@
+package container
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the token of the pod's service account, which needs get on nodes/proxy to list the pods through the kubelet
+const ServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// how often the pod list may be fetched again because of a container we haven't seen yet
+const kubeletMinRefresh = 5 * time.Second
+
+// looks containers up in the pod list of the local kubelet (GET /pods), which is cheap and doesn't need access to the
+// API server, and covers exactly the pods of the node we are profiling
+type KubeletSource struct {
+	url       string
+	tokenFile string
+	client    *http.Client
+
+	mu          sync.Mutex
+	containers  map[string]Metadata // by container id
+	lastRefresh time.Time
+	now         func() time.Time
+}
+
+// url is the kubelet's base URL, e.g. https://$NODE_IP:10250. tokenFile is read on every request, because projected
+// tokens get rotated; a missing file means no Authorization header is sent. The kubelet's serving certificate is
+// usually self-signed, hence insecureTLS.
+func NewKubeletSource(url, tokenFile string, insecureTLS bool) *KubeletSource {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecureTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &KubeletSource{
+		url:        strings.TrimSuffix(url, "/"),
+		tokenFile:  tokenFile,
+		client:     &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		containers: make(map[string]Metadata),
+		now:        time.Now,
+	}
+}
+
+func (k *KubeletSource) Lookup(containerID string) (Metadata, bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if md, ok := k.containers[containerID]; ok {
+		return md, true, nil
+	}
+	if k.now().Sub(k.lastRefresh) < kubeletMinRefresh {
+		return Metadata{}, false, nil
+	}
+	k.lastRefresh = k.now()
+	if err := k.refresh(); err != nil {
+		return Metadata{}, false, err
+	}
+	md, ok := k.containers[containerID]
+	return md, ok, nil
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"metadata"`
+		Status struct {
+			InitContainerStatuses      []containerStatus `json:"initContainerStatuses"`
+			ContainerStatuses          []containerStatus `json:"containerStatuses"`
+			EphemeralContainerStatuses []containerStatus `json:"ephemeralContainerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type containerStatus struct {
+	Name        string `json:"name"`
+	ContainerID string `json:"containerID"` // <runtime>://<id>
+}
+
+func (k *KubeletSource) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, k.url+"/pods", nil)
+	if err != nil {
+		return err
+	}
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("listing pods from kubelet: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing pods from kubelet: %s", resp.Status)
+	}
+
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return fmt.Errorf("decoding kubelet pod list: %w", err)
+	}
+
+	containers := make(map[string]Metadata)
+	for _, pod := range pods.Items {
+		statuses := append(append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...), pod.Status.EphemeralContainerStatuses...)
+		for _, cs := range statuses {
+			_, id, ok := strings.Cut(cs.ContainerID, "://")
+			if !ok || id == "" {
+				continue // not started yet
+			}
+			containers[id] = Metadata{
+				ContainerID:   id,
+				ContainerName: cs.Name,
+				PodName:       pod.Metadata.Name,
+				PodUID:        pod.Metadata.UID,
+				Namespace:     pod.Metadata.Namespace,
+			}
+		}
+	}
+	k.containers = containers
+	return nil
+}
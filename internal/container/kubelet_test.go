@@ -0,0 +1,101 @@
+package container
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const podsJSON = `{"items": [{
+	"metadata": {"name": "web-7d9f", "namespace": "shop", "uid": "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a"},
+	"status": {
+		"initContainerStatuses": [{"name": "migrate", "containerID": "containerd://aaaa"}],
+		"containerStatuses": [
+			{"name": "app", "containerID": "containerd://` + testID + `"},
+			{"name": "pending", "containerID": ""}
+		]
+	}
+}]}`
+
+func TestKubeletSource_Lookup(t *testing.T) {
+	var requests int
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(podsJSON))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatalf("write token: %v", err)
+	}
+
+	k := NewKubeletSource(srv.URL+"/", tokenFile, false)
+	md, ok, err := k.Lookup(testID)
+	if err != nil || !ok {
+		t.Fatalf("Lookup: ok=%v err=%v", ok, err)
+	}
+	want := Metadata{ContainerID: testID, ContainerName: "app", PodName: "web-7d9f", PodUID: "8f2c3a1e-4b5d-4c6e-9f7a-1b2c3d4e5f6a", Namespace: "shop"}
+	if md != want {
+		t.Fatalf("unexpected metadata: got %+v want %+v", md, want)
+	}
+	if auth != "Bearer secret" {
+		t.Fatalf("unexpected Authorization header: %q", auth)
+	}
+
+	if md, ok, _ := k.Lookup("aaaa"); !ok || md.ContainerName != "migrate" {
+		t.Fatalf("init containers should be found too, got %+v", md)
+	}
+	if requests != 1 {
+		t.Fatalf("known containers should not refetch the pod list, got %d requests", requests)
+	}
+}
+
+func TestKubeletSource_RateLimitsRefreshes(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(podsJSON))
+	}))
+	defer srv.Close()
+
+	now := time.Unix(1000, 0)
+	k := NewKubeletSource(srv.URL, filepath.Join(t.TempDir(), "missing"), false)
+	k.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, ok, err := k.Lookup("unknown"); ok || err != nil {
+			t.Fatalf("unexpected result: ok=%v err=%v", ok, err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected a single refresh, got %d", requests)
+	}
+
+	now = now.Add(kubeletMinRefresh)
+	k.Lookup("unknown")
+	if requests != 2 {
+		t.Fatalf("expected a refresh after %v, got %d requests", kubeletMinRefresh, requests)
+	}
+}
+
+func TestKubeletSource_HTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	k := NewKubeletSource(srv.URL, filepath.Join(t.TempDir(), "missing"), false)
+	if _, _, err := k.Lookup(testID); err == nil {
+		t.Fatal("expected error")
+	}
+}
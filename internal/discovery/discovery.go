@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/cgroup"
+)
+
+// selects processes by what they run rather than by pid, which changes with every restart. The criteria that are set
+// must all match.
+type Matcher struct {
+	Exe     string         // base name of the executable, e.g. "nginx"
+	Cmdline *regexp.Regexp // matched against the command line, with the arguments separated by spaces
+	Unit    string         // systemd unit the process runs in, e.g. "nginx.service"; ".service" is implied
+}
+
+func (m Matcher) IsZero() bool {
+	return m.Exe == "" && m.Cmdline == nil && m.Unit == ""
+}
+
+func (m Matcher) String() string {
+	var parts []string
+	if m.Exe != "" {
+		parts = append(parts, "exe="+m.Exe)
+	}
+	if m.Cmdline != nil {
+		parts = append(parts, "cmdline="+m.Cmdline.String())
+	}
+	if m.Unit != "" {
+		parts = append(parts, "unit="+m.unit())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (m Matcher) unit() string {
+	if strings.Contains(m.Unit, ".") {
+		return m.Unit // .service, .scope, etc.
+	}
+	return m.Unit + ".service"
+}
+
+// whether the process matches; processes that can't be inspected, such as kernel threads (which have no executable)
+// or processes that just exited, don't
+func (m Matcher) matches(procRoot string, pid int) bool {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if m.Exe != "" {
+		exe, err := os.Readlink(filepath.Join(dir, "exe"))
+		if err != nil {
+			return false
+		}
+		// the binary may have been replaced by an upgrade since the process started
+		exe = strings.TrimSuffix(exe, " (deleted)")
+		if filepath.Base(exe) != m.Exe {
+			return false
+		}
+	}
+	if m.Cmdline != nil {
+		b, err := os.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil || len(b) == 0 {
+			return false
+		}
+		cmdline := string(bytes.ReplaceAll(bytes.TrimRight(b, "\x00"), []byte{0}, []byte{' '}))
+		if !m.Cmdline.MatchString(cmdline) {
+			return false
+		}
+	}
+	if m.Unit != "" {
+		path, err := cgroup.ProcessPathIn(procRoot, pid)
+		if err != nil {
+			return false
+		}
+		// the unit's own cgroup, or one below it, e.g. .../docker.service/<container> or a service's sub-cgroups
+		unit := m.unit()
+		if !strings.HasSuffix(path, "/"+unit) && !strings.Contains(path, "/"+unit+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// gets to know about the processes that start and stop matching
+type Handler interface {
+	Attach(pid int) error
+	Detach(pid int) error
+}
+
+// follows the processes matching a Matcher by scanning /proc, so that they are profiled across restarts: new
+// processes are attached to within an interval of starting (or exec'ing into a matching binary), and detached from
+// once they exit.
+type Watcher struct {
+	procRoot string
+	matcher  Matcher
+	interval time.Duration
+	handler  Handler
+	attached map[int]bool
+}
+
+func NewWatcher(matcher Matcher, interval time.Duration, handler Handler) *Watcher {
+	return &Watcher{procRoot: "/proc", matcher: matcher, interval: interval, handler: handler, attached: make(map[int]bool)}
+}
+
+// scans until ctx is done, starting right away
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if err := w.scan(); err != nil {
+			slog.Warn("Failed to scan processes", "matcher", w.matcher, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// attaches to the matching processes that aren't attached yet and detaches from those that no longer match.
+// Failures to attach are retried on the next scan.
+func (w *Watcher) scan() error {
+	entries, err := os.ReadDir(w.procRoot)
+	if err != nil {
+		return fmt.Errorf("listing processes: %w", err)
+	}
+
+	matching := make(map[int]bool)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue // not a process
+		}
+		if w.matcher.matches(w.procRoot, pid) {
+			matching[pid] = true
+		}
+	}
+
+	for pid := range matching {
+		if w.attached[pid] {
+			continue
+		}
+		if err := w.handler.Attach(pid); err != nil {
+			slog.Warn("Failed to attach to process", "pid", pid, "error", err)
+			continue
+		}
+		slog.Info("Attached to process", "pid", pid, "matcher", w.matcher)
+		w.attached[pid] = true
+	}
+	for pid := range w.attached {
+		if matching[pid] {
+			continue
+		}
+		// exited, or exec'd into something that doesn't match anymore
+		if err := w.handler.Detach(pid); err != nil {
+			slog.Warn("Failed to detach from process", "pid", pid, "error", err)
+			continue
+		}
+		slog.Info("Detached from process", "pid", pid)
+		delete(w.attached, pid)
+	}
+	return nil
+}
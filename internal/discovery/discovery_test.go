@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+type fakeProcess struct {
+	exe     string // symlink target; no link if empty, as for kernel threads
+	cmdline string // NUL-separated
+	cgroup  string
+}
+
+func addProcess(t *testing.T, procRoot string, pid int, p fakeProcess) {
+	t.Helper()
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if p.exe != "" {
+		if err := os.Symlink(p.exe, filepath.Join(dir, "exe")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cmdline"), []byte(p.cmdline), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::"+p.cgroup+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeProc(t *testing.T) string {
+	root := t.TempDir()
+	addProcess(t, root, 1, fakeProcess{exe: "/usr/lib/systemd/systemd", cmdline: "/sbin/init\x00", cgroup: "/init.scope"})
+	addProcess(t, root, 2, fakeProcess{cgroup: "/"}) // kthreadd
+	addProcess(t, root, 100, fakeProcess{exe: "/usr/sbin/nginx", cmdline: "nginx: master process /usr/sbin/nginx\x00", cgroup: "/system.slice/nginx.service"})
+	addProcess(t, root, 101, fakeProcess{exe: "/usr/sbin/nginx (deleted)", cmdline: "nginx: worker process\x00", cgroup: "/system.slice/nginx.service"})
+	addProcess(t, root, 200, fakeProcess{exe: "/usr/bin/java", cmdline: "java\x00-jar\x00/opt/orders/orders.jar\x00", cgroup: "/system.slice/orders.service/app"})
+	addProcess(t, root, 201, fakeProcess{exe: "/usr/bin/java", cmdline: "java\x00-jar\x00/opt/billing/billing.jar\x00", cgroup: "/system.slice/billing.service"})
+	if err := os.WriteFile(filepath.Join(root, "meminfo"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func matchingPIDs(procRoot string, m Matcher) []int {
+	var pids []int
+	for _, pid := range []int{1, 2, 100, 101, 200, 201} {
+		if m.matches(procRoot, pid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+func TestMatcher(t *testing.T) {
+	root := fakeProc(t)
+	tests := []struct {
+		name    string
+		matcher Matcher
+		want    []int
+	}{
+		{"exe", Matcher{Exe: "nginx"}, []int{100, 101}},
+		{"cmdline", Matcher{Cmdline: regexp.MustCompile(`-jar \S*orders\.jar`)}, []int{200}},
+		{"unit", Matcher{Unit: "nginx"}, []int{100, 101}},
+		{"unit sub-cgroup", Matcher{Unit: "orders.service"}, []int{200}},
+		{"unit scope", Matcher{Unit: "init.scope"}, []int{1}},
+		{"all criteria", Matcher{Exe: "java", Cmdline: regexp.MustCompile(`billing`), Unit: "billing"}, []int{201}},
+		{"criteria disagree", Matcher{Exe: "java", Unit: "nginx"}, nil},
+		{"no kernel threads", Matcher{Cmdline: regexp.MustCompile(`.*`)}, []int{1, 100, 101, 200, 201}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchingPIDs(root, tt.matcher); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeHandler struct {
+	attached  map[int]bool
+	attachErr error
+}
+
+func (h *fakeHandler) Attach(pid int) error {
+	if h.attachErr != nil {
+		return h.attachErr
+	}
+	h.attached[pid] = true
+	return nil
+}
+
+func (h *fakeHandler) Detach(pid int) error {
+	delete(h.attached, pid)
+	return nil
+}
+
+func TestWatcher_Scan(t *testing.T) {
+	root := fakeProc(t)
+	h := &fakeHandler{attached: make(map[int]bool), attachErr: errors.New("map full")}
+	w := NewWatcher(Matcher{Exe: "nginx"}, 0, h)
+	w.procRoot = root
+
+	// failed attaches are retried
+	if err := w.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.attached) != 0 {
+		t.Fatalf("expected no processes to be attached, got %v", w.attached)
+	}
+	h.attachErr = nil
+	if err := w.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.attached) != 2 || !h.attached[100] || !h.attached[101] {
+		t.Fatalf("expected both nginx processes to be attached, got %v", h.attached)
+	}
+
+	// the worker exits and gets restarted
+	if err := os.RemoveAll(filepath.Join(root, "101")); err != nil {
+		t.Fatal(err)
+	}
+	addProcess(t, root, 102, fakeProcess{exe: "/usr/sbin/nginx", cmdline: "nginx: worker process\x00", cgroup: "/system.slice/nginx.service"})
+	if err := w.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.attached) != 2 || !h.attached[100] || !h.attached[102] {
+		t.Fatalf("expected the restarted worker to replace the old one, got %v", h.attached)
+	}
+}
+
+func TestMatcher_String(t *testing.T) {
+	m := Matcher{Exe: "java", Cmdline: regexp.MustCompile(`orders`), Unit: "orders"}
+	if got := m.String(); got != "exe=java cmdline=orders unit=orders.service" {
+		t.Fatalf("unexpected string %q", got)
+	}
+	if !(Matcher{}).IsZero() || m.IsZero() {
+		t.Fatal("unexpected IsZero")
+	}
+}
@@ -3,10 +3,26 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_tracing.h>
+#include <bpf/bpf_core_read.h>
 
+/* defaults only: userspace resizes the maps at load time (see options.go) */
 #define MAX_STACKS 16384
 #define MAX_ENTRIES 65536
 #define MAX_STACK_FRAMES 127
+#define COMM_LEN 16
+#define TASK_RUNNING 0
+#define USER_STACK_COPY 8192 // bytes of user stack copied per sample for unwinding in userspace
+#define USER_STACKS_RING_SIZE (8 << 20)
+#define RAW_SAMPLES_RING_SIZE (1 << 20)
+#define MAX_FILTERS 1024
+#define MAX_CGROUP_DEPTH 16
+
+#define FILTER_ALLOW 1
+#define FILTER_DENY 2
+
+#define ENOMEM 12
+#define EFAULT 14
+#define EEXIST 17
 
 struct {
     __uint(type, BPF_MAP_TYPE_STACK_TRACE);
@@ -15,39 +31,424 @@ struct {
     __type(value, __u64[MAX_STACK_FRAMES]);
 } stacks SEC(".maps");
 
-struct {
+struct count_key {
+    u32 pid; // tgid, i.e. the process
+    u32 tid;
+    u64 cgroup_id; // cgroup v2 the thread was in
+    u32 user_stack_id;
+    u32 kernel_stack_id;
+    char comm[COMM_LEN];
+};
+
+struct counts_map {
     __uint(type, BPF_MAP_TYPE_LRU_PERCPU_HASH);
-    __type(key, u64);
+    __type(key, struct count_key);
     __type(value, u64);
     __uint(max_entries, MAX_ENTRIES);
-} counts SEC(".maps");
+};
 
+/* the counts are double-buffered: samples always go to the map in active_counts, while userspace swaps in the other
+   buffer, then reads and clears the one that was active. Updating a map-in-map from userspace waits for all running
+   BPF programs to finish, so once the swap returns nothing can be writing to the old buffer anymore. */
+struct counts_map counts_0 SEC(".maps");
+struct counts_map counts_1 SEC(".maps");
 
-SEC("perf_event")
-int on_sample(struct bpf_perf_event_data *ctx) {
-    int kernel_flags = BPF_F_REUSE_STACKID;       
-    int user_flags = BPF_F_USER_STACK | BPF_F_REUSE_STACKID;
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);
+    __uint(max_entries, 1);
+    __type(key, u32);
+    __array(values, struct counts_map);
+} active_counts SEC(".maps") = {
+    .values = { &counts_0 },
+};
 
-    int kernel_id = bpf_get_stackid(ctx, &stacks, kernel_flags);
-    int user_id = bpf_get_stackid(ctx, &stacks, user_flags);
+/* why samples got lost or are less trustworthy, read (and summed over CPUs) by userspace */
+enum stat {
+    STAT_SAMPLES,              // samples (on-CPU) or blocked intervals (off-CPU) of the target that were seen
+    STAT_SAMPLES_DROPPED,      // ... of which neither stack could be captured
+    STAT_STACK_COLLISIONS,     // stacks not recorded because their bucket already held a different stack
+    STAT_STACK_MAP_FULL,       // stacks not recorded because the stacks map ran out of space
+    STAT_STACK_ERRORS,         // any other failure to capture a stack (except for the expected -EFAULT, see below)
+    STAT_COUNTS_UPDATE_ERRORS, // counts (or off-CPU starts) that could not be stored
+    STAT_USER_STACKS_LOST,     // user stack copies that did not fit into the user_stacks ring buffer
+    STAT_RAW_SAMPLES_LOST,     // samples that did not fit into the raw_samples ring buffer
+    STAT_COUNTS_INSERTED_0,    // entries created in counts_0, see add_count
+    STAT_COUNTS_INSERTED_1,    // ... in counts_1
+    STAT_MAX,
+};
 
-    if (kernel_id < 0 && user_id < 0) // either might still be negative, though
-        return 0;
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, STAT_MAX);
+    __type(key, u32);
+    __type(value, u64);
+} stats SEC(".maps");
+
+/* process (tgid) to sample, set from userspace before the perf events are attached; 0 samples every process.
+   The perf events are opened system-wide, so that every thread of the target - including those created later - is
+   covered, and everything else is filtered out here before paying for the stack walk. */
+volatile u32 target_tgid = 0;
+
+/* cgroup v2 to sample, 0 samples every cgroup. Processes in descendant cgroups are sampled too, which is what
+   "everything in this service" means for systemd slices and container runtimes that nest cgroups; level is the depth
+   of the target below the root, at which the current task's ancestor has to be the target. */
+volatile u64 target_cgroup_id = 0;
+volatile u32 target_cgroup_level = 0;
+
+/* process filters on top of the target, edited from userspace at any time: processes matching a deny entry are never
+   sampled, and once there is any allow entry, only processes matching one are. Within each map the most specific
+   entry decides (the deepest cgroup, the longest comm prefix), across maps a deny wins. They are checked before any
+   stack is captured, so that filtered processes neither cost stack walks nor fill up the stacks map. */
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_FILTERS);
+    __type(key, u32); // tgid
+    __type(value, u32);
+} filter_pids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_FILTERS);
+    __type(key, u64); // cgroup v2 id, matching its descendants too
+    __type(value, u32);
+} filter_cgroups SEC(".maps");
+
+struct comm_prefix {
+    u32 prefixlen; // in bits, as LPM tries want it
+    char comm[COMM_LEN];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, MAX_FILTERS);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct comm_prefix);
+    __type(value, u32);
+} filter_comms SEC(".maps");
+
+/* set from userspace, so that samples only pay for the lookups when there are filters */
+volatile u32 filters_enabled = 0; // any entries at all
+volatile u32 filters_allow = 0;   // any allow entries
+
+/* a sample whose user stack still has to be unwound: the registers unwinding starts from and a copy of the top of
+   the stack, from sp upwards */
+struct user_stack_sample {
+    struct count_key key; // without user_stack_id
+    u64 value;
+    u64 ip;
+    u64 sp;
+    u64 bp;
+    u32 stack_len; // bytes of stack that could be copied
+    u8 stack[USER_STACK_COPY];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, USER_STACKS_RING_SIZE);
+} user_stacks SEC(".maps");
+
+/* set from userspace to stream every sample through raw_samples, in addition to counting it */
+volatile u32 stream_samples = 0;
+
+/* a single sample, for timelines that aggregated counts can't provide */
+struct raw_sample {
+    struct count_key key;
+    u64 ts;    // bpf_ktime_get_ns() when the sample was taken (on-CPU) or the thread blocked (off-CPU)
+    u64 value; // what was added to the counts
+    u32 cpu;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, RAW_SAMPLES_RING_SIZE);
+} raw_samples SEC(".maps");
+
+/* where, since when and on which CPU a thread has been blocked, recorded when it is switched out */
+struct off_cpu_start {
+    struct count_key key;
+    u64 ts;
+    u32 cpu;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, u32); // tid
+    __type(value, struct off_cpu_start);
+    __uint(max_entries, MAX_ENTRIES);
+} off_cpu_starts SEC(".maps");
+
+/* task_struct->state was renamed to __state in 5.14 */
+struct task_struct___new {
+    unsigned int __state;
+} __attribute__((preserve_access_index));
+
+struct task_struct___old {
+    long state;
+} __attribute__((preserve_access_index));
+
+static __always_inline long task_state(struct task_struct *t) {
+    if (bpf_core_field_exists(((struct task_struct___new *)t)->__state))
+        return BPF_CORE_READ((struct task_struct___new *)t, __state);
+    return BPF_CORE_READ((struct task_struct___old *)t, state);
+}
+
+/* the action of the deepest cgroup in filter_cgroups the current task is in, 0 if there is none */
+static __always_inline u32 cgroup_filter(void) {
+    u32 action = 0;
+    for (int level = 0; level < MAX_CGROUP_DEPTH; level++) {
+        u64 id = bpf_get_current_ancestor_cgroup_id(level);
+        if (!id) // below the task's own cgroup
+            break;
+        u32 *a = bpf_map_lookup_elem(&filter_cgroups, &id);
+        if (a)
+            action = *a;
+    }
+    return action;
+}
+
+static __always_inline bool passes_filters(u32 tgid) {
+    if (!filters_enabled)
+        return true;
+    bool allowed = false;
+
+    u32 *action = bpf_map_lookup_elem(&filter_pids, &tgid);
+    if (action) {
+        if (*action == FILTER_DENY)
+            return false;
+        allowed = true;
+    }
+
+    u32 cgroup_action = cgroup_filter();
+    if (cgroup_action == FILTER_DENY)
+        return false;
+    allowed |= cgroup_action == FILTER_ALLOW;
+
+    struct comm_prefix key = {.prefixlen = COMM_LEN * 8};
+    bpf_get_current_comm(&key.comm, sizeof(key.comm));
+    action = bpf_map_lookup_elem(&filter_comms, &key);
+    if (action) {
+        if (*action == FILTER_DENY)
+            return false;
+        allowed = true;
+    }
+    return allowed || !filters_allow;
+}
+
+static __always_inline bool is_target(u32 tgid) {
+    if (tgid == 0) // idle task
+        return false;
+    if (target_tgid != 0 && tgid != target_tgid)
+        return false;
+    if (target_cgroup_id != 0 && bpf_get_current_ancestor_cgroup_id(target_cgroup_level) != target_cgroup_id)
+        return false;
+    return passes_filters(tgid);
+}
 
+static __always_inline void inc_stat(u32 stat) {
+    u64 *val = bpf_map_lookup_elem(&stats, &stat);
+    if (val)
+        (*val)++;
+}
+
+/* -EFAULT just means there was no stack to walk, e.g. no kernel stack for samples taken in user mode, or no user
+   stack in kernel threads */
+static __always_inline void count_stack_error(int id) {
+    if (id >= 0 || id == -EFAULT)
+        return;
+    if (id == -EEXIST)
+        inc_stat(STAT_STACK_COLLISIONS);
+    else if (id == -ENOMEM)
+        inc_stat(STAT_STACK_MAP_FULL);
+    else
+        inc_stat(STAT_STACK_ERRORS);
+}
+
+/* fills in the key for the current thread, returns false if neither stack could be captured. user_stack is false
+   when the user stack is copied for unwinding in userspace instead, in which case it is left out of the key.
+   Stacks are not recorded with BPF_F_REUSE_STACKID: on a hash collision that would replace the stack behind an id
+   that counts may still refer to, attributing them to the wrong stack. Losing the new stack instead is detectable. */
+static __always_inline bool capture_key(void *ctx, u64 pid_tgid, struct count_key *key, bool user_stack) {
+    int kernel_id = bpf_get_stackid(ctx, &stacks, 0);
+    int user_id = user_stack ? bpf_get_stackid(ctx, &stacks, BPF_F_USER_STACK) : -EFAULT;
+    count_stack_error(kernel_id);
+    count_stack_error(user_id);
+
+    if (kernel_id < 0 && user_id < 0 && user_stack) { // either might still be negative, though
+        inc_stat(STAT_SAMPLES_DROPPED);
+        return false;
+    }
+
+    key->pid = pid_tgid >> 32;
+    key->tid = (u32)pid_tgid;
+    key->cgroup_id = bpf_get_current_cgroup_id();
     /* normalize negatives to 0xffffffff to keep a stable 32-bit slot, or handle errors specially */
-    u32 k = (kernel_id < 0) ? (u32)0xFFFFFFFF : (u32)kernel_id;
-    u32 u = (user_id < 0) ? (u32)0xFFFFFFFF : (u32)user_id;
+    key->kernel_stack_id = (kernel_id < 0) ? (u32)0xFFFFFFFF : (u32)kernel_id;
+    key->user_stack_id = (user_id < 0) ? (u32)0xFFFFFFFF : (u32)user_id;
+    bpf_get_current_comm(&key->comm, sizeof(key->comm));
+    return true;
+}
 
-    u64 key = ((u64)u << 32) | (u64)k;
+/* the counts maps are LRU maps, which evict silently when they are full. To tell how many entries got lost that way,
+   the entries created in each buffer are counted in the stats, which userspace compares with the number of entries it
+   drains from that buffer. They can't be counted in the buffers themselves, where they would be evicted like any
+   other entry. */
+static __always_inline void add_count(struct count_key *key, u64 value) {
+    u32 zero = 0;
+    void *counts = bpf_map_lookup_elem(&active_counts, &zero);
+    if (!counts)
+        return;
 
-    u64 *val = bpf_map_lookup_elem(&counts, &key);
+    u64 *val = bpf_map_lookup_elem(counts, key);
     if (val) {
-        *val += 1; // safe, because it's a per-CPU map
-    } else {
-        u64 init = 1;
-        bpf_map_update_elem(&counts, &key, &init, BPF_ANY);
+        *val += value; // safe, because it's a per-CPU map
+        return;
+    }
+
+    long err = bpf_map_update_elem(counts, key, &value, BPF_NOEXIST);
+    if (err == -EEXIST) { // just created on another CPU
+        val = bpf_map_lookup_elem(counts, key);
+        if (val)
+            *val += value;
+        return;
+    }
+    if (err) {
+        inc_stat(STAT_COUNTS_UPDATE_ERRORS);
+        return;
+    }
+    inc_stat(counts == (void *)&counts_1 ? STAT_COUNTS_INSERTED_1 : STAT_COUNTS_INSERTED_0);
+}
+
+static __always_inline void emit_raw_sample(struct count_key *key, u64 value, u64 ts, u32 cpu) {
+    if (!stream_samples)
+        return;
+    struct raw_sample *s = bpf_ringbuf_reserve(&raw_samples, sizeof(*s), 0);
+    if (!s) {
+        inc_stat(STAT_RAW_SAMPLES_LOST);
+        return;
+    }
+    s->key = *key;
+    s->ts = ts;
+    s->value = value;
+    s->cpu = cpu;
+    bpf_ringbuf_submit(s, 0);
+}
+
+/* the user registers are only read on x86-64; elsewhere they stay 0 and no stack is copied */
+struct pt_regs___x86 {
+    unsigned long ip;
+    unsigned long sp;
+    unsigned long bp;
+} __attribute__((preserve_access_index));
+
+/* bpf_get_stackid walks user stacks with frame pointers, which most distro libraries and -fomit-frame-pointer
+   binaries don't keep. Instead, this copies the top of the user stack together with the registers, and userspace
+   unwinds it with the .eh_frame/.debug_frame of the mapped binaries. Returns false if the ring buffer was full. */
+static __always_inline bool submit_user_stack(struct count_key *key, u64 value) {
+    struct user_stack_sample *s = bpf_ringbuf_reserve(&user_stacks, sizeof(*s), 0);
+    if (!s) {
+        inc_stat(STAT_USER_STACKS_LOST);
+        return false;
     }
+    s->key = *key;
+    s->value = value;
+    s->ip = 0;
+    s->sp = 0;
+    s->bp = 0;
+    s->stack_len = 0;
+
+    /* the registers saved on entry to the kernel, i.e. where user space was interrupted; kernel threads have none */
+    struct task_struct *task = bpf_get_current_task_btf();
+    struct pt_regs___x86 *regs = (struct pt_regs___x86 *)bpf_task_pt_regs(task);
+    if (BPF_CORE_READ(task, mm) && bpf_core_field_exists(regs->ip)) {
+        s->ip = BPF_CORE_READ(regs, ip);
+        s->sp = BPF_CORE_READ(regs, sp);
+        s->bp = BPF_CORE_READ(regs, bp);
+    }
+
+    if (s->sp) {
+        /* the copy fails as a whole when the window runs past the top of the stack, so retry with smaller ones */
+        u32 len = USER_STACK_COPY;
+        for (int i = 0; i < 4; i++) {
+            if (bpf_probe_read_user(s->stack, len, (void *)s->sp) == 0) {
+                s->stack_len = len;
+                break;
+            }
+            len /= 2;
+        }
+    }
+    bpf_ringbuf_submit(s, 0);
+    return true;
+}
+
+/* on-CPU: every sample stands for sample_period occurrences of the perf event (nanoseconds for cpu-clock) */
+static __always_inline int sample(struct bpf_perf_event_data *ctx, bool unwind_user_stack) {
+    u64 pid_tgid = bpf_get_current_pid_tgid();
+    if (!is_target(pid_tgid >> 32))
+        return 0;
+    inc_stat(STAT_SAMPLES);
+
+    struct count_key key = {};
+    if (!capture_key(ctx, pid_tgid, &key, !unwind_user_stack))
+        return 0;
+    emit_raw_sample(&key, ctx->sample_period, bpf_ktime_get_ns(), bpf_get_smp_processor_id());
+
+    /* samples whose stack copy got lost are still counted, without user stack */
+    if (unwind_user_stack && submit_user_stack(&key, ctx->sample_period))
+        return 0;
+    add_count(&key, ctx->sample_period);
+    return 0;
+}
+
+SEC("perf_event")
+int on_sample(struct bpf_perf_event_data *ctx) {
+    return sample(ctx, false);
+}
+
+/* copies the user stacks for unwinding in userspace (see submit_user_stack). A program of its own, as reading the
+   user registers needs a kernel with BTF, which on_sample can do without. */
+SEC("perf_event")
+int on_sample_unwind(struct bpf_perf_event_data *ctx) {
+    return sample(ctx, true);
+}
+
+/* off-CPU: the time between a thread blocking and being woken up, in nanoseconds */
+static __always_inline void finish_off_cpu(u32 tid, u64 now) {
+    struct off_cpu_start *start = bpf_map_lookup_elem(&off_cpu_starts, &tid);
+    if (!start)
+        return;
+    if (now > start->ts) {
+        add_count(&start->key, now - start->ts);
+        emit_raw_sample(&start->key, now - start->ts, start->ts, start->cpu);
+    }
+    bpf_map_delete_elem(&off_cpu_starts, &tid);
+}
+
+SEC("tp_btf/sched_switch")
+int BPF_PROG(on_sched_switch, bool preempt, struct task_struct *prev, struct task_struct *next) {
+    u64 now = bpf_ktime_get_ns();
+
+    /* the tracepoint fires in the context of prev, so the current stacks are the ones it blocks in.
+       Preempted threads are still runnable, so only voluntary switches count as off-CPU time. */
+    u64 pid_tgid = bpf_get_current_pid_tgid();
+    if (is_target(pid_tgid >> 32) && task_state(prev) != TASK_RUNNING) {
+        inc_stat(STAT_SAMPLES);
+        struct off_cpu_start start = {};
+        if (capture_key(ctx, pid_tgid, &start.key, true)) {
+            start.ts = now;
+            start.cpu = bpf_get_smp_processor_id();
+            if (bpf_map_update_elem(&off_cpu_starts, &start.key.tid, &start, BPF_ANY))
+                inc_stat(STAT_COUNTS_UPDATE_ERRORS);
+        }
+    }
+
+    /* normally accounted for on wakeup already, this catches wakeups we did not see */
+    finish_off_cpu(BPF_CORE_READ(next, pid), now);
+    return 0;
+}
 
+SEC("tp_btf/sched_wakeup")
+int BPF_PROG(on_sched_wakeup, struct task_struct *p) {
+    finish_off_cpu(BPF_CORE_READ(p, pid), bpf_ktime_get_ns());
     return 0;
 }
 
@@ -3,116 +3,483 @@ package ebpf
 import (
 	"errors"
 	"fmt"
-	"runtime"
+	"log/slog"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"golang.org/x/sys/unix"
+	ciliumebpf "github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/ringbuf"
 )
 
+const missingSentinel = 0xFFFFFFFF // as used in the C code
+
+type ProfileType int
+
 const (
-	missingSentinel = 0xFFFFFFFF // as used in the C code
-	maxStackFrames  = 127        // max frames in the stacks map (must match what the C code expects)
+	// samples stacks on a perf event (by default the CPU clock) while threads are running; values are totals of the
+	// event, e.g. nanoseconds of CPU time or number of page faults
+	OnCPU ProfileType = iota
+	// records the stacks threads block in (locks, I/O, sleeps, etc.); values are the nanoseconds spent blocked
+	OffCPU
 )
 
+func (t ProfileType) String() string {
+	switch t {
+	case OnCPU:
+		return "on-cpu"
+	case OffCPU:
+		return "off-cpu"
+	default:
+		return fmt.Sprintf("ProfileType(%d)", int(t))
+	}
+}
+
+// AllProcesses can be used as Target.PID to sample every process on the host
+const AllProcesses = -1
+
+// what to profile: a single process, the processes in a cgroup, or everything (AllProcesses and no cgroup)
+type Target struct {
+	PID         int    // process (tgid) to sample, or AllProcesses
+	CgroupID    uint64 // if non-zero, only processes in this cgroup v2 or its descendants are sampled
+	CgroupLevel int    // depth of the cgroup below the root of the hierarchy (see cgroup.Cgroup)
+	// if set, only processes an allow Filter matches are sampled, and none while there are none; for processes that
+	// come and go, which are allowed by pid as they are found
+	AllowedOnly bool
+}
+
+// identifies one entry of the counts map: a user and kernel stack pair sampled in a given thread
+type CountKey struct {
+	PID           uint32 // the process (tgid)
+	TID           uint32
+	CgroupID      uint64
+	Comm          string
+	UserStackID   uint32
+	KernelStackID uint32
+}
+
+// tells how trustworthy a profile is: every counter is a total since Start
+type Stats struct {
+	Samples         uint64 // samples (on-CPU) or blocked intervals (off-CPU) of the target seen by the BPF programs
+	SamplesDropped  uint64 // samples for which neither stack could be captured
+	StackCollisions uint64 // stacks lost because a different stack hashed to the same stack id
+	StackMapFull    uint64 // stacks lost because the stacks map ran out of space (Options.StackMapSize is too small)
+	StackErrors     uint64 // stacks lost for any other reason
+	CountsEvicted   uint64 // counts entries evicted from the LRU counts map before they were collected
+	CountsErrors    uint64 // counts that could not be stored
+	LookupFailures  uint64 // stack ids whose frames were no longer in the stacks map when they were looked up
+
+	// with Options.UserStackUnwinder only
+	UserStacksLost      uint64 // user stack copies that didn't fit into the ring buffer; counted without user stack
+	UserStacksTruncated uint64 // user stacks whose unwinding stopped before the outermost frame
+
+	// with Options.StreamSamples only
+	RawSamplesLost uint64 // raw samples that didn't fit into the ring buffer or that the consumer wasn't ready for
+}
+
 type EbpfBackend struct {
-	objs    profileObjects
-	perfFDs []int
-	mu      sync.Mutex
-	started bool
+	objs         profileObjects
+	perfEvents   map[int]*perfEventAttachment // by CPU
+	event        PerfEvent                    // what perfEvents sample on, to open it on CPUs that come online
+	sampleHz     uint64
+	possibleCPUs int // the number of values in per-CPU maps
+	links        []link.Link
+	activeCounts int // index of the counts buffer (Counts0 or Counts1) currently in active_counts
+	stackFrames  int // value size of the stacks map, in frames
+	mu           sync.Mutex
+	started      bool
+
+	// the stats only known in userspace
+	countsEvicted  uint64
+	lookupFailures uint64
+	countsInserted [2]uint64 // STAT_COUNTS_INSERTED_0 and _1 as of the last drain of each buffer
+
+	// unwinding of user stacks in userspace, see user_stacks.go
+	unwinder       UserStackUnwinder
+	userStacks     *ringbuf.Reader
+	userStacksDone sync.WaitGroup
+	unwoundStacks  map[uint32][]uint64 // by the ids handed out by the last snapshot
+
+	unwoundMu           sync.Mutex // the unwound counts are added by the ring buffer reader
+	unwoundCounts       map[unwoundKey]uint64
+	userStacksTruncated uint64
+
+	// streaming of raw samples, see raw_samples.go
+	streamSamples     bool
+	rawSamples        *ringbuf.Reader
+	rawSamplesCh      chan RawSample
+	rawSamplesDone    sync.WaitGroup
+	rawSamplesDropped atomic.Uint64
+
+	// pinning of the counts and the attached programs, see pinning.go
+	pinPath  string
+	pinState *ciliumebpf.Map
+
+	filters     map[Filter]FilterAction // as set in the filter maps, see filters.go
+	allowedOnly bool                    // Target.AllowedOnly
 }
 
-func NewEbpfBackend() (*EbpfBackend, error) {
-	var e EbpfBackend
-	if err := loadProfileObjects(&e.objs, nil); err != nil {
-		return nil, fmt.Errorf("loading bpf objects: %w", err)
+func NewEbpfBackend(opts Options) (*EbpfBackend, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(perfEventMaxStack()); err != nil {
+		return nil, err
+	}
+
+	spec, err := loadProfile()
+	if err != nil {
+		return nil, fmt.Errorf("loading bpf spec: %w", err)
+	}
+	if err := opts.apply(spec); err != nil {
+		return nil, err
+	}
+
+	possibleCPUs, err := ciliumebpf.PossibleCPU()
+	if err != nil {
+		return nil, fmt.Errorf("getting possible CPUs: %w", err)
+	}
+
+	e := &EbpfBackend{
+		stackFrames:   opts.StackFrames,
+		possibleCPUs:  possibleCPUs,
+		unwinder:      opts.UserStackUnwinder,
+		streamSamples: opts.StreamSamples,
+		pinPath:       opts.PinPath,
+	}
+	var loadOpts ciliumebpf.CollectionOptions
+	if opts.VerboseVerifierLog {
+		// the log starts out at the default size, and is grown until the verifier's output fits
+		loadOpts.Programs.LogLevel = ciliumebpf.LogLevelInstruction | ciliumebpf.LogLevelStats
+	}
+	if opts.KernelBTF != "" {
+		kernelTypes, err := btf.LoadSpec(opts.KernelBTF)
+		if err != nil {
+			return nil, fmt.Errorf("loading kernel BTF from %s: %w", opts.KernelBTF, err)
+		}
+		loadOpts.Programs.KernelTypes = kernelTypes
 	}
-	return &e, nil
+	if opts.PinPath != "" {
+		if err := os.MkdirAll(opts.PinPath, 0o700); err != nil {
+			return nil, fmt.Errorf("creating pin path: %w", err)
+		}
+		loadOpts.Maps.PinPath = opts.PinPath
+	}
+	kernelBTF := haveKernelBTF()
+	if opts.UserStackUnwinder != nil && !kernelBTF {
+		return nil, errors.New("unwinding user stacks in userspace needs a kernel with BTF (/sys/kernel/btf/vmlinux) to read the user registers")
+	}
+	if err := e.load(spec, loadOpts, opts.UserStackUnwinder != nil, kernelBTF); err != nil {
+		return nil, err
+	}
+	if err := opts.check(&e.objs); err != nil {
+		e.objs.Close()
+		return nil, err
+	}
+	if opts.PinPath != "" {
+		if e.pinState, err = openPinnedState(opts.PinPath); err != nil {
+			e.objs.Close()
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
-func (e *EbpfBackend) Start(targetPID int, samplingPeriodNs uint64) error {
+// loads the maps and the programs that can be used: only one of the on-CPU programs, and the off-CPU programs only
+// if the kernel has BTF, without which they can't be loaded at all. Maps pinned by a previous backend are reused, and
+// counts_0 is made the active counts buffer either way.
+func (e *EbpfBackend) load(spec *ciliumebpf.CollectionSpec, opts ciliumebpf.CollectionOptions, unwind, kernelBTF bool) error {
+	spec = spec.Copy()
+	if unwind {
+		delete(spec.Programs, "on_sample")
+	} else {
+		delete(spec.Programs, "on_sample_unwind")
+	}
+	if !kernelBTF {
+		delete(spec.Programs, "on_sched_switch")
+		delete(spec.Programs, "on_sched_wakeup")
+	}
+
+	coll, err := ciliumebpf.NewCollectionWithOptions(spec, opts)
+	if errors.Is(err, ciliumebpf.ErrMapIncompatible) {
+		return fmt.Errorf("the maps pinned in %s were created with other sizes or by an incompatible version; remove the directory to discard them: %w", opts.Maps.PinPath, err)
+	}
+	if err != nil {
+		return newLoadError(spec, err)
+	}
+	defer coll.Close() // whatever wasn't taken out of it below
+	if err := coll.Assign(&e.objs.profileMaps); err != nil {
+		return err
+	}
+	if err := coll.Assign(&e.objs.profileVariables); err != nil {
+		e.objs.profileMaps.Close()
+		return err
+	}
+	e.objs.OnSample = coll.DetachProgram("on_sample")
+	e.objs.OnSampleUnwind = coll.DetachProgram("on_sample_unwind")
+	e.objs.OnSchedSwitch = coll.DetachProgram("on_sched_switch")
+	e.objs.OnSchedWakeup = coll.DetachProgram("on_sched_wakeup")
+	return nil
+}
+
+// the kernel's own BTF, which is what BTF-typed hooks and helpers are resolved against, unlike the CO-RE relocations,
+// for which Options.KernelBTF can stand in
+func haveKernelBTF() bool {
+	_, err := os.Stat("/sys/kernel/btf/vmlinux")
+	return err == nil
+}
+
+// the program the perf events are attached to
+func (e *EbpfBackend) sampleProgram() *ciliumebpf.Program {
+	if e.unwinder != nil {
+		return e.objs.OnSampleUnwind
+	}
+	return e.objs.OnSample
+}
+
+// event and sampleHz only apply to OnCPU profiles
+func (e *EbpfBackend) Start(target Target, profileType ProfileType, event PerfEvent, sampleHz uint64) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	if e.started {
 		return errors.New("profiler already attached")
 	}
 
-	prog := e.objs.profilePrograms.OnSample
-	if prog == nil {
-		return errors.New("BPF program OnSample is nil")
+	// the perf events and tracepoints are system-wide and the BPF programs only keep samples of the target process
+	// or cgroup, which is how all of its threads get covered, including the ones created after we attach
+	var targetTgid uint32 // 0 keeps every process
+	if target.PID != AllProcesses {
+		if target.PID <= 0 {
+			return fmt.Errorf("invalid target pid %d", target.PID)
+		}
+		targetTgid = uint32(target.PID)
+	}
+	if err := e.objs.TargetTgid.Set(targetTgid); err != nil {
+		return fmt.Errorf("setting target pid %d: %w", target.PID, err)
+	}
+	if target.CgroupLevel < 0 {
+		return fmt.Errorf("invalid target cgroup level %d", target.CgroupLevel)
+	}
+	if err := e.objs.TargetCgroupId.Set(target.CgroupID); err != nil {
+		return fmt.Errorf("setting target cgroup %d: %w", target.CgroupID, err)
+	}
+	if err := e.objs.TargetCgroupLevel.Set(uint32(target.CgroupLevel)); err != nil {
+		return fmt.Errorf("setting target cgroup level %d: %w", target.CgroupLevel, err)
 	}
 
-	progFD := prog.FD()
-	if progFD < 0 {
-		return errors.New("invalid program FD")
+	e.allowedOnly = target.AllowedOnly
+	if err := e.syncFilterFlags(); err != nil {
+		return err
 	}
 
-	err := e.createPerfEventsAndAttach(progFD, targetPID, samplingPeriodNs)
-	if err != nil {
+	if e.unwinder != nil && profileType != OnCPU {
+		return errors.New("unwinding user stacks in userspace is only supported for on-CPU profiles")
+	}
+	if err := e.objs.StreamSamples.Set(boolToUint32(e.streamSamples)); err != nil {
+		return fmt.Errorf("setting sample streaming: %w", err)
+	}
+	state := newPinnedState(target, targetTgid, profileType, event, e.unwinder != nil)
+	if e.pinPath != "" {
+		if err := e.takeOverPinned(state); err != nil {
+			return err
+		}
+	}
+	if e.streamSamples {
+		if err := e.startRawSamplesReader(); err != nil {
+			return err
+		}
+	}
+	if err := e.attach(profileType, event, sampleHz); err != nil {
+		e.stopRawSamplesReader()
 		return err
 	}
+	if e.pinPath != "" {
+		if err := e.pinAttachments(state); err != nil {
+			e.unpinAttachments()
+			e.detach()
+			return err
+		}
+	}
 
+	e.countsEvicted, e.lookupFailures, e.userStacksTruncated = 0, 0, 0
 	e.started = true
 	return nil
 }
 
+// attaches the programs of profileType
+func (e *EbpfBackend) attach(profileType ProfileType, event PerfEvent, sampleHz uint64) error {
+	switch profileType {
+	case OnCPU:
+		if e.sampleProgram() == nil {
+			return errors.New("BPF program OnSample is nil")
+		}
+		if e.unwinder != nil {
+			if err := e.startUserStacksReader(); err != nil {
+				return err
+			}
+		}
+		if err := e.attachPerfEvents(event, sampleHz); err != nil {
+			e.stopUserStacksReader()
+			return err
+		}
+	case OffCPU:
+		if e.objs.OnSchedSwitch == nil {
+			return errors.New("off-CPU profiles need a kernel with BTF (/sys/kernel/btf/vmlinux), which the sched tracepoints are attached through")
+		}
+		if err := e.attachSchedTracepoints(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown profile type %v", profileType)
+	}
+	return nil
+}
+
 func (e *EbpfBackend) Stop() error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	if !e.started {
 		// still close objects
+		_ = e.pinState.Close()
 		_ = e.objs.Close()
 		return nil
 	}
 
-	var resultErr error
-	// disable and close perf fds
-	for _, fd := range e.perfFDs {
-		_ = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0)
-		if err := unix.Close(fd); err != nil {
-			resultErr = fmt.Errorf("close perf fd: %w", err)
-		}
-	}
-	e.perfFDs = nil
+	resultErr := e.detach()
 	e.started = false
 
-	// close maps & programs
+	// close maps & programs; pinned ones live on in their pins
+	if err := e.pinState.Close(); err != nil && resultErr == nil {
+		resultErr = fmt.Errorf("closing pinned state: %w", err)
+	}
 	if err := e.objs.Close(); err != nil && resultErr == nil {
 		resultErr = fmt.Errorf("closing BPF objects: %w", err)
 	}
 	return resultErr
 }
 
-// reads and merges the per-CPU stackId -> counts map
-func (e *EbpfBackend) SnapshotCounts() (map[uint64]uint64, error) {
+// detaches the programs, unless their links are pinned, and stops reading the ring buffers
+func (e *EbpfBackend) detach() error {
+	var resultErr error
+	for _, pe := range e.perfEvents {
+		if err := pe.Close(); err != nil {
+			resultErr = fmt.Errorf("close perf event: %w", err)
+		}
+	}
+	e.perfEvents = nil
+	for _, l := range e.links {
+		if err := l.Close(); err != nil {
+			resultErr = fmt.Errorf("close link: %w", err)
+		}
+	}
+	e.links = nil
+	e.stopUserStacksReader()
+	e.stopRawSamplesReader()
+	return resultErr
+}
+
+// returns the counts sampled since the previous snapshot (or since Start), merged across CPUs, except the ones held
+// back for the next snapshot: the counts are double-buffered (see profile.c), and a BPF program that started before
+// the buffers were swapped may still be adding to the one swapped out. So each snapshot drains the buffer the
+// previous one swapped out, which had a whole interval for those programs to finish, and then swaps the buffers
+// again; the counts of each interval are returned one snapshot late. FlushCounts returns them all.
+func (e *EbpfBackend) SnapshotCounts() (map[CountKey]uint64, error) {
+	return e.snapshotCounts(false)
+}
+
+// returns the counts sampled since the previous snapshot, including the ones SnapshotCounts would hold back, for
+// the final snapshot before Stop. The buffer that was active is drained after countsGracePeriod.
+func (e *EbpfBackend) FlushCounts() (map[CountKey]uint64, error) {
+	return e.snapshotCounts(true)
+}
+
+// BPF programs can't sleep and run for microseconds, so the ones still adding to a swapped out buffer are done well
+// within this
+const countsGracePeriod = 10 * time.Millisecond
+
+func (e *EbpfBackend) snapshotCounts(flush bool) (map[CountKey]uint64, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	if !e.started {
 		return nil, errors.New("profiler not started")
 	}
+	e.syncPerfEventsWithOnlineCPUs()
 
-	results := make(map[uint64]uint64)
+	results := make(map[CountKey]uint64)
+	// swapped out by the previous snapshot, or left behind by the backend whose pinned maps we took over
+	if err := e.drainCounts(1-e.activeCounts, results); err != nil {
+		return nil, err
+	}
+	if err := e.swapCounts(); err != nil {
+		return nil, err
+	}
+	if flush {
+		time.Sleep(countsGracePeriod)
+		if err := e.drainCounts(1-e.activeCounts, results); err != nil {
+			return nil, err
+		}
+	}
+	if e.unwinder != nil {
+		e.snapshotUnwoundCounts(results)
+	}
+	return results, nil
+}
 
-	iter := e.objs.Counts.Iterate()
-	var rawKey uint64
+// makes the BPF programs add to the other counts buffer
+func (e *EbpfBackend) swapCounts() error {
+	next := 1 - e.activeCounts
+	buffers := [2]*ciliumebpf.Map{e.objs.Counts0, e.objs.Counts1}
+	if err := e.objs.ActiveCounts.Put(uint32(0), buffers[next]); err != nil {
+		return fmt.Errorf("swap counts buffers: %w", err)
+	}
+	e.activeCounts = next
+	return nil
+}
+
+// reads the counts of buffer (0 or 1), which has to be swapped out for a grace period, into results, then clears it
+func (e *EbpfBackend) drainCounts(buffer int, results map[CountKey]uint64) error {
+	drained := [2]*ciliumebpf.Map{e.objs.Counts0, e.objs.Counts1}[buffer]
+	iter := drained.Iterate()
+	var rawKey profileCountKey
+	var rawKeys []profileCountKey
 
-	numCPUs := runtime.NumCPU()
+	numCPUs := e.possibleCPUs
 	perCpuVals := make([]uint64, numCPUs)
 
+	var surviving uint64
 	for iter.Next(&rawKey, &perCpuVals) {
+		rawKeys = append(rawKeys, rawKey)
+		surviving++
 		var sum uint64
-		for i := 0; i < numCPUs; i++ {
-			sum += perCpuVals[i]
+		for _, v := range perCpuVals {
+			sum += v
 		}
 		if sum > 0 {
-			results[rawKey] = sum
+			results[toCountKey(rawKey)] += sum
 		}
 	}
 	if err := iter.Err(); err != nil {
-		return nil, fmt.Errorf("iterate counts map: %w", err)
+		return fmt.Errorf("iterate counts map: %w", err)
 	}
 
-	return results, nil
+	// the entries created in the buffer since it was last drained (see add_count in profile.c)
+	inserted, err := e.readStat(profileStatSTAT_COUNTS_INSERTED_0 + profileStat(buffer))
+	if err != nil {
+		return err
+	}
+	if inserted-e.countsInserted[buffer] > surviving {
+		e.countsEvicted += inserted - e.countsInserted[buffer] - surviving
+	}
+	e.countsInserted[buffer] = inserted
+
+	for _, k := range rawKeys {
+		if err := drained.Delete(&k); err != nil && !errors.Is(err, ciliumebpf.ErrKeyNotExist) {
+			return fmt.Errorf("clear counts map: %w", err)
+		}
+	}
+	return nil
 }
 
 // looks up the user frames and kernel frames by the corresponding stackIds
@@ -127,10 +494,23 @@ func (e *EbpfBackend) LookupStacks(userID uint32, kernID uint32) ([]uint64, []ui
 		if id == missingSentinel {
 			return nil, nil
 		}
+		if id >= unwoundStackIDBase {
+			frames, ok := e.unwoundStacks[id]
+			if !ok {
+				e.lookupFailures++
+				return nil, nil
+			}
+			return frames, nil
+		}
 
-		var raw [maxStackFrames]uint64
-		if err := e.objs.Stacks.Lookup(&id, &raw); err != nil {
-			return nil, nil
+		raw := make([]uint64, e.stackFrames)
+		if err := e.objs.Stacks.Lookup(&id, raw); err != nil {
+			if errors.Is(err, ciliumebpf.ErrKeyNotExist) {
+				// the stack is gone, but the sample is still worth reporting without it
+				e.lookupFailures++
+				return nil, nil
+			}
+			return nil, fmt.Errorf("lookup stack %d: %w", id, err)
 		}
 		// trim zeros
 		n := 0
@@ -157,53 +537,181 @@ func (e *EbpfBackend) LookupStacks(userID uint32, kernID uint32) ([]uint64, []ui
 	return uFrames, kFrames, nil
 }
 
-func (e *EbpfBackend) createPerfEventsAndAttach(progFD int, targetPID int, samplingPeriodNs uint64) error {
-	numCPUs := runtime.NumCPU()
-	pfds := make([]int, 0, numCPUs)
+func (e *EbpfBackend) Stats() (Stats, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.started {
+		return Stats{}, errors.New("profiler not started")
+	}
 
-	for cpu := 0; cpu < numCPUs; cpu++ {
-		attr := unix.PerfEventAttr{
-			Type:        unix.PERF_TYPE_SOFTWARE,
-			Config:      unix.PERF_COUNT_SW_CPU_CLOCK,
-			Sample:      uint64(samplingPeriodNs),
-			Sample_type: unix.PERF_SAMPLE_IP,
+	var counters [profileStatSTAT_MAX]uint64
+	for stat := range counters {
+		v, err := e.readStat(profileStat(stat))
+		if err != nil {
+			return Stats{}, err
 		}
+		counters[stat] = v
+	}
 
-		fd, err := unix.PerfEventOpen(&attr, targetPID, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	stats := Stats{
+		Samples:         counters[profileStatSTAT_SAMPLES],
+		SamplesDropped:  counters[profileStatSTAT_SAMPLES_DROPPED],
+		StackCollisions: counters[profileStatSTAT_STACK_COLLISIONS],
+		StackMapFull:    counters[profileStatSTAT_STACK_MAP_FULL],
+		StackErrors:     counters[profileStatSTAT_STACK_ERRORS],
+		CountsEvicted:   e.countsEvicted,
+		CountsErrors:    counters[profileStatSTAT_COUNTS_UPDATE_ERRORS],
+		LookupFailures:  e.lookupFailures,
+		UserStacksLost:  counters[profileStatSTAT_USER_STACKS_LOST],
+		RawSamplesLost:  counters[profileStatSTAT_RAW_SAMPLES_LOST] + e.rawSamplesDropped.Load(),
+	}
+	e.unwoundMu.Lock()
+	stats.UserStacksTruncated = e.userStacksTruncated
+	e.unwoundMu.Unlock()
+	return stats, nil
+}
+
+// sums stat over the CPUs
+func (e *EbpfBackend) readStat(stat profileStat) (uint64, error) {
+	perCpuVals := make([]uint64, e.possibleCPUs)
+	if err := e.objs.Stats.Lookup(uint32(stat), &perCpuVals); err != nil {
+		return 0, fmt.Errorf("lookup stat %d: %w", stat, err)
+	}
+	var sum uint64
+	for _, v := range perCpuVals {
+		sum += v
+	}
+	return sum, nil
+}
+
+func (e *EbpfBackend) startUserStacksReader() error {
+	rd, err := ringbuf.NewReader(e.objs.UserStacks)
+	if err != nil {
+		return fmt.Errorf("opening user stacks ring buffer: %w", err)
+	}
+	e.userStacks = rd
+	e.unwoundCounts = make(map[unwoundKey]uint64)
+	e.userStacksDone.Add(1)
+	go e.readUserStacks(rd)
+	return nil
+}
+
+// stops reading user stacks, after which no more unwound counts are added
+func (e *EbpfBackend) stopUserStacksReader() {
+	if e.userStacks == nil {
+		return
+	}
+	e.userStacks.Close()
+	e.userStacksDone.Wait()
+	e.userStacks = nil
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// attaches the off-CPU programs to the sched_switch and sched_wakeup tracepoints
+func (e *EbpfBackend) attachSchedTracepoints() error {
+	for _, prog := range []*ciliumebpf.Program{e.objs.OnSchedSwitch, e.objs.OnSchedWakeup} {
+		l, err := link.AttachTracing(link.TracingOptions{Program: prog})
 		if err != nil {
-			// cleanup already opened fds
-			for _, ofd := range pfds {
-				unix.Close(ofd)
+			for _, ol := range e.links {
+				ol.Close()
 			}
-			return fmt.Errorf("perf_event_open pid=%d cpu=%d: %w", targetPID, cpu, err)
+			e.links = nil
+			return fmt.Errorf("attach %v: %w", prog, err)
 		}
+		e.links = append(e.links, l)
+	}
+	return nil
+}
 
-		// now attach the BPF prog
-		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, progFD); err != nil {
-			unix.Close(fd)
-			for _, ofd := range pfds {
-				unix.Close(ofd)
+// attaches the on-CPU program to the event on every online CPU
+func (e *EbpfBackend) attachPerfEvents(event PerfEvent, sampleHz uint64) error {
+	cpus, err := onlineCPUs()
+	if err != nil {
+		return fmt.Errorf("reading online CPUs: %w", err)
+	}
+
+	e.perfEvents = make(map[int]*perfEventAttachment, len(cpus))
+	for _, cpu := range cpus {
+		pe, err := attachPerfEvent(e.sampleProgram(), event, sampleHz, cpu)
+		if err != nil {
+			for _, ope := range e.perfEvents {
+				ope.Close()
 			}
-			return fmt.Errorf("ioctl PERF_EVENT_IOC_SET_BPF: %w", err)
+			e.perfEvents = nil
+			return err
 		}
+		e.perfEvents[cpu] = pe
+	}
+	e.event, e.sampleHz = event, sampleHz
+	return nil
+}
 
-		// and enable the event
-		if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
-			unix.Close(fd)
-			for _, ofd := range pfds {
-				unix.Close(ofd)
+// follows CPU hotplug: events of CPUs that went offline are closed, as the kernel doesn't bring them back when the CPU
+// returns, and CPUs that came online get a new event. Failures only cost samples on those CPUs, so they are just logged.
+func (e *EbpfBackend) syncPerfEventsWithOnlineCPUs() {
+	if e.perfEvents == nil {
+		return // off-CPU
+	}
+	cpus, err := onlineCPUs()
+	if err != nil {
+		slog.Warn("Failed to read online CPUs", "error", err)
+		return
+	}
+
+	online := make(map[int]bool, len(cpus))
+	for _, cpu := range cpus {
+		online[cpu] = true
+		if _, ok := e.perfEvents[cpu]; ok {
+			continue
+		}
+		pe, err := attachPerfEvent(e.sampleProgram(), e.event, e.sampleHz, cpu)
+		if err != nil {
+			slog.Warn("Failed to attach perf event to CPU that came online", "cpu", cpu, "error", err)
+			continue
+		}
+		if e.pinPath != "" {
+			if err := e.pinPerfEvent(cpu, pe); err != nil {
+				slog.Warn("Failed to pin perf event of CPU that came online", "cpu", cpu, "error", err)
+			}
+		}
+		e.perfEvents[cpu] = pe
+	}
+	for cpu, pe := range e.perfEvents {
+		if !online[cpu] {
+			if pe.link != nil {
+				_ = pe.link.Unpin() // or the pin would keep it open
 			}
-			return fmt.Errorf("ioctl PERF_EVENT_IOC_ENABLE: %w", err)
+			pe.Close()
+			delete(e.perfEvents, cpu)
 		}
+	}
+}
 
-		pfds = append(pfds, fd)
+func toCountKey(k profileCountKey) CountKey {
+	return CountKey{
+		PID:           k.Pid,
+		TID:           k.Tid,
+		CgroupID:      k.CgroupId,
+		Comm:          commToString(k.Comm),
+		UserStackID:   k.UserStackId,
+		KernelStackID: k.KernelStackId,
 	}
-	e.perfFDs = pfds
-	return nil
 }
 
-func UnpackKey(key uint64) (userID, kernID uint32) {
-	userID = uint32(key >> 32)
-	kernID = uint32(key & 0xffffffff)
-	return
+// comm is a NUL-padded C string
+func commToString(comm [16]int8) string {
+	b := make([]byte, 0, len(comm))
+	for _, c := range comm {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
 }
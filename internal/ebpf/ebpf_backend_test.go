@@ -7,8 +7,12 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/cgroup"
 )
 
 //go:noinline
@@ -28,14 +32,14 @@ func TestEbpfIntegration_SamplesOwnProcess(t *testing.T) {
 		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
 	}
 
-	e, err := NewEbpfBackend()
+	e, err := NewEbpfBackend(Options{})
 	if err != nil {
 		t.Fatalf("NewBackend: %v", err)
 	}
 	defer e.Stop()
 
 	pid := os.Getpid()
-	if err := e.Start(pid, 1_000_000 /* ns */); err != nil {
+	if err := e.Start(Target{PID: pid}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
 		t.Fatalf("Start: %v", err)
 	}
 
@@ -45,29 +49,448 @@ func TestEbpfIntegration_SamplesOwnProcess(t *testing.T) {
 		hotCaller()
 	}
 
-	snap, err := e.SnapshotCounts()
+	assertHotFunctionSampled(t, e)
+}
+
+func TestEbpfIntegration_SamplesAllThreads(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	if err := e.Start(Target{PID: os.Getpid()}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// spread the work over several locked threads, most of which are not the thread whose TID equals the PID
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			done := time.Now().Add(1 * time.Second)
+			for time.Now().Before(done) {
+				hotCaller()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assertHotFunctionSampled(t, e)
+}
+
+func TestEbpfIntegration_SamplesAllProcesses(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	if err := e.Start(Target{PID: AllProcesses}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := time.Now().Add(1 * time.Second)
+	for time.Now().Before(done) {
+		hotCaller()
+	}
+
+	snap, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+	ownComm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("read own comm: %v", err)
+	}
+	for k := range snap {
+		if k.PID == 0 {
+			t.Fatalf("idle task should not be sampled: %+v", k)
+		}
+		if k.PID == uint32(os.Getpid()) && k.Comm != strings.TrimSpace(string(ownComm)) {
+			t.Fatalf("unexpected comm for own process: %q", k.Comm)
+		}
+	}
+
+	assertHotFunctionSampled(t, e)
+}
+
+func TestEbpfIntegration_SamplesCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	path, err := cgroup.ProcessPath(os.Getpid())
+	if err != nil {
+		t.Fatalf("own cgroup: %v", err)
+	}
+	cg, err := cgroup.Lookup(cgroup.DefaultRoot, path)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	if err := e.Start(Target{PID: AllProcesses, CgroupID: cg.ID, CgroupLevel: cg.Level}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := time.Now().Add(1 * time.Second)
+	for time.Now().Before(done) {
+		hotCaller()
+	}
+
+	snap, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+	for k := range snap {
+		if k.PID == uint32(os.Getpid()) && k.CgroupID != cg.ID {
+			t.Fatalf("unexpected cgroup for own process: got %d want %d", k.CgroupID, cg.ID)
+		}
+	}
+
+	assertHotFunctionSampled(t, e)
+}
+
+func TestEbpfIntegration_SnapshotsAreDeltas(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	pid := os.Getpid()
+	if err := e.Start(Target{PID: pid}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := time.Now().Add(1 * time.Second)
+	for time.Now().Before(done) {
+		hotCaller()
+	}
+
+	total := func(snap map[CountKey]uint64) uint64 {
+		var sum uint64
+		for _, v := range snap {
+			sum += v
+		}
+		return sum
+	}
+
+	first, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond) // mostly idle, so hardly any new samples
+	second, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+
+	if total(first) == 0 {
+		t.Fatalf("no samples in first snapshot")
+	}
+	if total(second) >= total(first) {
+		t.Fatalf("second snapshot should only contain the samples taken since the first: first=%d second=%d", total(first), total(second))
+	}
+}
+
+func TestEbpfIntegration_SnapshotsLagOneInterval(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	if err := e.Start(Target{PID: os.Getpid()}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(done) {
+		hotCaller()
+	}
+
+	first, err := e.SnapshotCounts()
+	if err != nil {
+		t.Fatalf("SnapshotCounts: %v", err)
+	}
+	if len(first) != 0 {
+		t.Fatalf("expected the first snapshot to hold back the counts of its interval, got %v", first)
+	}
+	second, err := e.SnapshotCounts()
 	if err != nil {
 		t.Fatalf("SnapshotCounts: %v", err)
 	}
+	if len(second) == 0 {
+		t.Fatalf("expected the second snapshot to return the counts of the first interval")
+	}
+}
+
+func TestEbpfIntegration_Stats(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	if err := e.Start(Target{PID: os.Getpid()}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(done) {
+		hotCaller()
+	}
+	snap, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+
+	stats, err := e.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Samples == 0 {
+		t.Fatalf("no samples counted: %+v", stats)
+	}
+	if stats.SamplesDropped > stats.Samples {
+		t.Fatalf("more samples dropped than taken: %+v", stats)
+	}
+	if stats.CountsEvicted != 0 {
+		t.Fatalf("a handful of stacks should not evict anything from the counts map: %+v", stats)
+	}
+	if _, ok := snap[CountKey{}]; ok {
+		t.Fatalf("no sample without a process should be reported")
+	}
+}
+
+func TestEbpfIntegration_OffCPU(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	pid := os.Getpid()
+	if err := e.Start(Target{PID: pid}, OffCPU, PerfEvent{}, 0); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// block a locked thread on a pipe read for a while
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	defer r.Close()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte{1})
+		w.Close()
+	}()
+	runtime.LockOSThread()
+	buf := make([]byte, 1)
+	if _, err := syscall.Read(int(r.Fd()), buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	runtime.UnlockOSThread()
+
+	snap, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+
+	var blockedNs uint64
+	for k, v := range snap {
+		if k.PID == uint32(pid) && v > blockedNs {
+			blockedNs = v
+		}
+	}
+	if blockedNs < uint64(100*time.Millisecond) {
+		t.Fatalf("expected at least one stack blocked for >100ms, longest was %v", time.Duration(blockedNs))
+	}
+}
+
+func TestEbpfIntegration_PinnedStateSurvivesRestart(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	opts := Options{PinPath: "/sys/fs/bpf/ebpf-profiler-test"}
+	os.RemoveAll(opts.PinPath)
+	defer os.RemoveAll(opts.PinPath)
+	target := Target{PID: os.Getpid()}
+
+	first, err := NewEbpfBackend(opts)
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	if err := first.Start(target, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		first.Stop()
+		t.Fatalf("Start: %v", err)
+	}
+	if err := first.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	// the pinned programs keep counting while no backend runs
+	done := time.Now().Add(1 * time.Second)
+	for time.Now().Before(done) {
+		hotCaller()
+	}
+
+	incompatible, err := NewEbpfBackend(opts)
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	if err := incompatible.Start(Target{PID: AllProcesses}, OnCPU, CPUClock, 1000); err == nil {
+		t.Fatal("expected the pinned state of another target not to be taken over")
+	}
+	incompatible.Stop()
+
+	second, err := NewEbpfBackend(opts)
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer second.Stop()
+	if err := second.Start(target, OnCPU, CPUClock, 1000); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	assertHotFunctionSampled(t, second)
+
+	if err := second.Unpin(); err != nil {
+		t.Fatalf("Unpin: %v", err)
+	}
+	if _, err := os.Stat(opts.PinPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", opts.PinPath, err)
+	}
+}
+
+func TestEbpfIntegration_Filters(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Fatalf("integration test requires root (or appropriate perf_event permissions)")
+	}
+
+	e, err := NewEbpfBackend(Options{})
+	if err != nil {
+		t.Fatalf("NewBackend: %v", err)
+	}
+	defer e.Stop()
+
+	own := Filter{PID: os.Getpid()}
+	if err := e.SetFilter(own, FilterDeny); err != nil {
+		t.Fatalf("SetFilter: %v", err)
+	}
+	if err := e.Start(Target{PID: AllProcesses}, OnCPU, CPUClock, 1000 /* Hz */); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	work := func() {
+		done := time.Now().Add(1 * time.Second)
+		for time.Now().Before(done) {
+			hotCaller()
+		}
+	}
+
+	work()
+	snap, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+	for k := range snap {
+		if k.PID == uint32(os.Getpid()) {
+			t.Fatalf("denied process was sampled: %+v", k)
+		}
+	}
+
+	// only our own process is allowed now
+	if err := e.RemoveFilter(own); err != nil {
+		t.Fatalf("RemoveFilter: %v", err)
+	}
+	comm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("read own comm: %v", err)
+	}
+	if err := e.SetFilter(Filter{CommPrefix: strings.TrimSpace(string(comm))}, FilterAllow); err != nil {
+		t.Fatalf("SetFilter: %v", err)
+	}
+	if _, err := e.FlushCounts(); err != nil { // sampled while there were no filters
+		t.Fatalf("FlushCounts: %v", err)
+	}
+	work()
+	snap, err = e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
+	for k := range snap {
+		if k.PID != uint32(os.Getpid()) {
+			t.Fatalf("process that isn't allowed was sampled: %+v", k)
+		}
+	}
+	if len(snap) == 0 {
+		t.Fatalf("allowed process was not sampled")
+	}
+}
+
+func assertHotFunctionSampled(t *testing.T, e *EbpfBackend) {
+	t.Helper()
+
+	snap, err := e.FlushCounts()
+	if err != nil {
+		t.Fatalf("FlushCounts: %v", err)
+	}
 	if len(snap) == 0 {
 		t.Fatalf("no stacks collected")
 	}
 
-	var pickedKey uint64
+	var pickedKey CountKey
 	var highestCount uint64
 	for k, v := range snap {
+		if k.PID != uint32(os.Getpid()) {
+			continue
+		}
 		if v > highestCount {
 			pickedKey = k
 			highestCount = v
 			break
 		}
 	}
-	if pickedKey == 0 {
-		t.Fatalf("no nonzero counts found")
+	if highestCount == 0 {
+		t.Fatalf("no nonzero counts found for own process")
 	}
 
-	userID, kernID := UnpackKey(pickedKey)
-	uframes, kframes, err := e.LookupStacks(userID, kernID)
+	uframes, kframes, err := e.LookupStacks(pickedKey.UserStackID, pickedKey.KernelStackID)
 	if err != nil {
 		t.Fatalf("LookupStacks: %v", err)
 	}
@@ -0,0 +1,101 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	ciliumebpf "github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+)
+
+// returned by NewEbpfBackend when the kernel rejects the BPF objects, with what's needed to find out why
+type LoadError struct {
+	Err error
+	// the kernel features profile.c uses that the running kernel lacks, e.g. "map type LRUCPUHash"; empty if they
+	// are all there or the kernel could not be probed (which needs the same privileges as loading)
+	Missing []string
+	// the verifier's output for the program it rejected; only the last lines make it into Error. See
+	// Options.VerboseVerifierLog for more detail.
+	VerifierLog []string
+}
+
+func (e *LoadError) Error() string {
+	msg := "loading bpf objects: " + e.Err.Error()
+	if len(e.Missing) > 0 {
+		msg += " (the kernel lacks " + strings.Join(e.Missing, ", ") + ")"
+	}
+	return msg
+}
+
+func (e *LoadError) Unwrap() error { return e.Err }
+
+// explains why the kernel rejected spec, by probing what it needs when the error doesn't tell
+func newLoadError(spec *ciliumebpf.CollectionSpec, err error) *LoadError {
+	le := &LoadError{Err: err, Missing: missingFeatures(requiredFeatures(spec))}
+	var ve *ciliumebpf.VerifierError
+	if errors.As(err, &ve) {
+		le.VerifierLog = ve.Log
+	}
+	return le
+}
+
+type kernelFeature struct {
+	name  string
+	probe func() error // nil if available, ErrNotSupported if not, anything else if it couldn't be told
+}
+
+// the map types, program types and helpers spec uses, each once
+func requiredFeatures(spec *ciliumebpf.CollectionSpec) []kernelFeature {
+	var required []kernelFeature
+	seen := make(map[string]bool)
+	add := func(name string, probe func() error) {
+		if !seen[name] {
+			seen[name] = true
+			required = append(required, kernelFeature{name: name, probe: probe})
+		}
+	}
+	addMap := func(m *ciliumebpf.MapSpec) {
+		add("map type "+m.Type.String(), func() error { return features.HaveMapType(m.Type) })
+	}
+
+	// sorted, so the missing features are always reported in the same order
+	for _, name := range slices.Sorted(maps.Keys(spec.Maps)) {
+		m := spec.Maps[name]
+		addMap(m)
+		if m.InnerMap != nil {
+			addMap(m.InnerMap)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(spec.Programs)) {
+		p := spec.Programs[name]
+		add("program type "+p.Type.String(), func() error { return features.HaveProgramType(p.Type) })
+		for _, ins := range p.Instructions {
+			if !ins.IsBuiltinCall() {
+				continue
+			}
+			fn := asm.BuiltinFunc(ins.Constant)
+			add(fmt.Sprintf("helper %s in %s programs", fn, p.Type), func() error { return features.HaveProgramHelper(p.Type, fn) })
+		}
+	}
+	return required
+}
+
+// probes the required features, returning the names of those the kernel definitely doesn't have
+func missingFeatures(required []kernelFeature) []string {
+	var missing []string
+	for _, f := range required {
+		err := f.probe()
+		switch {
+		case errors.Is(err, ciliumebpf.ErrNotSupported):
+			missing = append(missing, f.name)
+		case err != nil:
+			slog.Debug("Failed to probe kernel feature", "feature", f.name, "error", err)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,72 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	ciliumebpf "github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+)
+
+func TestRequiredFeatures(t *testing.T) {
+	spec := &ciliumebpf.CollectionSpec{
+		Maps: map[string]*ciliumebpf.MapSpec{
+			"counts":  {Type: ciliumebpf.LRUCPUHash},
+			"stacks":  {Type: ciliumebpf.StackTrace},
+			"active":  {Type: ciliumebpf.ArrayOfMaps, InnerMap: &ciliumebpf.MapSpec{Type: ciliumebpf.LRUCPUHash}},
+			"counts2": {Type: ciliumebpf.LRUCPUHash},
+		},
+		Programs: map[string]*ciliumebpf.ProgramSpec{
+			"on_sample": {Type: ciliumebpf.PerfEvent, Instructions: asm.Instructions{
+				asm.FnGetStackid.Call(),
+				asm.FnGetStackid.Call(),
+				asm.FnRingbufReserve.Call(),
+				asm.Return(),
+			}},
+		},
+	}
+
+	var names []string
+	for _, f := range requiredFeatures(spec) {
+		names = append(names, f.name)
+	}
+	want := []string{
+		"map type ArrayOfMaps",
+		"map type LRUCPUHash",
+		"map type StackTrace",
+		"program type PerfEvent",
+		"helper FnGetStackid in PerfEvent programs",
+		"helper FnRingbufReserve in PerfEvent programs",
+	}
+	if !slices.Equal(names, want) {
+		t.Fatalf("unexpected features:\n got %q\nwant %q", names, want)
+	}
+}
+
+func TestMissingFeatures(t *testing.T) {
+	missing := missingFeatures([]kernelFeature{
+		{name: "available", probe: func() error { return nil }},
+		{name: "missing", probe: func() error { return fmt.Errorf("probe: %w", ciliumebpf.ErrNotSupported) }},
+		{name: "unknown", probe: func() error { return errors.New("operation not permitted") }},
+	})
+	// features that couldn't be probed are not reported, as they may well be available
+	if !slices.Equal(missing, []string{"missing"}) {
+		t.Fatalf("unexpected missing features: %q", missing)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	cause := errors.New("invalid argument")
+	err := fmt.Errorf("starting: %w", &LoadError{Err: cause, Missing: []string{"map type LRUCPUHash", "program type PerfEvent"}})
+
+	var le *LoadError
+	if !errors.As(err, &le) || !errors.Is(err, cause) {
+		t.Fatalf("expected a LoadError wrapping the cause, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "loading bpf objects: invalid argument") || !strings.Contains(msg, "the kernel lacks map type LRUCPUHash, program type PerfEvent") {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
@@ -0,0 +1,158 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+
+	ciliumebpf "github.com/cilium/ebpf"
+)
+
+// the longest comm prefix a filter can match on: comm is truncated to 15 bytes plus NUL by the kernel
+const MaxCommPrefix = 15
+
+// what happens to the processes a Filter matches
+type FilterAction uint32
+
+const (
+	// once there is any allow filter, only processes matching one are sampled
+	FilterAllow FilterAction = 1 // FILTER_ALLOW in profile.c
+	// processes matching a deny filter are never sampled, whatever else they match
+	FilterDeny FilterAction = 2 // FILTER_DENY
+)
+
+func (a FilterAction) String() string {
+	switch a {
+	case FilterAllow:
+		return "allow"
+	case FilterDeny:
+		return "deny"
+	default:
+		return fmt.Sprintf("FilterAction(%d)", uint32(a))
+	}
+}
+
+// narrows down which processes of the Target are sampled, e.g. to leave out the agent's own or a noisy neighbour in
+// system-wide profiles. Exactly one of the fields is set. Filters are applied in BPF before any stack is captured.
+//
+// When several filters of the same kind match, the most specific one decides: the deepest cgroup, the longest comm
+// prefix. Across kinds, a deny wins.
+type Filter struct {
+	PID        int    // the process (tgid)
+	CgroupID   uint64 // a cgroup v2, matching the processes in its descendants too
+	CommPrefix string // the start of the comm (the thread name), at most MaxCommPrefix bytes
+}
+
+func (f Filter) String() string {
+	switch {
+	case f.PID != 0:
+		return fmt.Sprintf("pid %d", f.PID)
+	case f.CgroupID != 0:
+		return fmt.Sprintf("cgroup %d", f.CgroupID)
+	default:
+		return fmt.Sprintf("comm prefix %q", f.CommPrefix)
+	}
+}
+
+func (f Filter) validate() error {
+	set := 0
+	for _, isSet := range []bool{f.PID != 0, f.CgroupID != 0, f.CommPrefix != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("invalid filter %+v: exactly one of PID, CgroupID and CommPrefix must be set", f)
+	}
+	if f.PID < 0 {
+		return fmt.Errorf("invalid filter pid %d", f.PID)
+	}
+	if len(f.CommPrefix) > MaxCommPrefix {
+		return fmt.Errorf("invalid filter comm prefix %q: longer than %d bytes", f.CommPrefix, MaxCommPrefix)
+	}
+	return nil
+}
+
+// the BPF map the filter goes into, and its key there
+func (e *EbpfBackend) filterEntry(f Filter) (*ciliumebpf.Map, any, error) {
+	if err := f.validate(); err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case f.PID != 0:
+		return e.objs.FilterPids, uint32(f.PID), nil
+	case f.CgroupID != 0:
+		return e.objs.FilterCgroups, f.CgroupID, nil
+	default:
+		return e.objs.FilterComms, commPrefixKey(f.CommPrefix), nil
+	}
+}
+
+// the LPM trie key matching the comms that start with prefix
+func commPrefixKey(prefix string) profileCommPrefix {
+	key := profileCommPrefix{Prefixlen: uint32(len(prefix) * 8)}
+	for i := 0; i < len(prefix); i++ {
+		key.Comm[i] = int8(prefix[i])
+	}
+	return key
+}
+
+// adds the filter, or changes its action. Filters can be changed at any time, also while profiling.
+func (e *EbpfBackend) SetFilter(f Filter, action FilterAction) error {
+	if action != FilterAllow && action != FilterDeny {
+		return fmt.Errorf("invalid filter action %v", action)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	m, key, err := e.filterEntry(f)
+	if err != nil {
+		return err
+	}
+	if err := m.Put(key, action); err != nil {
+		return fmt.Errorf("adding filter %v: %w", f, err)
+	}
+	if e.filters == nil {
+		e.filters = make(map[Filter]FilterAction)
+	}
+	e.filters[f] = action
+	return e.syncFilterFlags()
+}
+
+// removes the filter; removing one that was never set is not an error
+func (e *EbpfBackend) RemoveFilter(f Filter) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	m, key, err := e.filterEntry(f)
+	if err != nil {
+		return err
+	}
+	if err := m.Delete(key); err != nil && !errors.Is(err, ciliumebpf.ErrKeyNotExist) {
+		return fmt.Errorf("removing filter %v: %w", f, err)
+	}
+	delete(e.filters, f)
+	return e.syncFilterFlags()
+}
+
+// tells the BPF programs whether they have to look at the filters at all, and whether only allowed processes are
+// sampled
+func (e *EbpfBackend) syncFilterFlags() error {
+	enabled, allow := filterFlags(e.filters, e.allowedOnly)
+	if err := e.objs.FiltersEnabled.Set(boolToUint32(enabled)); err != nil {
+		return fmt.Errorf("enabling filters: %w", err)
+	}
+	if err := e.objs.FiltersAllow.Set(boolToUint32(allow)); err != nil {
+		return fmt.Errorf("enabling allow filters: %w", err)
+	}
+	return nil
+}
+
+func filterFlags(filters map[Filter]FilterAction, allowedOnly bool) (enabled, allow bool) {
+	allow = allowedOnly
+	for _, action := range filters {
+		if action == FilterAllow {
+			allow = true
+		}
+	}
+	return allow || len(filters) > 0, allow
+}
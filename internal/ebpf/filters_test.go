@@ -0,0 +1,49 @@
+package ebpf
+
+import "testing"
+
+func TestFilter_Validate(t *testing.T) {
+	for _, f := range []Filter{{PID: 42}, {CgroupID: 7}, {CommPrefix: "nginx"}, {CommPrefix: "exactly15bytes!"}} {
+		if err := f.validate(); err != nil {
+			t.Fatalf("unexpected error for %+v: %v", f, err)
+		}
+	}
+	for _, f := range []Filter{{}, {PID: 42, CgroupID: 7}, {CgroupID: 7, CommPrefix: "nginx"}, {PID: -1}, {CommPrefix: "more-than-15-bytes"}} {
+		if err := f.validate(); err == nil {
+			t.Fatalf("expected error for %+v", f)
+		}
+	}
+}
+
+func TestCommPrefixKey(t *testing.T) {
+	key := commPrefixKey("nginx")
+	if key.Prefixlen != 5*8 {
+		t.Fatalf("expected the prefix length in bits, got %d", key.Prefixlen)
+	}
+	if got := commToString(key.Comm); got != "nginx" {
+		t.Fatalf("unexpected comm %q", got)
+	}
+}
+
+func TestFilterFlags(t *testing.T) {
+	tests := []struct {
+		name           string
+		filters        map[Filter]FilterAction
+		allowedOnly    bool
+		enabled, allow bool
+	}{
+		{"none", nil, false, false, false},
+		{"deny only", map[Filter]FilterAction{{PID: 1}: FilterDeny, {CommPrefix: "kworker"}: FilterDeny}, false, true, false},
+		{"allow", map[Filter]FilterAction{{PID: 1}: FilterDeny, {CgroupID: 7}: FilterAllow}, false, true, true},
+		// nothing is sampled until a process is allowed
+		{"allowed only", nil, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enabled, allow := filterFlags(tt.filters, tt.allowedOnly)
+			if enabled != tt.enabled || allow != tt.allow {
+				t.Fatalf("got enabled=%v allow=%v, want enabled=%v allow=%v", enabled, allow, tt.enabled, tt.allow)
+			}
+		})
+	}
+}
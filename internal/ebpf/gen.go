@@ -1,4 +1,4 @@
 package ebpf
 
 //go:generate bash -c "bpftool btf dump file /sys/kernel/btf/vmlinux format c > bpf/vmlinux.h"
-//go:generate go tool bpf2go -tags linux profile bpf/profile.c
+//go:generate go tool bpf2go -tags linux -type count_key -type stat -type user_stack_sample -type raw_sample profile bpf/profile.c
@@ -0,0 +1,154 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	ciliumebpf "github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// the sizes profile.c is compiled with
+const (
+	DefaultStackMapSize  = 16384 // MAX_STACKS
+	DefaultCountsMapSize = 65536 // MAX_ENTRIES
+	DefaultStackFrames   = 127   // MAX_STACK_FRAMES
+)
+
+// sizes the BPF maps at load time and selects how user stacks are captured; zero values keep the defaults.
+//
+// Memory use is roughly StackMapSize*StackFrames*8 bytes for the stacks, plus 2*CountsMapSize entries of the counts
+// buffers, each of which holds a counter per possible CPU.
+type Options struct {
+	StackMapSize  int // distinct stacks that can be stored; busy hosts fill the default quickly (see Stats.StackMapFull)
+	CountsMapSize int // distinct (thread, stacks) entries per collection interval, also the threads tracked off-CPU
+	StackFrames   int // maximum depth of the captured stacks, limited by the kernel.perf_event_max_stack sysctl
+
+	// if set, the user stacks of on-CPU profiles are copied and unwound with it in userspace, instead of being walked
+	// with frame pointers in BPF, which most distro libraries are built without
+	UserStackUnwinder UserStackUnwinder
+
+	// streams every sample with its timestamp and CPU through EbpfBackend.RawSamples, in addition to counting it; not
+	// with UserStackUnwinder, see ErrStreamingUnwoundStacks
+	StreamSamples bool
+
+	// loads the programs with the verifier logging every instruction and its statistics, which LoadError.VerifierLog
+	// then carries; slower, so only meant for finding out why a kernel rejects them
+	VerboseVerifierLog bool
+
+	// a BTF file describing the running kernel's types (raw BTF, e.g. from BTFHub, or a vmlinux with a .BTF section)
+	// that the programs are relocated against, for kernels built without CONFIG_DEBUG_INFO_BTF or containers that
+	// don't see /sys/kernel/btf/vmlinux. Off-CPU profiles and Options.UserStackUnwinder still need the kernel's own.
+	KernelBTF string
+
+	// a directory on bpffs (e.g. /sys/fs/bpf/ebpf-profiler) to pin the counts and stacks maps and the links of the
+	// attached programs to. The programs then keep counting after the backend is stopped, and the next backend with
+	// the same PinPath takes over their counts on Start, unless EbpfBackend.Unpin is called first.
+	PinPath string
+}
+
+// ErrStreamingUnwoundStacks is returned by NewEbpfBackend for Options with both StreamSamples and UserStackUnwinder:
+// the user stacks are unwound after the samples were counted, so streamed samples would lack them.
+var ErrStreamingUnwoundStacks = errors.New("samples can't be streamed with user stacks unwound in userspace")
+
+func (o Options) withDefaults() Options {
+	if o.StackMapSize == 0 {
+		o.StackMapSize = DefaultStackMapSize
+	}
+	if o.CountsMapSize == 0 {
+		o.CountsMapSize = DefaultCountsMapSize
+	}
+	if o.StackFrames == 0 {
+		o.StackFrames = DefaultStackFrames
+	}
+	return o
+}
+
+// maxStackFrames is the kernel's limit for the depth of stack trace maps
+func (o Options) validate(maxStackFrames int) error {
+	if o.StackMapSize <= 0 {
+		return fmt.Errorf("invalid stack map size %d", o.StackMapSize)
+	}
+	if o.CountsMapSize <= 0 {
+		return fmt.Errorf("invalid counts map size %d", o.CountsMapSize)
+	}
+	if o.StackFrames <= 0 || o.StackFrames > maxStackFrames {
+		return fmt.Errorf("invalid stack depth %d; must be between 1 and %d (kernel.perf_event_max_stack)", o.StackFrames, maxStackFrames)
+	}
+	if o.StreamSamples && o.UserStackUnwinder != nil {
+		return ErrStreamingUnwoundStacks
+	}
+	return nil
+}
+
+// rewrites the map specs before loading, so that the kernel allocates the maps with the configured sizes
+func (o Options) apply(spec *ciliumebpf.CollectionSpec) error {
+	stacks, ok := spec.Maps["stacks"]
+	if !ok {
+		return fmt.Errorf("map stacks not found in BPF spec")
+	}
+	stacks.MaxEntries = uint32(o.StackMapSize)
+	stacks.ValueSize = uint32(o.StackFrames * 8)
+	// the value's BTF type (__u64[MAX_STACK_FRAMES]) has to agree with the value size
+	if arr, ok := btf.UnderlyingType(stacks.Value).(*btf.Array); ok {
+		resized := *arr
+		resized.Nelems = uint32(o.StackFrames)
+		stacks.Value = &resized
+	}
+
+	for _, name := range []string{"counts_0", "counts_1", "off_cpu_starts"} {
+		m, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("map %s not found in BPF spec", name)
+		}
+		m.MaxEntries = uint32(o.CountsMapSize)
+	}
+
+	// the kernel only accepts inner maps that match the template of the outer map, including its size
+	active, ok := spec.Maps["active_counts"]
+	if !ok || active.InnerMap == nil {
+		return fmt.Errorf("map active_counts not found in BPF spec")
+	}
+	active.InnerMap.MaxEntries = uint32(o.CountsMapSize)
+
+	if o.PinPath != "" {
+		for _, name := range pinnedMaps {
+			spec.Maps[name].Pinning = ciliumebpf.PinByName
+		}
+	}
+	return nil
+}
+
+// checks that the loaded maps have the layout the Go side reads them with
+func (o Options) check(objs *profileObjects) error {
+	if got, want := objs.Stacks.ValueSize(), uint32(o.StackFrames*8); got != want {
+		return fmt.Errorf("stacks map has value size %d, expected %d", got, want)
+	}
+	keySize := uint32(binary.Size(profileCountKey{}))
+	for _, m := range []*ciliumebpf.Map{objs.Counts0, objs.Counts1} {
+		if m.KeySize() != keySize {
+			return fmt.Errorf("counts map has key size %d, expected %d", m.KeySize(), keySize)
+		}
+		if m.MaxEntries() != uint32(o.CountsMapSize) {
+			return fmt.Errorf("counts map has %d entries, expected %d", m.MaxEntries(), o.CountsMapSize)
+		}
+	}
+	return nil
+}
+
+// reads kernel.perf_event_max_stack, falling back to its default
+func perfEventMaxStack() int {
+	b, err := os.ReadFile("/proc/sys/kernel/perf_event_max_stack")
+	if err != nil {
+		return DefaultStackFrames
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return DefaultStackFrames
+	}
+	return n
+}
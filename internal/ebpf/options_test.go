@@ -0,0 +1,128 @@
+package ebpf
+
+import (
+	"slices"
+	"testing"
+
+	ciliumebpf "github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+func testSpec() *ciliumebpf.CollectionSpec {
+	u64 := &btf.Int{Name: "__u64", Size: 8}
+	counts := func() *ciliumebpf.MapSpec {
+		return &ciliumebpf.MapSpec{Type: ciliumebpf.LRUCPUHash, KeySize: 40, ValueSize: 8, MaxEntries: DefaultCountsMapSize}
+	}
+	return &ciliumebpf.CollectionSpec{Maps: map[string]*ciliumebpf.MapSpec{
+		"stacks": {
+			Type:       ciliumebpf.StackTrace,
+			KeySize:    4,
+			ValueSize:  DefaultStackFrames * 8,
+			MaxEntries: DefaultStackMapSize,
+			Value:      &btf.Array{Type: u64, Nelems: DefaultStackFrames},
+		},
+		"counts_0":       counts(),
+		"counts_1":       counts(),
+		"off_cpu_starts": {Type: ciliumebpf.Hash, KeySize: 4, ValueSize: 48, MaxEntries: DefaultCountsMapSize},
+		"active_counts":  {Type: ciliumebpf.ArrayOfMaps, KeySize: 4, ValueSize: 4, MaxEntries: 1, InnerMap: counts()},
+	}}
+}
+
+func TestOptions_Apply(t *testing.T) {
+	spec := testSpec()
+	opts := Options{StackMapSize: 1 << 18, CountsMapSize: 4096, StackFrames: 64}.withDefaults()
+	if err := opts.apply(spec); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	stacks := spec.Maps["stacks"]
+	if stacks.MaxEntries != 1<<18 || stacks.ValueSize != 64*8 {
+		t.Fatalf("unexpected stacks map: entries=%d value size=%d", stacks.MaxEntries, stacks.ValueSize)
+	}
+	if arr := stacks.Value.(*btf.Array); arr.Nelems != 64 {
+		t.Fatalf("stack value type not resized: %d frames", arr.Nelems)
+	}
+	for _, name := range []string{"counts_0", "counts_1", "off_cpu_starts"} {
+		if spec.Maps[name].MaxEntries != 4096 {
+			t.Fatalf("unexpected size of %s: %d", name, spec.Maps[name].MaxEntries)
+		}
+	}
+	if spec.Maps["active_counts"].InnerMap.MaxEntries != 4096 {
+		t.Fatalf("inner map template of active_counts not resized")
+	}
+}
+
+func TestOptions_Defaults(t *testing.T) {
+	spec := testSpec()
+	if err := (Options{}).withDefaults().apply(spec); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if spec.Maps["stacks"].MaxEntries != DefaultStackMapSize || spec.Maps["stacks"].ValueSize != DefaultStackFrames*8 {
+		t.Fatalf("defaults changed the stacks map: %+v", spec.Maps["stacks"])
+	}
+	if spec.Maps["counts_0"].MaxEntries != DefaultCountsMapSize {
+		t.Fatalf("defaults changed the counts map: %+v", spec.Maps["counts_0"])
+	}
+}
+
+func TestOptions_ApplyMissingMap(t *testing.T) {
+	spec := testSpec()
+	delete(spec.Maps, "counts_1")
+	if err := (Options{}).withDefaults().apply(spec); err == nil {
+		t.Fatal("expected error for a spec without counts_1")
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{"defaults", Options{}, false},
+		{"max depth", Options{StackFrames: 127}, false},
+		{"too deep", Options{StackFrames: 128}, true},
+		{"negative stack map size", Options{StackMapSize: -1}, true},
+		{"negative counts map size", Options{CountsMapSize: -1}, true},
+		{"negative depth", Options{StackFrames: -1}, true},
+		{"unwinding", Options{UserStackUnwinder: nopUnwinder{}}, false},
+		{"streaming unwound stacks", Options{UserStackUnwinder: nopUnwinder{}, StreamSamples: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.withDefaults().validate(127)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected result: %v", err)
+			}
+		})
+	}
+}
+
+type nopUnwinder struct{}
+
+func (nopUnwinder) Unwind(pid int, ip, sp, bp uint64, stack []byte) ([]uint64, error) {
+	return nil, nil
+}
+
+func TestOptions_ApplyPinning(t *testing.T) {
+	spec := testSpec()
+	if err := (Options{PinPath: "/sys/fs/bpf/ebpf-profiler"}).withDefaults().apply(spec); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for name, m := range spec.Maps {
+		pinned := slices.Contains(pinnedMaps, name)
+		if (m.Pinning == ciliumebpf.PinByName) != pinned {
+			t.Fatalf("unexpected pinning of %s: %v", name, m.Pinning)
+		}
+	}
+
+	spec = testSpec()
+	if err := (Options{}).withDefaults().apply(spec); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	for name, m := range spec.Maps {
+		if m.Pinning != ciliumebpf.PinNone {
+			t.Fatalf("%s pinned without a pin path", name)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	ciliumebpf "github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// ErrEventNotSupported is returned by Start when the kernel or the hardware can't sample the requested perf event,
+// e.g. hardware events inside VMs without a virtualised PMU
+var ErrEventNotSupported = errors.New("perf event not supported on this machine")
+
+// a perf event that on-CPU profiles can sample on
+type PerfEvent struct {
+	Name   string // as listed by `perf list`
+	Unit   string // what the sampled values count
+	Type   uint32 // PERF_TYPE_*
+	Config uint64 // PERF_COUNT_*
+}
+
+var (
+	CPUClock        = PerfEvent{Name: "cpu-clock", Unit: "nanoseconds", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CPU_CLOCK}
+	PageFaults      = PerfEvent{Name: "page-faults", Unit: "count", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_PAGE_FAULTS}
+	MajorFaults     = PerfEvent{Name: "major-faults", Unit: "count", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_PAGE_FAULTS_MAJ}
+	ContextSwitches = PerfEvent{Name: "context-switches", Unit: "count", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CONTEXT_SWITCHES}
+	CPUMigrations   = PerfEvent{Name: "cpu-migrations", Unit: "count", Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CPU_MIGRATIONS}
+	Cycles          = PerfEvent{Name: "cycles", Unit: "count", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_CPU_CYCLES}
+	Instructions    = PerfEvent{Name: "instructions", Unit: "count", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_INSTRUCTIONS}
+	CacheMisses     = PerfEvent{Name: "cache-misses", Unit: "count", Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_CACHE_MISSES}
+)
+
+// PerfEvents lists the events that can be selected by name
+var PerfEvents = []PerfEvent{CPUClock, PageFaults, MajorFaults, ContextSwitches, CPUMigrations, Cycles, Instructions, CacheMisses}
+
+func PerfEventByName(name string) (PerfEvent, bool) {
+	for _, ev := range PerfEvents {
+		if ev.Name == name {
+			return ev, true
+		}
+	}
+	return PerfEvent{}, false
+}
+
+func (ev PerfEvent) String() string { return ev.Name }
+
+// a perf event opened on one CPU, with the on-CPU program attached to it
+type perfEventAttachment struct {
+	fd   int
+	link link.Link // nil when attached with the PERF_EVENT_IOC_SET_BPF ioctl, on kernels without perf event links (< 5.15)
+}
+
+// opens the event on the CPU for all processes (pid=-1) and attaches prog to it.
+//
+// The event samples in frequency mode, so the kernel adjusts the period to get about sampleHz samples per second, and
+// the BPF program weighs every sample by its period (for the clock events the period is simply 1s/sampleHz).
+func attachPerfEvent(prog *ciliumebpf.Program, event PerfEvent, sampleHz uint64, cpu int) (*perfEventAttachment, error) {
+	attr := unix.PerfEventAttr{
+		Type:        event.Type,
+		Config:      event.Config,
+		Sample:      sampleHz,
+		Bits:        unix.PerfBitFreq,
+		Sample_type: unix.PERF_SAMPLE_IP | unix.PERF_SAMPLE_PERIOD,
+	}
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENODEV) {
+			return nil, fmt.Errorf("%w: %s (cpu=%d): %v", ErrEventNotSupported, event.Name, cpu, err)
+		}
+		return nil, fmt.Errorf("perf_event_open %s cpu=%d: %w", event.Name, cpu, err)
+	}
+
+	// events are opened enabled, so attaching the program is all that is left to do
+	l, linkErr := link.AttachRawLink(link.RawLinkOptions{Target: fd, Program: prog, Attach: ciliumebpf.AttachPerfEvent})
+	if linkErr == nil {
+		return &perfEventAttachment{fd: fd, link: l}, nil
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog.FD()); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("attach to perf event cpu=%d: %w (bpf link: %v)", cpu, err, linkErr)
+	}
+	return &perfEventAttachment{fd: fd}, nil
+}
+
+func (a *perfEventAttachment) Close() error {
+	var err error
+	if a.link != nil {
+		err = a.link.Close()
+	} else {
+		_ = unix.IoctlSetInt(a.fd, unix.PERF_EVENT_IOC_DISABLE, 0)
+	}
+	if cerr := unix.Close(a.fd); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// the CPUs that are currently online, which can change at any time with CPU hotplug
+func onlineCPUs() ([]int, error) {
+	b, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// parses the kernel's CPU list format, e.g. "0-3,5,7-8"
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	if s == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", s)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu list %q", s)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,36 @@
+package ebpf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+	}{
+		{"0", []int{0}},
+		{"0-3", []int{0, 1, 2, 3}},
+		{"0-3,5,7-8", []int{0, 1, 2, 3, 5, 7, 8}},
+		{"1,3", []int{1, 3}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseCPUList(tt.list)
+		if err != nil {
+			t.Fatalf("parseCPUList(%q): %v", tt.list, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Fatalf("parseCPUList(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParseCPUList_Invalid(t *testing.T) {
+	for _, list := range []string{"a", "0-", "3-1", "0,,1"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Fatalf("expected error for %q", list)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	ciliumebpf "github.com/cilium/ebpf"
+)
+
+// bump whenever the pinned maps change meaning in a way their sizes don't reveal, e.g. a new field in the count key
+// that keeps its size, so that agents don't take over state they would misread
+const pinnedStateVersion = 2
+
+// the maps that survive a restart with Options.PinPath: the counts with their stacks. The stats and the other maps
+// only cover the time since Start anyway.
+var pinnedMaps = []string{"active_counts", "counts_0", "counts_1", "stacks"}
+
+// the pins of the links start with this, so that they can be told apart from the maps
+const linkPinPrefix = "link_"
+
+// what the pinned programs were attached for, stored next to the pinned maps so that the next agent can check that
+// the counts it takes over are of the same profile
+type pinnedState struct {
+	CgroupID    uint64
+	EventConfig uint64
+	Version     uint32
+	ProfileType uint32
+	TargetTgid  uint32
+	CgroupLevel uint32
+	EventType   uint32
+	Unwind      uint32 // 1 if user stacks are unwound in userspace, in which case they never make it into the counts
+	AllowedOnly uint32
+	_           uint32
+}
+
+func newPinnedState(target Target, targetTgid uint32, profileType ProfileType, event PerfEvent, unwind bool) pinnedState {
+	s := pinnedState{
+		Version:     pinnedStateVersion,
+		ProfileType: uint32(profileType),
+		TargetTgid:  targetTgid,
+		CgroupID:    target.CgroupID,
+		CgroupLevel: uint32(target.CgroupLevel),
+		Unwind:      boolToUint32(unwind),
+		AllowedOnly: boolToUint32(target.AllowedOnly),
+	}
+	if profileType == OnCPU {
+		// values of different events can't be added up, while the frequency doesn't matter, as samples are weighted
+		s.EventType, s.EventConfig = event.Type, event.Config
+	}
+	return s
+}
+
+// how want differs from the pinned state s, empty if the counts can be taken over
+func (s pinnedState) diff(want pinnedState) []string {
+	var diffs []string
+	if s.Version != want.Version {
+		return []string{fmt.Sprintf("version %d changed to %d", s.Version, want.Version)}
+	}
+	if s.ProfileType != want.ProfileType {
+		diffs = append(diffs, fmt.Sprintf("profile type %v changed to %v", ProfileType(s.ProfileType), ProfileType(want.ProfileType)))
+	}
+	if s.TargetTgid != want.TargetTgid {
+		diffs = append(diffs, fmt.Sprintf("target pid %d changed to %d", s.TargetTgid, want.TargetTgid))
+	}
+	if s.AllowedOnly != want.AllowedOnly {
+		diffs = append(diffs, "allowed processes only changed")
+	}
+	if s.CgroupID != want.CgroupID || s.CgroupLevel != want.CgroupLevel {
+		diffs = append(diffs, fmt.Sprintf("target cgroup %d changed to %d", s.CgroupID, want.CgroupID))
+	}
+	if s.EventType != want.EventType || s.EventConfig != want.EventConfig {
+		diffs = append(diffs, fmt.Sprintf("perf event %d/%d changed to %d/%d", s.EventType, s.EventConfig, want.EventType, want.EventConfig))
+	}
+	if s.Unwind != want.Unwind {
+		diffs = append(diffs, "user stack unwinding changed")
+	}
+	return diffs
+}
+
+// creates the map the pinned state is kept in, or opens it if a previous agent left it behind
+func openPinnedState(dir string) (*ciliumebpf.Map, error) {
+	m, err := ciliumebpf.NewMapWithOptions(&ciliumebpf.MapSpec{
+		Name:       "pinned_state",
+		Type:       ciliumebpf.Array,
+		KeySize:    4,
+		ValueSize:  uint32(binary.Size(pinnedState{})),
+		MaxEntries: 1,
+		Pinning:    ciliumebpf.PinByName,
+	}, ciliumebpf.MapOptions{PinPath: dir})
+	if err != nil {
+		return nil, fmt.Errorf("opening pinned state in %s: %w", dir, err)
+	}
+	return m, nil
+}
+
+// takes over from the programs a previous agent left attached, if they profile the same as want: their links are
+// unpinned, which detaches them, so that this agent's programs can take their place. Returns an error if they profile
+// something else, as their counts would end up in this profile. Loading the pinned active_counts swapped counts_0 in
+// (see load), so whatever they left in counts_1 is drained by the first snapshot, like any buffer swapped out.
+func (e *EbpfBackend) takeOverPinned(want pinnedState) error {
+	var prev pinnedState
+	if err := e.pinState.Lookup(uint32(0), &prev); err != nil {
+		return fmt.Errorf("reading pinned state: %w", err)
+	}
+	if prev.Version != 0 {
+		if diffs := prev.diff(want); len(diffs) > 0 {
+			return fmt.Errorf("the programs pinned in %s profile something else (%v); remove the directory to discard them", e.pinPath, diffs)
+		}
+	}
+
+	pins, err := filepath.Glob(filepath.Join(e.pinPath, linkPinPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, pin := range pins {
+		if err := os.Remove(pin); err != nil {
+			return fmt.Errorf("detaching pinned programs: %w", err)
+		}
+	}
+	if prev.Version != 0 {
+		slog.Info("Taking over pinned profiling state", "path", e.pinPath, "detached_links", len(pins))
+	}
+	return nil
+}
+
+// pins the links of the attached programs, so that they keep running once this agent exits, and records what they
+// profile
+func (e *EbpfBackend) pinAttachments(state pinnedState) error {
+	for cpu, pe := range e.perfEvents {
+		if err := e.pinPerfEvent(cpu, pe); err != nil {
+			return err
+		}
+	}
+	for i, l := range e.links {
+		name := [...]string{"sched_switch", "sched_wakeup"}[i] // as attached by attachSchedTracepoints
+		if err := l.Pin(filepath.Join(e.pinPath, linkPinPrefix+name)); err != nil {
+			return fmt.Errorf("pinning %s link: %w", name, err)
+		}
+	}
+	if err := e.pinState.Put(uint32(0), state); err != nil {
+		return fmt.Errorf("writing pinned state: %w", err)
+	}
+	return nil
+}
+
+func (e *EbpfBackend) pinPerfEvent(cpu int, pe *perfEventAttachment) error {
+	if pe.link == nil {
+		return errors.New("pinning needs perf event links, which the kernel doesn't support (Linux 5.15+)")
+	}
+	// the link holds on to the perf event, so the event stays open with it
+	if err := pe.link.Pin(filepath.Join(e.pinPath, fmt.Sprintf("%scpu%d", linkPinPrefix, cpu))); err != nil {
+		return fmt.Errorf("pinning perf event link cpu=%d: %w", cpu, err)
+	}
+	return nil
+}
+
+// unpins the links pinned by pinAttachments, so that closing them detaches the programs
+func (e *EbpfBackend) unpinAttachments() {
+	for _, pe := range e.perfEvents {
+		if pe.link != nil {
+			_ = pe.link.Unpin()
+		}
+	}
+	for _, l := range e.links {
+		_ = l.Unpin()
+	}
+}
+
+// removes everything pinned in Options.PinPath, so that the programs are detached and the maps freed once the
+// backend is stopped, instead of the next agent taking them over. Does nothing without Options.PinPath.
+func (e *EbpfBackend) Unpin() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pinPath == "" {
+		return nil
+	}
+	if err := os.RemoveAll(e.pinPath); err != nil {
+		return fmt.Errorf("removing %s: %w", e.pinPath, err)
+	}
+	return nil
+}
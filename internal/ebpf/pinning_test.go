@@ -0,0 +1,60 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestPinnedState_Layout(t *testing.T) {
+	// no padding, so that the map value is the same whichever way it is marshalled
+	if got := binary.Size(pinnedState{}); got != 48 {
+		t.Fatalf("unexpected size of pinnedState: %d", got)
+	}
+}
+
+func TestPinnedState_Diff(t *testing.T) {
+	pinned := newPinnedState(Target{PID: 42}, 42, OnCPU, CPUClock, false)
+
+	if diffs := pinned.diff(newPinnedState(Target{PID: 42}, 42, OnCPU, CPUClock, false)); len(diffs) != 0 {
+		t.Fatalf("expected the same profile to be taken over, got %v", diffs)
+	}
+
+	tests := []struct {
+		name string
+		want pinnedState
+		diff string
+	}{
+		{"target", newPinnedState(Target{PID: 43}, 43, OnCPU, CPUClock, false), "target pid 42 changed to 43"},
+		{"cgroup", newPinnedState(Target{PID: 42, CgroupID: 7, CgroupLevel: 2}, 42, OnCPU, CPUClock, false), "target cgroup 0 changed to 7"},
+		{"profile type", newPinnedState(Target{PID: 42}, 42, OffCPU, CPUClock, false), "profile type on-cpu changed to off-cpu"},
+		{"event", newPinnedState(Target{PID: 42}, 42, OnCPU, PageFaults, false), "perf event"},
+		{"allowed only", newPinnedState(Target{PID: 42, AllowedOnly: true}, 42, OnCPU, CPUClock, false), "allowed processes only changed"},
+		{"unwinding", newPinnedState(Target{PID: 42}, 42, OnCPU, CPUClock, true), "user stack unwinding changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := pinned.diff(tt.want)
+			if !strings.Contains(strings.Join(diffs, ", "), tt.diff) {
+				t.Fatalf("expected %q, got %v", tt.diff, diffs)
+			}
+		})
+	}
+}
+
+func TestPinnedState_DiffVersion(t *testing.T) {
+	pinned := newPinnedState(Target{PID: 42}, 42, OnCPU, CPUClock, false)
+	pinned.Version = pinnedStateVersion - 1
+	// nothing else can be compared across versions
+	diffs := pinned.diff(newPinnedState(Target{PID: 43}, 43, OnCPU, CPUClock, false))
+	if len(diffs) != 1 || !strings.Contains(diffs[0], "version") {
+		t.Fatalf("expected only the version to be reported, got %v", diffs)
+	}
+}
+
+func TestPinnedState_OffCPUIgnoresEvent(t *testing.T) {
+	pinned := newPinnedState(Target{PID: AllProcesses}, 0, OffCPU, CPUClock, false)
+	if diffs := pinned.diff(newPinnedState(Target{PID: AllProcesses}, 0, OffCPU, Cycles, false)); len(diffs) != 0 {
+		t.Fatalf("expected the event not to matter off-CPU, got %v", diffs)
+	}
+}
@@ -8,10 +8,64 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"structs"
 
 	"github.com/cilium/ebpf"
 )
 
+type profileCommPrefix struct {
+	_         structs.HostLayout
+	Prefixlen uint32
+	Comm      [16]int8
+}
+
+type profileCountKey struct {
+	_             structs.HostLayout
+	Pid           uint32
+	Tid           uint32
+	CgroupId      uint64
+	UserStackId   uint32
+	KernelStackId uint32
+	Comm          [16]int8
+}
+
+type profileStat uint32
+
+const (
+	profileStatSTAT_SAMPLES              profileStat = 0
+	profileStatSTAT_SAMPLES_DROPPED      profileStat = 1
+	profileStatSTAT_STACK_COLLISIONS     profileStat = 2
+	profileStatSTAT_STACK_MAP_FULL       profileStat = 3
+	profileStatSTAT_STACK_ERRORS         profileStat = 4
+	profileStatSTAT_COUNTS_UPDATE_ERRORS profileStat = 5
+	profileStatSTAT_USER_STACKS_LOST     profileStat = 6
+	profileStatSTAT_RAW_SAMPLES_LOST     profileStat = 7
+	profileStatSTAT_COUNTS_INSERTED_0    profileStat = 8
+	profileStatSTAT_COUNTS_INSERTED_1    profileStat = 9
+	profileStatSTAT_MAX                  profileStat = 10
+)
+
+type profileRawSample struct {
+	_     structs.HostLayout
+	Key   profileCountKey
+	Ts    uint64
+	Value uint64
+	Cpu   uint32
+	_     [4]byte
+}
+
+type profileUserStackSample struct {
+	_        structs.HostLayout
+	Key      profileCountKey
+	Value    uint64
+	Ip       uint64
+	Sp       uint64
+	Bp       uint64
+	StackLen uint32
+	Stack    [8192]uint8
+	_        [4]byte
+}
+
 // loadProfile returns the embedded CollectionSpec for profile.
 func loadProfile() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_ProfileBytes)
@@ -54,21 +108,39 @@ type profileSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type profileProgramSpecs struct {
-	OnSample *ebpf.ProgramSpec `ebpf:"on_sample"`
+	OnSample       *ebpf.ProgramSpec `ebpf:"on_sample"`
+	OnSampleUnwind *ebpf.ProgramSpec `ebpf:"on_sample_unwind"`
+	OnSchedSwitch  *ebpf.ProgramSpec `ebpf:"on_sched_switch"`
+	OnSchedWakeup  *ebpf.ProgramSpec `ebpf:"on_sched_wakeup"`
 }
 
 // profileMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type profileMapSpecs struct {
-	Counts *ebpf.MapSpec `ebpf:"counts"`
-	Stacks *ebpf.MapSpec `ebpf:"stacks"`
+	ActiveCounts  *ebpf.MapSpec `ebpf:"active_counts"`
+	Counts0       *ebpf.MapSpec `ebpf:"counts_0"`
+	Counts1       *ebpf.MapSpec `ebpf:"counts_1"`
+	FilterCgroups *ebpf.MapSpec `ebpf:"filter_cgroups"`
+	FilterComms   *ebpf.MapSpec `ebpf:"filter_comms"`
+	FilterPids    *ebpf.MapSpec `ebpf:"filter_pids"`
+	OffCpuStarts  *ebpf.MapSpec `ebpf:"off_cpu_starts"`
+	RawSamples    *ebpf.MapSpec `ebpf:"raw_samples"`
+	Stacks        *ebpf.MapSpec `ebpf:"stacks"`
+	Stats         *ebpf.MapSpec `ebpf:"stats"`
+	UserStacks    *ebpf.MapSpec `ebpf:"user_stacks"`
 }
 
 // profileVariableSpecs contains global variables before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type profileVariableSpecs struct {
+	FiltersAllow      *ebpf.VariableSpec `ebpf:"filters_allow"`
+	FiltersEnabled    *ebpf.VariableSpec `ebpf:"filters_enabled"`
+	StreamSamples     *ebpf.VariableSpec `ebpf:"stream_samples"`
+	TargetCgroupId    *ebpf.VariableSpec `ebpf:"target_cgroup_id"`
+	TargetCgroupLevel *ebpf.VariableSpec `ebpf:"target_cgroup_level"`
+	TargetTgid        *ebpf.VariableSpec `ebpf:"target_tgid"`
 }
 
 // profileObjects contains all objects after they have been loaded into the kernel.
@@ -91,14 +163,32 @@ func (o *profileObjects) Close() error {
 //
 // It can be passed to loadProfileObjects or ebpf.CollectionSpec.LoadAndAssign.
 type profileMaps struct {
-	Counts *ebpf.Map `ebpf:"counts"`
-	Stacks *ebpf.Map `ebpf:"stacks"`
+	ActiveCounts  *ebpf.Map `ebpf:"active_counts"`
+	Counts0       *ebpf.Map `ebpf:"counts_0"`
+	Counts1       *ebpf.Map `ebpf:"counts_1"`
+	FilterCgroups *ebpf.Map `ebpf:"filter_cgroups"`
+	FilterComms   *ebpf.Map `ebpf:"filter_comms"`
+	FilterPids    *ebpf.Map `ebpf:"filter_pids"`
+	OffCpuStarts  *ebpf.Map `ebpf:"off_cpu_starts"`
+	RawSamples    *ebpf.Map `ebpf:"raw_samples"`
+	Stacks        *ebpf.Map `ebpf:"stacks"`
+	Stats         *ebpf.Map `ebpf:"stats"`
+	UserStacks    *ebpf.Map `ebpf:"user_stacks"`
 }
 
 func (m *profileMaps) Close() error {
 	return _ProfileClose(
-		m.Counts,
+		m.ActiveCounts,
+		m.Counts0,
+		m.Counts1,
+		m.FilterCgroups,
+		m.FilterComms,
+		m.FilterPids,
+		m.OffCpuStarts,
+		m.RawSamples,
 		m.Stacks,
+		m.Stats,
+		m.UserStacks,
 	)
 }
 
@@ -106,18 +196,30 @@ func (m *profileMaps) Close() error {
 //
 // It can be passed to loadProfileObjects or ebpf.CollectionSpec.LoadAndAssign.
 type profileVariables struct {
+	FiltersAllow      *ebpf.Variable `ebpf:"filters_allow"`
+	FiltersEnabled    *ebpf.Variable `ebpf:"filters_enabled"`
+	StreamSamples     *ebpf.Variable `ebpf:"stream_samples"`
+	TargetCgroupId    *ebpf.Variable `ebpf:"target_cgroup_id"`
+	TargetCgroupLevel *ebpf.Variable `ebpf:"target_cgroup_level"`
+	TargetTgid        *ebpf.Variable `ebpf:"target_tgid"`
 }
 
 // profilePrograms contains all programs after they have been loaded into the kernel.
 //
 // It can be passed to loadProfileObjects or ebpf.CollectionSpec.LoadAndAssign.
 type profilePrograms struct {
-	OnSample *ebpf.Program `ebpf:"on_sample"`
+	OnSample       *ebpf.Program `ebpf:"on_sample"`
+	OnSampleUnwind *ebpf.Program `ebpf:"on_sample_unwind"`
+	OnSchedSwitch  *ebpf.Program `ebpf:"on_sched_switch"`
+	OnSchedWakeup  *ebpf.Program `ebpf:"on_sched_wakeup"`
 }
 
 func (p *profilePrograms) Close() error {
 	return _ProfileClose(
 		p.OnSample,
+		p.OnSampleUnwind,
+		p.OnSchedSwitch,
+		p.OnSchedWakeup,
 	)
 }
 
@@ -0,0 +1,108 @@
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"golang.org/x/sys/unix"
+)
+
+// how many raw samples can be waiting for the consumer before they get dropped
+const rawSamplesBuffer = 4096
+
+// a single sample, streamed when Options.StreamSamples is set
+type RawSample struct {
+	CountKey           // where the sample was taken, with the ids of its stacks for LookupStacks
+	Time     time.Time // when the sample was taken (on-CPU) or the thread blocked (off-CPU)
+	CPU      uint32
+	Value    uint64 // the event's period (on-CPU) or the nanoseconds blocked (off-CPU), as added to the counts
+}
+
+// returns the stream of raw samples, which is closed by Stop; nil unless Options.StreamSamples is set
+func (e *EbpfBackend) RawSamples() <-chan RawSample {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rawSamplesCh == nil {
+		return nil // a nil channel never delivers, so consumers don't need to special case it
+	}
+	return e.rawSamplesCh
+}
+
+func (e *EbpfBackend) startRawSamplesReader() error {
+	offset, err := monotonicToWallClock()
+	if err != nil {
+		return err
+	}
+	rd, err := ringbuf.NewReader(e.objs.RawSamples)
+	if err != nil {
+		return fmt.Errorf("opening raw samples ring buffer: %w", err)
+	}
+	e.rawSamples = rd
+	e.rawSamplesCh = make(chan RawSample, rawSamplesBuffer)
+	e.rawSamplesDropped.Store(0)
+	e.rawSamplesDone.Add(1)
+	go e.readRawSamples(rd, e.rawSamplesCh, offset)
+	return nil
+}
+
+// stops reading raw samples and closes the stream
+func (e *EbpfBackend) stopRawSamplesReader() {
+	if e.rawSamples == nil {
+		return
+	}
+	e.rawSamples.Close()
+	e.rawSamplesDone.Wait()
+	e.rawSamples = nil
+}
+
+// reads the raw samples off the ring buffer until it is closed. Samples the consumer isn't ready for are dropped
+// rather than letting the ring buffer fill up, which would lose samples just the same, but in the BPF program.
+func (e *EbpfBackend) readRawSamples(rd *ringbuf.Reader, ch chan<- RawSample, clockOffset int64) {
+	defer e.rawSamplesDone.Done()
+	defer close(ch)
+
+	var rec ringbuf.Record
+	var s profileRawSample
+	for {
+		if err := rd.ReadInto(&rec); err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			slog.Warn("Failed to read raw sample from ring buffer", "error", err)
+			continue
+		}
+		if err := binary.Read(bytes.NewReader(rec.RawSample), binary.NativeEndian, &s); err != nil {
+			slog.Warn("Failed to decode raw sample", "error", err)
+			continue
+		}
+		select {
+		case ch <- toRawSample(s, clockOffset):
+		default:
+			e.rawSamplesDropped.Add(1)
+		}
+	}
+}
+
+func toRawSample(s profileRawSample, clockOffset int64) RawSample {
+	return RawSample{
+		CountKey: toCountKey(s.Key),
+		Time:     time.Unix(0, int64(s.Ts)+clockOffset),
+		CPU:      s.Cpu,
+		Value:    s.Value,
+	}
+}
+
+// bpf_ktime_get_ns is CLOCK_MONOTONIC, which starts at boot; this is what has to be added to it to get the wall
+// clock. It is only taken once, so wall clock adjustments made while profiling don't make samples jump around.
+func monotonicToWallClock() (int64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, fmt.Errorf("reading monotonic clock: %w", err)
+	}
+	return time.Now().UnixNano() - ts.Nano(), nil
+}
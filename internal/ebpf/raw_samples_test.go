@@ -0,0 +1,57 @@
+package ebpf
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestRawSampleLayout(t *testing.T) {
+	// the size of struct raw_sample in profile.c
+	if size := binary.Size(profileRawSample{}); size != 64 {
+		t.Fatalf("unexpected size %d", size)
+	}
+}
+
+func TestToRawSample(t *testing.T) {
+	var comm [16]int8
+	for i, c := range "worker" {
+		comm[i] = int8(c)
+	}
+	s := profileRawSample{
+		Key:   profileCountKey{Pid: 10, Tid: 11, CgroupId: 7, UserStackId: 1, KernelStackId: 2, Comm: comm},
+		Ts:    5_000_000_000,
+		Value: 250,
+		Cpu:   3,
+	}
+	offset := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+	got := toRawSample(s, offset)
+	want := RawSample{
+		CountKey: CountKey{PID: 10, TID: 11, CgroupID: 7, Comm: "worker", UserStackID: 1, KernelStackID: 2},
+		Time:     time.Date(2024, 1, 1, 0, 0, 5, 0, time.UTC),
+		CPU:      3,
+		Value:    250,
+	}
+	if got.CountKey != want.CountKey || !got.Time.Equal(want.Time) || got.CPU != want.CPU || got.Value != want.Value {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestMonotonicToWallClock(t *testing.T) {
+	offset, err := monotonicToWallClock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the offset is the time of boot, which has to be in the past
+	if boot := time.Unix(0, offset); !boot.Before(time.Now()) {
+		t.Fatalf("boot time %v is not in the past", boot)
+	}
+}
+
+func TestRawSamplesDisabled(t *testing.T) {
+	e := &EbpfBackend{}
+	if ch := e.RawSamples(); ch != nil {
+		t.Fatalf("expected no stream when streaming is disabled, got %v", ch)
+	}
+}
@@ -0,0 +1,103 @@
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// unwinds the user stacks the BPF program copies when Options.UserStackUnwinder is set (see submit_user_stack in
+// profile.c): ip, sp and bp are the registers user space was interrupted with, and stack is the copy of its stack from
+// sp upwards. The frames that could be unwound are expected even if unwinding stopped early with an error.
+type UserStackUnwinder interface {
+	Unwind(pid int, ip, sp, bp uint64, stack []byte) ([]uint64, error)
+}
+
+// the ids SnapshotCounts hands out for unwound user stacks; the ids of the stacks map are always lower
+const unwoundStackIDBase = 0x80000000
+
+type unwoundKey struct {
+	key    CountKey // without UserStackID, which is assigned when the counts are snapshotted
+	frames string   // the unwound frames, 8 bytes each, so that keys can be compared
+}
+
+// reads the user stack copies off the ring buffer until it is closed, and unwinds them right away, while the mappings
+// of the process are most likely still the ones the sample was taken with
+func (e *EbpfBackend) readUserStacks(rd *ringbuf.Reader) {
+	defer e.userStacksDone.Done()
+
+	var rec ringbuf.Record
+	var s profileUserStackSample
+	for {
+		if err := rd.ReadInto(&rec); err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			slog.Warn("Failed to read user stack from ring buffer", "error", err)
+			continue
+		}
+		if err := binary.Read(bytes.NewReader(rec.RawSample), binary.NativeEndian, &s); err != nil {
+			slog.Warn("Failed to decode user stack", "error", err)
+			continue
+		}
+
+		stack := s.Stack[:min(int(s.StackLen), len(s.Stack))]
+		frames, err := e.unwinder.Unwind(int(s.Key.Pid), s.Ip, s.Sp, s.Bp, stack)
+		if len(frames) > e.stackFrames {
+			frames = frames[:e.stackFrames]
+		}
+
+		e.unwoundMu.Lock()
+		if err != nil {
+			e.userStacksTruncated++
+			slog.Debug("User stack unwinding stopped early", "pid", s.Key.Pid, "frames", len(frames), "error", err)
+		}
+		e.unwoundCounts[unwoundKey{key: toCountKey(s.Key), frames: encodeFrames(frames)}] += s.Value
+		e.unwoundMu.Unlock()
+	}
+}
+
+// moves the counts of the unwound user stacks into results, handing out ids for their stacks, which LookupStacks
+// resolves until the next snapshot
+func (e *EbpfBackend) snapshotUnwoundCounts(results map[CountKey]uint64) {
+	e.unwoundMu.Lock()
+	counts := e.unwoundCounts
+	e.unwoundCounts = make(map[unwoundKey]uint64)
+	e.unwoundMu.Unlock()
+
+	e.unwoundStacks = make(map[uint32][]uint64)
+	ids := make(map[string]uint32)
+	for k, v := range counts {
+		key := k.key
+		key.UserStackID = missingSentinel
+		if k.frames != "" {
+			id, ok := ids[k.frames]
+			if !ok {
+				id = unwoundStackIDBase + uint32(len(ids))
+				ids[k.frames] = id
+				e.unwoundStacks[id] = decodeFrames(k.frames)
+			}
+			key.UserStackID = id
+		}
+		results[key] += v
+	}
+}
+
+func encodeFrames(frames []uint64) string {
+	b := make([]byte, 0, 8*len(frames))
+	for _, f := range frames {
+		b = binary.NativeEndian.AppendUint64(b, f)
+	}
+	return string(b)
+}
+
+func decodeFrames(s string) []uint64 {
+	frames := make([]uint64, len(s)/8)
+	for i := range frames {
+		frames[i] = binary.NativeEndian.Uint64([]byte(s[8*i : 8*i+8]))
+	}
+	return frames
+}
@@ -0,0 +1,75 @@
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestSnapshotUnwoundCounts(t *testing.T) {
+	key := CountKey{PID: 10, TID: 11, Comm: "app", KernelStackID: 3}
+	other := CountKey{PID: 10, TID: 12, Comm: "app", KernelStackID: missingSentinel}
+	e := &EbpfBackend{started: true, unwoundCounts: map[unwoundKey]uint64{
+		{key: key, frames: encodeFrames([]uint64{0x1000, 0x2000})}:   5,
+		{key: other, frames: encodeFrames([]uint64{0x1000, 0x2000})}: 7,
+		{key: other, frames: ""}:                                     1,
+	}}
+
+	results := map[CountKey]uint64{}
+	e.snapshotUnwoundCounts(results)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 counts, got %v", results)
+	}
+
+	var ids []uint32
+	for k, v := range results {
+		if k.UserStackID == missingSentinel {
+			if k.TID != 12 || v != 1 {
+				t.Fatalf("unexpected count without user stack: %+v=%d", k, v)
+			}
+			continue
+		}
+		ids = append(ids, k.UserStackID)
+		user, kernel, err := e.LookupStacks(k.UserStackID, missingSentinel)
+		if err != nil {
+			t.Fatalf("LookupStacks: %v", err)
+		}
+		if !slices.Equal(user, []uint64{0x1000, 0x2000}) || kernel != nil {
+			t.Fatalf("unexpected stacks: %#x %#x", user, kernel)
+		}
+	}
+	if len(ids) != 2 || ids[0] != ids[1] || ids[0] < unwoundStackIDBase {
+		t.Fatalf("expected the same stack to get the same id, got %#x", ids)
+	}
+	if len(e.unwoundCounts) != 0 {
+		t.Fatalf("expected the unwound counts to be drained, got %v", e.unwoundCounts)
+	}
+
+	// ids are only valid until the next snapshot
+	e.snapshotUnwoundCounts(map[CountKey]uint64{})
+	if user, _, err := e.LookupStacks(ids[0], missingSentinel); err != nil || user != nil || e.lookupFailures != 1 {
+		t.Fatalf("expected a lookup failure, got %#x, %v, %d failures", user, err, e.lookupFailures)
+	}
+}
+
+func TestUserStackSampleLayout(t *testing.T) {
+	// the size of struct user_stack_sample in profile.c
+	if size := binary.Size(profileUserStackSample{}); size != 8272 {
+		t.Fatalf("unexpected size %d", size)
+	}
+
+	in := profileUserStackSample{Key: profileCountKey{Pid: 10, Tid: 11}, Value: 3, Ip: 0x1000, Sp: 0x7ffd0000, StackLen: 16}
+	in.Stack[0] = 0xaa
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.NativeEndian, &in); err != nil {
+		t.Fatalf("binary.Write: %v", err)
+	}
+	var out profileUserStackSample
+	if err := binary.Read(&buf, binary.NativeEndian, &out); err != nil {
+		t.Fatalf("binary.Read: %v", err)
+	}
+	if out != in {
+		t.Fatalf("round trip changed the sample")
+	}
+}
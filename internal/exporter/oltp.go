@@ -3,6 +3,7 @@ package exporter
 import (
 	"os"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
 	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 	collectorpb "go.opentelemetry.io/proto/otlp/collector/profiles/v1development"
@@ -14,42 +15,47 @@ import (
 
 type NowFunc func() uint64 // produces unix nsec
 
-func BuildOltpProfile(samples []profiler.Sample, now NowFunc) *profilespb.ProfilesData {
+// sampleTypeName and sampleTypeUnit describe the sample values, e.g. "samples"/"count" or "off_cpu"/"nanoseconds"
+func BuildOltpProfile(samples []profiler.Sample, sampleTypeName, sampleTypeUnit string, now NowFunc) *profilespb.ProfilesData {
 	nowNsec := now()
 	stringTable := []string{""}
 	mappingTable := []*profilespb.Mapping{{}}
 	locationTable := []*profilespb.Location{{}}
 	functionTable := []*profilespb.Function{{}}
 	stackTable := []*profilespb.Stack{{}}
+	attributeTable := []*profilespb.KeyValueAndUnit{{}}
 
 	defaultMappingIdx := 0
-	profileSamples := make([]*profilespb.Sample, 0, len(samples))
+	// samples are grouped by the container they were taken in, which the OTel semantic conventions model as resources
+	var containers []container.Metadata
+	samplesByContainer := map[container.Metadata][]*profilespb.Sample{}
 
 	sampleType := &profilespb.ValueType{
-		TypeStrindex: strIndex(&stringTable, "samples"),
-		UnitStrindex: strIndex(&stringTable, "count"),
+		TypeStrindex: strIndex(&stringTable, sampleTypeName),
+		UnitStrindex: strIndex(&stringTable, sampleTypeUnit),
 	}
 
 	buildStack := func(symbols []symbolizer.Symbol) int32 {
 		locIndices := make([]int32, 0, len(symbols))
-		for _, sym := range symbols {
-			funcNameIdx := strIndex(&stringTable, sym.Name)
-			fn := &profilespb.Function{
-				NameStrindex:       funcNameIdx,
-				SystemNameStrindex: funcNameIdx,
-			}
-			functionTable = append(functionTable, fn)
-			fnIdx := int32(len(functionTable) - 1)
-
+		for _, frames := range locationFrames(symbols) {
 			loc := &profilespb.Location{
-				Address:      sym.Addr,
+				Address:      frames[0].Addr,
 				MappingIndex: int32(defaultMappingIdx),
-				Lines: []*profilespb.Line{
-					{
-						FunctionIndex: fnIdx,
-						Line:          0,
-					},
-				},
+			}
+			for _, sym := range frames {
+				funcNameIdx := strIndex(&stringTable, sym.Name)
+				fn := &profilespb.Function{
+					NameStrindex:       funcNameIdx,
+					SystemNameStrindex: funcNameIdx,
+					FilenameStrindex:   strIndex(&stringTable, sym.File),
+					StartLine:          int64(sym.StartLine),
+				}
+				functionTable = append(functionTable, fn)
+				fnIdx := int32(len(functionTable) - 1)
+				loc.Lines = append(loc.Lines, &profilespb.Line{
+					FunctionIndex: fnIdx,
+					Line:          int64(sym.Line),
+				})
 			}
 			locationTable = append(locationTable, loc)
 			locIdx := int32(len(locationTable) - 1)
@@ -78,51 +84,94 @@ func BuildOltpProfile(samples []profiler.Sample, now NowFunc) *profilespb.Profil
 
 		stackIdx := buildStack(symStack)
 
+		attrIndices := []int32{}
+		if s.PID != 0 {
+			attrIndices = append(attrIndices,
+				attrIndex(&attributeTable, &stringTable, "process.pid", &v1.AnyValue{Value: &v1.AnyValue_IntValue{IntValue: int64(s.PID)}}),
+				attrIndex(&attributeTable, &stringTable, "thread.id", &v1.AnyValue{Value: &v1.AnyValue_IntValue{IntValue: int64(s.TID)}}),
+			)
+		}
+		if s.Comm != "" {
+			attrIndices = append(attrIndices,
+				attrIndex(&attributeTable, &stringTable, "process.executable.name", &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: s.Comm}}),
+			)
+		}
+		if s.CgroupPath != "" {
+			attrIndices = append(attrIndices,
+				attrIndex(&attributeTable, &stringTable, "process.linux.cgroup", &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: s.CgroupPath}}),
+			)
+		}
+
 		pbSample := &profilespb.Sample{
 			StackIndex:         stackIdx,
 			Values:             []int64{int64(s.Count)},
-			AttributeIndices:   []int32{},
+			AttributeIndices:   attrIndices,
 			LinkIndex:          0,
 			TimestampsUnixNano: []uint64{uint64(s.Timestamp.UnixNano())},
 		}
-		profileSamples = append(profileSamples, pbSample)
+		if _, ok := samplesByContainer[s.Container]; !ok {
+			containers = append(containers, s.Container)
+		}
+		samplesByContainer[s.Container] = append(samplesByContainer[s.Container], pbSample)
 	}
-
-	profile := &profilespb.Profile{
-		TimeUnixNano: nowNsec,
-		DurationNano: uint64(0),
-		SampleType:   sampleType,
-		Samples:      profileSamples,
+	if len(containers) == 0 {
+		containers = []container.Metadata{{}}
 	}
 
-	resource := &resourceV1.Resource{}
-	resourceProfiles := &profilespb.ResourceProfiles{
-		Resource: resource, // TODO add attributes
-		ScopeProfiles: []*profilespb.ScopeProfiles{
-			{
-				Scope: &v1.InstrumentationScope{
-					Name:    "ebpf-profiler",
-					Version: "v1",
+	resourceProfiles := make([]*profilespb.ResourceProfiles, 0, len(containers))
+	for _, md := range containers {
+		profile := &profilespb.Profile{
+			TimeUnixNano: nowNsec,
+			DurationNano: uint64(0),
+			SampleType:   sampleType,
+			Samples:      samplesByContainer[md],
+		}
+		resourceProfiles = append(resourceProfiles, &profilespb.ResourceProfiles{
+			Resource: &resourceV1.Resource{Attributes: containerAttributes(md)},
+			ScopeProfiles: []*profilespb.ScopeProfiles{
+				{
+					Scope: &v1.InstrumentationScope{
+						Name:    "ebpf-profiler",
+						Version: "v1",
+					},
+					Profiles: []*profilespb.Profile{profile},
 				},
-				Profiles: []*profilespb.Profile{profile},
 			},
-		},
+		})
 	}
 
 	dictionary := &profilespb.ProfilesDictionary{
-		MappingTable:  mappingTable,
-		LocationTable: locationTable,
-		FunctionTable: functionTable,
-		StackTable:    stackTable,
-		StringTable:   stringTable,
+		MappingTable:   mappingTable,
+		LocationTable:  locationTable,
+		FunctionTable:  functionTable,
+		StackTable:     stackTable,
+		StringTable:    stringTable,
+		AttributeTable: attributeTable,
 	}
 
 	return &profilespb.ProfilesData{
-		ResourceProfiles: []*profilespb.ResourceProfiles{resourceProfiles},
+		ResourceProfiles: resourceProfiles,
 		Dictionary:       dictionary,
 	}
 }
 
+// resource attributes for the non-empty fields of the container metadata
+func containerAttributes(md container.Metadata) []*v1.KeyValue {
+	var attrs []*v1.KeyValue
+	for _, kv := range []struct{ key, value string }{
+		{"k8s.namespace.name", md.Namespace},
+		{"k8s.pod.name", md.PodName},
+		{"k8s.pod.uid", md.PodUID},
+		{"k8s.container.name", md.ContainerName},
+		{"container.id", md.ContainerID},
+	} {
+		if kv.value != "" {
+			attrs = append(attrs, &v1.KeyValue{Key: kv.key, Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: kv.value}}})
+		}
+	}
+	return attrs
+}
+
 func strIndex(table *[]string, s string) int32 {
 	for i, v := range *table {
 		if v == s {
@@ -133,6 +182,18 @@ func strIndex(table *[]string, s string) int32 {
 	return int32(len(*table) - 1)
 }
 
+// returns the index of the key/value attribute in the attribute table, adding it if needed
+func attrIndex(table *[]*profilespb.KeyValueAndUnit, stringTable *[]string, key string, value *v1.AnyValue) int32 {
+	keyIdx := strIndex(stringTable, key)
+	for i, kv := range *table {
+		if i > 0 && kv.KeyStrindex == keyIdx && proto.Equal(kv.Value, value) {
+			return int32(i)
+		}
+	}
+	*table = append(*table, &profilespb.KeyValueAndUnit{KeyStrindex: keyIdx, Value: value})
+	return int32(len(*table) - 1)
+}
+
 func WriteOltpProfile(prof *profilespb.ProfilesData, filename string) error {
 	f, err := os.Create(filename)
 	if err != nil {
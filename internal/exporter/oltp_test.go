@@ -1,9 +1,11 @@
 package exporter
 
 import (
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
 	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 	v1 "go.opentelemetry.io/proto/otlp/common/v1"
@@ -37,7 +39,7 @@ func TestBuildOltpProfile_Basic(t *testing.T) {
 		},
 	}
 
-	got := BuildOltpProfile(samples, func() uint64 { return nowValue })
+	got := BuildOltpProfile(samples, "samples", "count", func() uint64 { return nowValue })
 	expectedStringTable := []string{"", "samples", "count", "foo", "bar"}
 	expectedMappingTable := []*profilespb.Mapping{{}}
 	expectedFunctionTable := []*profilespb.Function{
@@ -113,11 +115,12 @@ func TestBuildOltpProfile_Basic(t *testing.T) {
 	}
 
 	expectedDict := &profilespb.ProfilesDictionary{
-		MappingTable:  expectedMappingTable,
-		LocationTable: expectedLocationTable,
-		FunctionTable: expectedFunctionTable,
-		StackTable:    expectedStackTable,
-		StringTable:   expectedStringTable,
+		MappingTable:   expectedMappingTable,
+		LocationTable:  expectedLocationTable,
+		FunctionTable:  expectedFunctionTable,
+		StackTable:     expectedStackTable,
+		StringTable:    expectedStringTable,
+		AttributeTable: []*profilespb.KeyValueAndUnit{{}},
 	}
 
 	expected := &profilespb.ProfilesData{
@@ -150,7 +153,7 @@ func TestBuildOltpProfile_ProtoEqual_CombinedStack(t *testing.T) {
 		},
 	}
 
-	got := BuildOltpProfile(samples, func() uint64 { return nowValue })
+	got := BuildOltpProfile(samples, "samples", "count", func() uint64 { return nowValue })
 
 	expectedStringTable := []string{"", "samples", "count", "u1", "u2", "k1"}
 	expectedMappingTable := []*profilespb.Mapping{{}}
@@ -204,11 +207,12 @@ func TestBuildOltpProfile_ProtoEqual_CombinedStack(t *testing.T) {
 	}
 
 	expectedDict := &profilespb.ProfilesDictionary{
-		MappingTable:  expectedMappingTable,
-		LocationTable: expectedLocationTable,
-		FunctionTable: expectedFunctionTable,
-		StackTable:    expectedStackTable,
-		StringTable:   expectedStringTable,
+		MappingTable:   expectedMappingTable,
+		LocationTable:  expectedLocationTable,
+		FunctionTable:  expectedFunctionTable,
+		StackTable:     expectedStackTable,
+		StringTable:    expectedStringTable,
+		AttributeTable: []*profilespb.KeyValueAndUnit{{}},
 	}
 
 	expected := &profilespb.ProfilesData{
@@ -222,3 +226,156 @@ func TestBuildOltpProfile_ProtoEqual_CombinedStack(t *testing.T) {
 		t.Fatalf("ProfilesData proto mismatch\nGOT (len %d): %x\nWANT (len %d): %x", len(gotB), gotB, len(wantB), wantB)
 	}
 }
+
+func TestBuildOltpProfile_ProcessAttributes(t *testing.T) {
+	samples := []profiler.Sample{
+		{
+			Timestamp:  time.Unix(30, 0),
+			PID:        100,
+			TID:        101,
+			Comm:       "server",
+			CgroupPath: "/system.slice/server.service",
+			UserStack:  []symbolizer.Symbol{{Name: "a", Addr: 0x10}},
+			Count:      1,
+		},
+		{
+			Timestamp:  time.Unix(30, 0),
+			PID:        100,
+			TID:        102,
+			Comm:       "server",
+			CgroupPath: "/system.slice/server.service",
+			UserStack:  []symbolizer.Symbol{{Name: "b", Addr: 0x20}},
+			Count:      2,
+		},
+	}
+
+	got := BuildOltpProfile(samples, "samples", "count", func() uint64 { return 0 })
+	dict := got.Dictionary
+
+	expectedAttributes := []struct {
+		key   string
+		value *v1.AnyValue
+	}{
+		{"", nil},
+		{"process.pid", &v1.AnyValue{Value: &v1.AnyValue_IntValue{IntValue: 100}}},
+		{"thread.id", &v1.AnyValue{Value: &v1.AnyValue_IntValue{IntValue: 101}}},
+		{"process.executable.name", &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "server"}}},
+		{"process.linux.cgroup", &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "/system.slice/server.service"}}},
+		{"thread.id", &v1.AnyValue{Value: &v1.AnyValue_IntValue{IntValue: 102}}},
+	}
+	if len(dict.AttributeTable) != len(expectedAttributes) {
+		t.Fatalf("unexpected attribute table size: got %d want %d", len(dict.AttributeTable), len(expectedAttributes))
+	}
+	for i, want := range expectedAttributes {
+		kv := dict.AttributeTable[i]
+		if dict.StringTable[kv.KeyStrindex] != want.key || !proto.Equal(kv.Value, want.value) {
+			t.Fatalf("unexpected attribute %d: %v", i, kv)
+		}
+	}
+
+	pbSamples := got.ResourceProfiles[0].ScopeProfiles[0].Profiles[0].Samples
+	if len(pbSamples) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(pbSamples))
+	}
+	if !slices.Equal(pbSamples[0].AttributeIndices, []int32{1, 2, 3, 4}) {
+		t.Fatalf("unexpected attributes for first sample: %v", pbSamples[0].AttributeIndices)
+	}
+	if !slices.Equal(pbSamples[1].AttributeIndices, []int32{1, 5, 3, 4}) {
+		t.Fatalf("unexpected attributes for second sample: %v", pbSamples[1].AttributeIndices)
+	}
+}
+
+func TestBuildOltpProfile_ContainerResources(t *testing.T) {
+	web := container.Metadata{ContainerID: "abc", ContainerName: "app", PodName: "web-7d9f", PodUID: "uid-1", Namespace: "shop"}
+	samples := []profiler.Sample{
+		{Timestamp: time.Unix(30, 0), Container: web, UserStack: []symbolizer.Symbol{{Name: "a", Addr: 0x10}}, Count: 1},
+		{Timestamp: time.Unix(30, 0), UserStack: []symbolizer.Symbol{{Name: "b", Addr: 0x20}}, Count: 2},
+		{Timestamp: time.Unix(30, 0), Container: web, UserStack: []symbolizer.Symbol{{Name: "c", Addr: 0x30}}, Count: 3},
+	}
+
+	got := BuildOltpProfile(samples, "samples", "count", func() uint64 { return 0 })
+	if len(got.ResourceProfiles) != 2 {
+		t.Fatalf("expected one resource per container, got %d", len(got.ResourceProfiles))
+	}
+
+	wantResource := &resourceV1.Resource{Attributes: []*v1.KeyValue{
+		{Key: "k8s.namespace.name", Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "shop"}}},
+		{Key: "k8s.pod.name", Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "web-7d9f"}}},
+		{Key: "k8s.pod.uid", Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "uid-1"}}},
+		{Key: "k8s.container.name", Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "app"}}},
+		{Key: "container.id", Value: &v1.AnyValue{Value: &v1.AnyValue_StringValue{StringValue: "abc"}}},
+	}}
+	if !proto.Equal(got.ResourceProfiles[0].Resource, wantResource) {
+		t.Fatalf("unexpected container resource: %v", got.ResourceProfiles[0].Resource)
+	}
+	if n := len(got.ResourceProfiles[0].ScopeProfiles[0].Profiles[0].Samples); n != 2 {
+		t.Fatalf("expected 2 samples for the container, got %d", n)
+	}
+
+	if !proto.Equal(got.ResourceProfiles[1].Resource, &resourceV1.Resource{}) {
+		t.Fatalf("samples outside of containers should have no resource attributes: %v", got.ResourceProfiles[1].Resource)
+	}
+	if n := len(got.ResourceProfiles[1].ScopeProfiles[0].Profiles[0].Samples); n != 1 {
+		t.Fatalf("expected 1 sample outside of containers, got %d", n)
+	}
+}
+
+func TestBuildOltpProfile_OffCPUSampleType(t *testing.T) {
+	samples := []profiler.Sample{
+		{
+			Timestamp: time.Unix(30, 0),
+			UserStack: []symbolizer.Symbol{{Name: "a", Addr: 0x10}},
+			Count:     1500,
+		},
+	}
+
+	got := BuildOltpProfile(samples, "off_cpu", "nanoseconds", func() uint64 { return 0 })
+	st := got.ResourceProfiles[0].ScopeProfiles[0].Profiles[0].SampleType
+	strs := got.Dictionary.StringTable
+	if strs[st.TypeStrindex] != "off_cpu" || strs[st.UnitStrindex] != "nanoseconds" {
+		t.Fatalf("unexpected sample type: %s/%s", strs[st.TypeStrindex], strs[st.UnitStrindex])
+	}
+}
+
+func TestBuildOltpProfile_Lines(t *testing.T) {
+	samples := []profiler.Sample{{
+		Timestamp: time.Unix(10, 0),
+		UserStack: []symbolizer.Symbol{{Name: "leaf", Addr: 0x401009, File: "lines.c", Line: 9, StartLine: 6}},
+		Count:     1,
+	}}
+	dict := BuildOltpProfile(samples, "samples", "count", func() uint64 { return 0 }).Dictionary
+
+	loc := dict.LocationTable[1]
+	if len(loc.Lines) != 1 || loc.Lines[0].Line != 9 {
+		t.Fatalf("unexpected lines: %+v", loc.Lines)
+	}
+	fn := dict.FunctionTable[loc.Lines[0].FunctionIndex]
+	if dict.StringTable[fn.FilenameStrindex] != "lines.c" || fn.StartLine != 6 {
+		t.Fatalf("unexpected function: %+v", fn)
+	}
+}
+
+func TestBuildOltpProfile_InlinedFrames(t *testing.T) {
+	samples := []profiler.Sample{{
+		Timestamp: time.Unix(10, 0),
+		UserStack: []symbolizer.Symbol{
+			{Name: "add", Addr: 0x401016, Line: 8, Inlined: true},
+			{Name: "work", Addr: 0x401016, Line: 19},
+			{Name: "_start", Addr: 0x401035, Line: 25},
+		},
+		Count: 1,
+	}}
+	dict := BuildOltpProfile(samples, "samples", "count", func() uint64 { return 0 }).Dictionary
+
+	stack := dict.StackTable[1]
+	if len(stack.LocationIndices) != 2 {
+		t.Fatalf("expected the inlined frame to share the location of work, got %+v", stack)
+	}
+	var got []string
+	for _, line := range dict.LocationTable[stack.LocationIndices[0]].Lines {
+		got = append(got, dict.StringTable[dict.FunctionTable[line.FunctionIndex].NameStrindex])
+	}
+	if !slices.Equal(got, []string{"add", "work"}) {
+		t.Fatalf("got lines of %v, want add then work", got)
+	}
+}
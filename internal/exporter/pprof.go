@@ -4,6 +4,7 @@ import (
 	"os"
 	"sort"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
 	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 	"github.com/google/pprof/profile"
@@ -17,56 +18,105 @@ func BuildPprofProfile(samples []profiler.Sample, sampleTypeName, sampleTypeUnit
 
 	p := &profile.Profile{
 		SampleType: []*profile.ValueType{{Type: sampleTypeName, Unit: sampleTypeUnit}},
-		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		PeriodType: &profile.ValueType{Type: sampleTypeName, Unit: sampleTypeUnit},
 	}
 
-	funcs := map[string]*profile.Function{}
-	locMap := map[uint64]*profile.Location{}
+	// functions of the same name may be defined in several files, e.g. static C functions
+	type funcKey struct {
+		name, file string
+	}
+	funcs := map[funcKey]*profile.Function{}
+	// the same address means something else in another mapped file, and for user frames outside of any mapping, in
+	// another process
+	type locKey struct {
+		mapping uint64 // ID, 0 for kernel frames and user frames outside of any mapping
+		pid     int    // only for user frames outside of any mapping
+		addr    uint64
+	}
+	locMap := map[locKey]*profile.Location{}
+	mappings := map[symbolizer.MapRegion]*profile.Mapping{}
 	nextFuncID := uint64(1)
 	nextLocID := uint64(1)
 
-	addFunction := func(name string) *profile.Function {
-		if f, ok := funcs[name]; ok {
+	addFunction := func(sym symbolizer.Symbol) *profile.Function {
+		key := funcKey{sym.Name, sym.File}
+		if f, ok := funcs[key]; ok {
 			return f
 		}
 		fn := &profile.Function{
-			ID:   nextFuncID,
-			Name: name,
+			ID:        nextFuncID,
+			Name:      sym.Name,
+			Filename:  sym.File,
+			StartLine: int64(sym.StartLine),
 		}
 		nextFuncID++
-		funcs[name] = fn
+		funcs[key] = fn
 		p.Function = append(p.Function, fn)
 		return fn
 	}
 
-	addLocationFor := func(sym symbolizer.Symbol) *profile.Location {
-		addr := sym.Addr
-		if loc, ok := locMap[addr]; ok {
+	// processes that map the same file at the same place share the mapping
+	addMapping := func(r *symbolizer.MapRegion) *profile.Mapping {
+		if m, ok := mappings[*r]; ok {
+			return m
+		}
+		// until a frame says otherwise, see symbolizedBy
+		m := &profile.Mapping{
+			ID:              uint64(len(p.Mapping) + 1),
+			Start:           r.Start,
+			Limit:           r.End,
+			Offset:          r.Offset,
+			File:            r.Path,
+			HasFunctions:    true,
+			HasFilenames:    true,
+			HasLineNumbers:  true,
+			HasInlineFrames: true,
+		}
+		mappings[*r] = m
+		p.Mapping = append(p.Mapping, m)
+		return m
+	}
+
+	addLocationFor := func(frames []symbolizer.Symbol, pid int) *profile.Location {
+		key := locKey{addr: frames[0].Addr}
+		var mapping *profile.Mapping
+		if r := frames[0].Mapping; r != nil {
+			mapping = addMapping(r)
+			key.mapping = mapping.ID
+		} else {
+			key.pid = pid
+		}
+		if loc, ok := locMap[key]; ok {
 			return loc
 		}
-		fn := addFunction(sym.Name)
 		loc := &profile.Location{
 			ID:      nextLocID,
-			Address: addr,
-			Line:    []profile.Line{{Function: fn, Line: 0}},
+			Mapping: mapping,
+			Address: key.addr,
+		}
+		for _, sym := range frames {
+			loc.Line = append(loc.Line, profile.Line{Function: addFunction(sym), Line: int64(sym.Line)})
+			if mapping != nil {
+				symbolizedBy(mapping, sym.Source)
+			}
 		}
 		nextLocID++
-		locMap[addr] = loc
+		locMap[key] = loc
 		p.Location = append(p.Location, loc)
 		return loc
 	}
 
 	// for each sample -> up to 2 pprof samples (we separate user and kernel, which is more flexible for downstream)
 	for _, s := range samples {
-		emit := func(stack []symbolizer.Symbol, typ string) {
+		// pid is that of the process the addresses of the stack belong to, 0 for the kernel
+		emit := func(stack []symbolizer.Symbol, typ string, pid int) {
 			if len(stack) == 0 {
 				return
 			}
 			// pprof assumes stacks are in leaf-to-root order, i.e. stack[0] is leaf (innermost)
 			locs := make([]*profile.Location, 0, len(stack))
-			for _, sym := range stack {
-				loc := addLocationFor(sym)
-				locs = append(locs, loc)
+			for _, frames := range locationFrames(stack) {
+				locs = append(locs, addLocationFor(frames, pid))
 			}
 
 			val := int64(s.Count)
@@ -78,11 +128,25 @@ func BuildPprofProfile(samples []profiler.Sample, sampleTypeName, sampleTypeUnit
 			}
 
 			pprofSample.Label["profile_type"] = []string{typ}
+			if s.PID != 0 {
+				pprofSample.NumLabel["pid"] = []int64{int64(s.PID)}
+				pprofSample.NumLabel["tid"] = []int64{int64(s.TID)}
+			}
+			if s.Comm != "" {
+				pprofSample.Label["comm"] = []string{s.Comm}
+			}
+			if s.CgroupID != 0 {
+				pprofSample.NumLabel["cgroup_id"] = []int64{int64(s.CgroupID)}
+			}
+			if s.CgroupPath != "" {
+				pprofSample.Label["cgroup"] = []string{s.CgroupPath}
+			}
+			addContainerLabels(pprofSample.Label, s.Container)
 			p.Sample = append(p.Sample, pprofSample)
 		}
 
-		emit(s.UserStack, "user")
-		emit(s.KernelStack, "kernel")
+		emit(s.UserStack, "user", s.PID)
+		emit(s.KernelStack, "kernel", 0)
 	}
 
 	// p.StartTime / Duration: use first and last sample timestamps
@@ -99,6 +163,46 @@ func BuildPprofProfile(samples []profiler.Sample, sampleTypeName, sampleTypeUnit
 	return p, nil
 }
 
+// clears the flags of m that source doesn't provide for its frames. They tell pprof which mappings are fully symbolized,
+// while it tries to symbolize the others itself, e.g. the placeholders of frames that couldn't be resolved.
+func symbolizedBy(m *profile.Mapping, source symbolizer.SymbolSource) {
+	m.HasFunctions = m.HasFunctions && source != symbolizer.SourceNone
+	lines := source == symbolizer.SourceGoPclntab || source == symbolizer.SourceDWARF
+	m.HasFilenames = m.HasFilenames && lines
+	m.HasLineNumbers = m.HasLineNumbers && lines
+	// inlined functions are only expanded from DWARF
+	m.HasInlineFrames = m.HasInlineFrames && source == symbolizer.SourceDWARF
+}
+
+// splits a stack into the frames of each location: a frame with the frames inlined into it, innermost first, as they
+// are all at the same address
+func locationFrames(stack []symbolizer.Symbol) [][]symbolizer.Symbol {
+	var locs [][]symbolizer.Symbol
+	start := 0
+	for i, sym := range stack {
+		if !sym.Inlined || i == len(stack)-1 {
+			locs = append(locs, stack[start:i+1])
+			start = i + 1
+		}
+	}
+	return locs
+}
+
+// labels the non-empty fields of the container metadata
+func addContainerLabels(labels map[string][]string, md container.Metadata) {
+	for _, kv := range []struct{ key, value string }{
+		{"namespace", md.Namespace},
+		{"pod", md.PodName},
+		{"pod_uid", md.PodUID},
+		{"container_name", md.ContainerName},
+		{"container_id", md.ContainerID},
+	} {
+		if kv.value != "" {
+			labels[kv.key] = []string{kv.value}
+		}
+	}
+}
+
 func WriteProfile(p *profile.Profile, filename string) error {
 	f, err := os.Create(filename)
 	if err != nil {
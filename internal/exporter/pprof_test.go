@@ -1,9 +1,12 @@
 package exporter
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
 	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 	"github.com/google/pprof/profile"
@@ -149,6 +152,137 @@ func TestBuildPprofProfile_UserAndKernelAndDedup(t *testing.T) {
 	}
 }
 
+// addresses are only unique within a mapped file, and outside of any mapping only within a process
+func TestBuildPprofProfile_Mappings(t *testing.T) {
+	app := &symbolizer.MapRegion{Start: 0x400000, End: 0x500000, Path: "/usr/bin/app"}
+	other := &symbolizer.MapRegion{Start: 0x400000, End: 0x480000, Path: "/usr/bin/other"}
+	libfoo := &symbolizer.MapRegion{Start: 0x7f0000000000, End: 0x7f0000100000, Path: "/usr/lib/libfoo.so"}
+	samples := []profiler.Sample{
+		{PID: 1, UserStack: []symbolizer.Symbol{{Name: "app.main", Addr: 0x401000, Mapping: app, Source: symbolizer.SourceDWARF}}, Count: 1},
+		// another instance of app, mapped at the same place
+		{PID: 2, UserStack: []symbolizer.Symbol{{Name: "app.main", Addr: 0x401000, Mapping: &symbolizer.MapRegion{Start: 0x400000, End: 0x500000, Path: "/usr/bin/app"}, Source: symbolizer.SourceDWARF}}, Count: 1},
+		// a library function below other.main that couldn't be resolved
+		{PID: 3, UserStack: []symbolizer.Symbol{{Name: "libfoo.so+0x1010", Addr: 0x7f0000001010, Mapping: libfoo}, {Name: "other.main", Addr: 0x401000, Mapping: other, Source: symbolizer.SourceELFSymbols}}, Count: 1},
+		{PID: 1, UserStack: []symbolizer.Symbol{{Name: symbolizer.UnknownFrame, Addr: 0x7000}}, KernelStack: []symbolizer.Symbol{{Name: "do_syscall_64", Addr: 0x7000}}, Count: 1},
+		{PID: 3, UserStack: []symbolizer.Symbol{{Name: symbolizer.UnknownFrame, Addr: 0x7000}}, Count: 1},
+	}
+	p, err := BuildPprofProfile(samples, "samples", "count")
+	if err != nil {
+		t.Fatalf("BuildPprofProfile error: %v", err)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+
+	if len(p.Mapping) != 3 || p.Mapping[0].File != "/usr/bin/app" || p.Mapping[1].File != "/usr/lib/libfoo.so" || p.Mapping[2].File != "/usr/bin/other" {
+		t.Fatalf("expected the mappings of app, libfoo and other, got %+v", p.Mapping)
+	}
+	if m := p.Mapping[0]; m.Start != 0x400000 || m.Limit != 0x500000 {
+		t.Fatalf("unexpected mapping of app: %+v", m)
+	}
+	// app.main, the libfoo frame, other.main, the unknown frames of pids 1 and 3, and the kernel frame
+	if len(p.Location) != 6 {
+		t.Fatalf("expected 6 locations, got %d", len(p.Location))
+	}
+	if p.Sample[0].Location[0] != p.Sample[1].Location[0] {
+		t.Fatalf("expected the instances of app to share their location")
+	}
+	if loc := p.Sample[2].Location[1]; loc.Mapping != p.Mapping[2] || loc.Line[0].Function.Name != "other.main" {
+		t.Fatalf("unexpected location of other.main: %+v", loc)
+	}
+
+	// what the sources the frames were resolved from provide
+	type flags struct{ functions, filenames, lineNumbers, inlineFrames bool }
+	for i, want := range []flags{{true, true, true, true}, {}, {functions: true}} {
+		m := p.Mapping[i]
+		if got := (flags{m.HasFunctions, m.HasFilenames, m.HasLineNumbers, m.HasInlineFrames}); got != want {
+			t.Errorf("mapping of %s: got %+v, want %+v", m.File, got, want)
+		}
+	}
+}
+
+func TestBuildPprofProfile_ProcessLabels(t *testing.T) {
+	s := profiler.Sample{
+		Timestamp:  time.Now(),
+		PID:        100,
+		TID:        101,
+		Comm:       "server",
+		CgroupID:   42,
+		CgroupPath: "/system.slice/server.service",
+		UserStack:  []symbolizer.Symbol{{Name: "foo", Addr: 0x1000}},
+		Count:      1,
+	}
+	p, err := BuildPprofProfile([]profiler.Sample{s}, "samples", "count")
+	if err != nil {
+		t.Fatalf("BuildPprofProfile error: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("expected 1 pprof sample, got %d", len(p.Sample))
+	}
+
+	pp := p.Sample[0]
+	if pid := pp.NumLabel["pid"]; len(pid) != 1 || pid[0] != 100 {
+		t.Fatalf("unexpected pid label: %v", pp.NumLabel)
+	}
+	if tid := pp.NumLabel["tid"]; len(tid) != 1 || tid[0] != 101 {
+		t.Fatalf("unexpected tid label: %v", pp.NumLabel)
+	}
+	if comm := pp.Label["comm"]; len(comm) != 1 || comm[0] != "server" {
+		t.Fatalf("unexpected comm label: %v", pp.Label)
+	}
+	if id := pp.NumLabel["cgroup_id"]; len(id) != 1 || id[0] != 42 {
+		t.Fatalf("unexpected cgroup_id label: %v", pp.NumLabel)
+	}
+	if cg := pp.Label["cgroup"]; len(cg) != 1 || cg[0] != "/system.slice/server.service" {
+		t.Fatalf("unexpected cgroup label: %v", pp.Label)
+	}
+}
+
+func TestBuildPprofProfile_ContainerLabels(t *testing.T) {
+	s := profiler.Sample{
+		Timestamp: time.Now(),
+		Container: container.Metadata{ContainerID: "abc", ContainerName: "app", PodName: "web-7d9f", Namespace: "shop"},
+		UserStack: []symbolizer.Symbol{{Name: "foo", Addr: 0x1000}},
+		Count:     1,
+	}
+	p, err := BuildPprofProfile([]profiler.Sample{s}, "samples", "count")
+	if err != nil {
+		t.Fatalf("BuildPprofProfile error: %v", err)
+	}
+
+	want := map[string][]string{
+		"profile_type":   {"user"},
+		"container_id":   {"abc"},
+		"container_name": {"app"},
+		"pod":            {"web-7d9f"},
+		"namespace":      {"shop"},
+	}
+	if !reflect.DeepEqual(p.Sample[0].Label, want) {
+		t.Fatalf("unexpected labels: got %v want %v", p.Sample[0].Label, want)
+	}
+}
+
+func TestBuildPprofProfile_OffCPUSampleType(t *testing.T) {
+	s := profiler.Sample{
+		Timestamp: time.Now(),
+		UserStack: []symbolizer.Symbol{{Name: "foo", Addr: 0x1000}},
+		Count:     1500,
+	}
+	p, err := BuildPprofProfile([]profiler.Sample{s}, "off_cpu", "nanoseconds")
+	if err != nil {
+		t.Fatalf("BuildPprofProfile error: %v", err)
+	}
+	if len(p.SampleType) != 1 || p.SampleType[0].Type != "off_cpu" || p.SampleType[0].Unit != "nanoseconds" {
+		t.Fatalf("unexpected sample type: %v", p.SampleType)
+	}
+	if p.PeriodType == nil || p.PeriodType.Type != "off_cpu" || p.PeriodType.Unit != "nanoseconds" {
+		t.Fatalf("unexpected period type: %v", p.PeriodType)
+	}
+	if p.Sample[0].Value[0] != 1500 {
+		t.Fatalf("unexpected value: %d", p.Sample[0].Value[0])
+	}
+}
+
 func findFuncByName(p *profile.Profile, name string) *profile.Function {
 	for _, f := range p.Function {
 		if f.Name == name {
@@ -166,3 +300,66 @@ func findLocByAddr(p *profile.Profile, addr uint64) *profile.Location {
 	}
 	return nil
 }
+
+func TestBuildPprofProfile_Lines(t *testing.T) {
+	s := profiler.Sample{
+		Timestamp: time.Now(),
+		UserStack: []symbolizer.Symbol{
+			{Name: "main.work", Addr: 0x1010, File: "/src/app/work.go", Line: 12, StartLine: 10},
+			{Name: "main.work", Addr: 0x1020, File: "/src/app/work.go", Line: 14, StartLine: 10},
+			{Name: "libfoo.so+0x1a2b", Addr: 0x7f0000001a2b},
+		},
+		Count: 1,
+	}
+	p, err := BuildPprofProfile([]profiler.Sample{s}, "samples", "count")
+	if err != nil {
+		t.Fatalf("BuildPprofProfile error: %v", err)
+	}
+	if len(p.Function) != 2 {
+		t.Fatalf("expected both lines to share their function, got %d functions", len(p.Function))
+	}
+	fn := findFuncByName(p, "main.work")
+	if fn == nil || fn.Filename != "/src/app/work.go" || fn.StartLine != 10 {
+		t.Fatalf("unexpected function: %+v", fn)
+	}
+	for addr, want := range map[uint64]int64{0x1010: 12, 0x1020: 14, 0x7f0000001a2b: 0} {
+		loc := findLocByAddr(p, addr)
+		if loc == nil || len(loc.Line) != 1 || loc.Line[0].Line != want {
+			t.Fatalf("expected line %d at %#x, got %+v", want, addr, loc)
+		}
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+}
+
+func TestBuildPprofProfile_InlinedFrames(t *testing.T) {
+	s := profiler.Sample{
+		Timestamp: time.Now(),
+		UserStack: []symbolizer.Symbol{
+			{Name: "add", Addr: 0x401016, Line: 8, Inlined: true},
+			{Name: "accumulate", Addr: 0x401016, Line: 14, Inlined: true},
+			{Name: "work", Addr: 0x401016, Line: 19},
+			{Name: "_start", Addr: 0x401035, Line: 25},
+		},
+		Count: 1,
+	}
+	p, err := BuildPprofProfile([]profiler.Sample{s}, "samples", "count")
+	if err != nil {
+		t.Fatalf("BuildPprofProfile error: %v", err)
+	}
+	if len(p.Sample) != 1 || len(p.Sample[0].Location) != 2 {
+		t.Fatalf("expected the inlined frames to share the location of work, got %+v", p.Sample)
+	}
+	var got []string
+	for _, line := range p.Sample[0].Location[0].Line {
+		got = append(got, fmt.Sprintf("%s:%d", line.Function.Name, line.Line))
+	}
+	// the caller last
+	if want := []string{"add:8", "accumulate:14", "work:19"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got lines %v, want %v", got, want)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+}
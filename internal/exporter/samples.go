@@ -0,0 +1,73 @@
+package exporter
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
+	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
+)
+
+// one line of the JSON Lines sample stream; stacks are leaf first
+type jsonSample struct {
+	Time        time.Time `json:"time"`
+	CPU         int       `json:"cpu"`
+	PID         int       `json:"pid"`
+	TID         int       `json:"tid"`
+	Comm        string    `json:"comm"`
+	Cgroup      string    `json:"cgroup,omitempty"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Pod         string    `json:"pod,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Event       string    `json:"event"`
+	Value       uint64    `json:"value"`
+	Unit        string    `json:"unit"`
+	UserStack   []string  `json:"user_stack,omitempty"`
+	KernelStack []string  `json:"kernel_stack,omitempty"`
+}
+
+// writes raw samples (see profiler.Profiler.RawSamples) as JSON Lines, one object per sample, so they can be
+// processed while profiling is still going on, e.g. with jq or by a log shipper
+type SampleWriter struct {
+	enc *json.Encoder
+}
+
+func NewSampleWriter(w io.Writer) *SampleWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false) // keeps frames like <unknown> or C++ templates readable
+	return &SampleWriter{enc: enc}
+}
+
+func (w *SampleWriter) Write(s profiler.Sample) error {
+	return w.enc.Encode(jsonSample{
+		Time:        s.Timestamp,
+		CPU:         s.CPU,
+		PID:         s.PID,
+		TID:         s.TID,
+		Comm:        s.Comm,
+		Cgroup:      s.CgroupPath,
+		ContainerID: s.Container.ContainerID,
+		Pod:         s.Container.PodName,
+		Namespace:   s.Container.Namespace,
+		Event:       s.Event,
+		Value:       s.Count,
+		Unit:        s.Unit,
+		UserStack:   frameNames(s.UserStack),
+		KernelStack: frameNames(s.KernelStack),
+	})
+}
+
+func frameNames(stack []symbolizer.Symbol) []string {
+	if len(stack) == 0 {
+		return nil
+	}
+	names := make([]string, len(stack))
+	for i, sym := range stack {
+		names[i] = sym.Name
+		if names[i] == "" {
+			names[i] = "<unknown>"
+		}
+	}
+	return names
+}
@@ -0,0 +1,61 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
+	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
+	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
+)
+
+func TestSampleWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewSampleWriter(&buf)
+	samples := []profiler.Sample{
+		{
+			Timestamp:   time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC),
+			CPU:         3,
+			PID:         10,
+			TID:         11,
+			Comm:        "worker",
+			CgroupPath:  "/kubepods/pod1/abc",
+			Container:   container.Metadata{ContainerID: "abc", PodName: "web", Namespace: "shop"},
+			UserStack:   []symbolizer.Symbol{{Name: "leaf"}, {}, {Name: "main"}},
+			KernelStack: []symbolizer.Symbol{{Name: "do_syscall_64"}},
+			Count:       10101010,
+			Event:       "cpu-clock",
+			Unit:        "nanoseconds",
+		},
+		{Timestamp: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC), PID: 12, TID: 12, Count: 1, Event: "off_cpu", Unit: "nanoseconds"},
+	}
+	for _, s := range samples {
+		if err := w.Write(s); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per sample, got %q", buf.String())
+	}
+	want := `{"time":"2024-01-02T03:04:05.000006Z","cpu":3,"pid":10,"tid":11,"comm":"worker","cgroup":"/kubepods/pod1/abc",` +
+		`"container_id":"abc","pod":"web","namespace":"shop","event":"cpu-clock","value":10101010,"unit":"nanoseconds",` +
+		`"user_stack":["leaf","<unknown>","main"],"kernel_stack":["do_syscall_64"]}`
+	if lines[0] != want {
+		t.Fatalf("unexpected line:\n got %s\nwant %s", lines[0], want)
+	}
+
+	var second map[string]any
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatalf("invalid JSON %q: %v", lines[1], err)
+	}
+	for _, k := range []string{"cgroup", "container_id", "user_stack", "kernel_stack"} {
+		if _, ok := second[k]; ok {
+			t.Fatalf("expected %s to be omitted, got %q", k, lines[1])
+		}
+	}
+}
@@ -7,46 +7,91 @@ import (
 	"sync"
 	"time"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
 	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 )
 
 type EbpfBackend interface {
-	Start(targetPID int, samplingPeriodNs uint64) error
+	Start(target ebpf.Target, profileType ebpf.ProfileType, event ebpf.PerfEvent, sampleHz uint64) error
 	Stop() error
-	SnapshotCounts() (map[uint64]uint64, error)
+	// returns the counts sampled up to the previous call: the ones since are held back for a grace period
+	SnapshotCounts() (map[ebpf.CountKey]uint64, error)
+	// returns the counts sampled since the previous call, including the ones held back; for the final snapshot
+	FlushCounts() (map[ebpf.CountKey]uint64, error)
 	LookupStacks(userID uint32, kernID uint32) ([]uint64, []uint64, error)
+	// returns the loss and error counters since Start
+	Stats() (ebpf.Stats, error)
+	// returns the stream of individual samples, closed by Stop; nil if the backend doesn't stream them
+	RawSamples() <-chan ebpf.RawSample
 }
 
 type Symbolizer interface {
 	Symbolize(stack []uint64) ([]symbolizer.Symbol, error)
 }
 
+// user space addresses are only meaningful within the process they were sampled in, so unlike kernel stacks, user
+// stacks are symbolized per PID
+type UserSymbolizer interface {
+	Symbolize(pid int, stack []uint64) ([]symbolizer.Symbol, error)
+}
+
+// maps the cgroup ids the samples carry to cgroup paths
+type CgroupResolver interface {
+	Path(id uint64) (string, error)
+}
+
+// identifies the container and pod of a cgroup; cgroups outside of containers get the zero Metadata
+type ContainerResolver interface {
+	Resolve(cgroupPath string) (container.Metadata, error)
+}
+
 type Sample struct {
-	Timestamp   time.Time
+	Timestamp   time.Time // end of the collection interval, or when the sample was taken for raw samples
+	CPU         int       // the CPU the sample was taken on; raw samples only
+	PID         int
+	TID         int
+	Comm        string
+	CgroupID    uint64
+	CgroupPath  string // relative to the cgroup v2 root, e.g. /system.slice/nginx.service; empty if it couldn't be resolved
+	Container   container.Metadata
 	UserStack   []symbolizer.Symbol
 	KernelStack []symbolizer.Symbol
-	Count       uint64
+	Count       uint64 // total of the event (on-CPU) or nanoseconds blocked (off-CPU) during the interval ending at Timestamp, or of the single sample for raw samples
+	Event       string // what Count measures, e.g. "cpu-clock", "page-faults" or "off_cpu"
+	Unit        string // unit of Count, e.g. "nanoseconds" or "count"
 }
 
 type Profiler struct {
-	pid              int
-	sampleHz         int
-	collectInterval  time.Duration
-	backend          EbpfBackend
-	userSymbolizer   Symbolizer
-	kernelSymbolizer Symbolizer
+	target            ebpf.Target
+	profileType       ebpf.ProfileType
+	event             ebpf.PerfEvent
+	sampleHz          int
+	collectInterval   time.Duration
+	backend           EbpfBackend
+	userSymbolizer    UserSymbolizer
+	kernelSymbolizer  Symbolizer
+	cgroupResolver    CgroupResolver
+	containerResolver ContainerResolver
 
-	samplesCh chan []Sample
+	samplesCh    chan []Sample
+	rawSamplesCh chan Sample
 
-	started bool
-	mu      sync.Mutex
-	ctx     context.Context
-	cancel  context.CancelFunc
-	wg      sync.WaitGroup
+	started    bool
+	mu         sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	collecting sync.WaitGroup // the collector, which needs the backend until it took the final snapshot
+	wg         sync.WaitGroup
+
+	// the backend's counters as of the final snapshot, which Stats returns once stopped
+	stopped       bool
+	finalStats    ebpf.Stats
+	finalStatsErr error
 }
 
-func NewProfiler(pid int, sampleHz int, collectInterval time.Duration, backend EbpfBackend, userSymbolizer Symbolizer, kernelSymbolizer Symbolizer) (*Profiler, error) {
+// event and sampleHz only apply to on-CPU profiles
+func NewProfiler(target ebpf.Target, profileType ebpf.ProfileType, event ebpf.PerfEvent, sampleHz int, collectInterval time.Duration, backend EbpfBackend, userSymbolizer UserSymbolizer, kernelSymbolizer Symbolizer, cgroupResolver CgroupResolver, containerResolver ContainerResolver) (*Profiler, error) {
 	if collectInterval <= 1*time.Millisecond {
 		return nil, errors.New("invalid collectInterval; must be > 1ms")
 	}
@@ -55,20 +100,51 @@ func NewProfiler(pid int, sampleHz int, collectInterval time.Duration, backend E
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Profiler{pid: pid,
-		sampleHz:         sampleHz,
-		collectInterval:  collectInterval,
-		backend:          backend,
-		userSymbolizer:   userSymbolizer,
-		kernelSymbolizer: kernelSymbolizer,
-		ctx:              ctx,
-		cancel:           cancel,
-		samplesCh:        make(chan []Sample, 1),
+	return &Profiler{target: target,
+		profileType:       profileType,
+		event:             event,
+		sampleHz:          sampleHz,
+		collectInterval:   collectInterval,
+		backend:           backend,
+		userSymbolizer:    userSymbolizer,
+		kernelSymbolizer:  kernelSymbolizer,
+		cgroupResolver:    cgroupResolver,
+		containerResolver: containerResolver,
+		ctx:               ctx,
+		cancel:            cancel,
+		samplesCh:         make(chan []Sample, 1),
+		rawSamplesCh:      make(chan Sample, 1),
 	}, nil
 }
 
+// returns the samples of each collection interval. It has to be received from until Stop closes it: the collector
+// waits for a slow consumer rather than dropping intervals, and Stop waits for the last, partial interval to be taken.
 func (p *Profiler) Samples() <-chan []Sample { return p.samplesCh }
 
+// returns every sample on its own, with its timestamp and CPU, if the backend streams them; the channel is closed by
+// Stop either way. Like Samples, it has to be received from until then; while the consumer is slow, the backend drops
+// what it can't buffer.
+func (p *Profiler) RawSamples() <-chan Sample { return p.rawSamplesCh }
+
+// returns the name and unit of the values in the samples, which is what exporters should use as the sample type
+func (p *Profiler) ValueType() (name, unit string) {
+	if p.profileType == ebpf.OffCPU {
+		return "off_cpu", "nanoseconds"
+	}
+	return p.event.Name, p.event.Unit
+}
+
+// returns the backend's loss and error counters, which tell whether the profile can be trusted; once stopped, the
+// ones Stop took after the final snapshot
+func (p *Profiler) Stats() (ebpf.Stats, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return p.finalStats, p.finalStatsErr
+	}
+	return p.backend.Stats()
+}
+
 func (p *Profiler) Start() error {
 	p.mu.Lock()
 	if p.started {
@@ -78,16 +154,19 @@ func (p *Profiler) Start() error {
 	p.started = true
 	p.mu.Unlock()
 
-	periodNs := uint64(1_000_000_000 / p.sampleHz)
-	if err := p.backend.Start(p.pid, periodNs); err != nil {
+	if err := p.backend.Start(p.target, p.profileType, p.event, uint64(p.sampleHz)); err != nil {
 		p.mu.Lock()
 		p.started = false
 		p.mu.Unlock()
 		return err
 	}
 
-	p.wg.Add(1)
+	p.collecting.Add(1)
 	go p.collector()
+	if raw := p.backend.RawSamples(); raw != nil {
+		p.wg.Add(1)
+		go p.streamer(raw)
+	}
 
 	return nil
 }
@@ -95,72 +174,132 @@ func (p *Profiler) Start() error {
 func (p *Profiler) Stop() error {
 	var stopErr error
 	p.cancel()
+	// the counts are deltas, so whatever was counted since the last tick is only in the maps until the backend stops
+	p.collecting.Wait()
+	// the final snapshot still adds to the counters, which the backend forgets once it stops
+	stats, statsErr := p.backend.Stats()
 
 	if err := p.backend.Stop(); err != nil {
 		stopErr = err
 	}
 
-	// Wait for collector to exit
+	// Wait for streamer to exit
 	p.wg.Wait()
 	close(p.samplesCh)
+	close(p.rawSamplesCh)
 
 	p.mu.Lock()
 	p.started = false
+	p.stopped = true
+	p.finalStats, p.finalStatsErr = stats, statsErr
 	p.mu.Unlock()
 	return stopErr
 }
 
 func (p *Profiler) collector() {
-	defer p.wg.Done()
+	defer p.collecting.Done()
 
 	ticker := time.NewTicker(p.collectInterval)
 	defer ticker.Stop()
 
+	// each snapshot returns the counts of the interval that ended with the previous tick
+	last := time.Now()
 	for {
 		select {
 		case <-p.ctx.Done():
+			p.samplesCh <- p.collect(p.backend.FlushCounts, time.Now())
 			return
 		case t := <-ticker.C:
-			counts, err := p.backend.SnapshotCounts()
-			if err != nil {
-				slog.Warn("Failed to collect counts from ebpf map", "error", err)
-				continue
-			}
-
-			var samples []Sample
-			for key, cnt := range counts {
-				userID, kernID := ebpf.UnpackKey(key)
-
-				userPCs, kernPCs, err := p.backend.LookupStacks(userID, kernID)
-				if err != nil {
-					slog.Warn("Failed to resolve stack keys", "error", err)
-					continue
-				}
-
-				userStack, err := p.userSymbolizer.Symbolize(userPCs)
-				if err != nil {
-					slog.Warn("Failed to symbolize user stack", "error", err)
-					continue
-				}
-				kernStack, err := p.kernelSymbolizer.Symbolize(kernPCs)
-				if err != nil {
-					slog.Warn("Failed to symbolize user stack", "error", err)
-					continue
-				}
-				s := Sample{
-					Timestamp:   t,
-					UserStack:   userStack,
-					KernelStack: kernStack,
-					Count:       cnt,
-				}
-				samples = append(samples, s)
-			}
-
+			samples := p.collect(p.backend.SnapshotCounts, last)
+			last = t
 			select {
 			case p.samplesCh <- samples:
-			default:
-				slog.Warn("consumer wasn't ready, sample dropped")
+			case <-p.ctx.Done():
+				// the consumer still gets this interval, together with the final one
+				p.samplesCh <- append(samples, p.collect(p.backend.FlushCounts, time.Now())...)
+				return
 			}
 		}
 	}
 }
+
+// takes a snapshot of the counts and builds their samples, timestamped t
+func (p *Profiler) collect(snapshot func() (map[ebpf.CountKey]uint64, error), t time.Time) []Sample {
+	counts, err := snapshot()
+	if err != nil {
+		slog.Warn("Failed to collect counts from ebpf map", "error", err)
+		return nil
+	}
+
+	event, unit := p.ValueType()
+	var samples []Sample
+	for key, cnt := range counts {
+		if s, ok := p.buildSample(key, cnt, t, event, unit); ok {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// symbolizes and forwards the backend's raw samples until the backend closes their stream, which Stop waits for
+func (p *Profiler) streamer(raw <-chan ebpf.RawSample) {
+	defer p.wg.Done()
+	event, unit := p.ValueType()
+
+	for rs := range raw {
+		s, ok := p.buildSample(rs.CountKey, rs.Value, rs.Time, event, unit)
+		if !ok {
+			continue
+		}
+		s.CPU = int(rs.CPU)
+		p.rawSamplesCh <- s
+	}
+}
+
+// resolves the stacks, cgroup and container of key; false if the sample has to be skipped
+func (p *Profiler) buildSample(key ebpf.CountKey, cnt uint64, t time.Time, event, unit string) (Sample, bool) {
+	userPCs, kernPCs, err := p.backend.LookupStacks(key.UserStackID, key.KernelStackID)
+	if err != nil {
+		slog.Warn("Failed to resolve stack keys", "error", err)
+		return Sample{}, false
+	}
+
+	// processes often exit before their last samples are collected, which are still worth keeping
+	userStack, err := p.userSymbolizer.Symbolize(int(key.PID), userPCs)
+	if err != nil {
+		slog.Debug("Failed to symbolize user stack, keeping its frames as unknown", "pid", key.PID, "error", err)
+		userStack = symbolizer.UnknownFrames(userPCs)
+	}
+	kernStack, err := p.kernelSymbolizer.Symbolize(kernPCs)
+	if err != nil {
+		slog.Warn("Failed to symbolize kernel stack", "error", err)
+		return Sample{}, false
+	}
+	// cgroups can be gone by the time we get to their samples, which are still worth keeping
+	cgroupPath, err := p.cgroupResolver.Path(key.CgroupID)
+	if err != nil {
+		slog.Debug("Failed to resolve cgroup", "cgroup_id", key.CgroupID, "error", err)
+	}
+	var ctr container.Metadata
+	if cgroupPath != "" {
+		// what could be resolved is still returned on errors
+		ctr, err = p.containerResolver.Resolve(cgroupPath)
+		if err != nil {
+			slog.Debug("Failed to resolve container", "cgroup", cgroupPath, "error", err)
+		}
+	}
+	return Sample{
+		Timestamp:   t,
+		PID:         int(key.PID),
+		TID:         int(key.TID),
+		Comm:        key.Comm,
+		CgroupID:    key.CgroupID,
+		CgroupPath:  cgroupPath,
+		Container:   ctr,
+		UserStack:   userStack,
+		KernelStack: kernStack,
+		Count:       cnt,
+		Event:       event,
+		Unit:        unit,
+	}, true
+}
@@ -7,13 +7,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
+	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 )
 
 func TestProfiler_StartStop_CallsBackend(t *testing.T) {
 	f := &mockBackend{}
 	sym := &mockSymbolizer{}
-	p, err := NewProfiler(1234, 100, 20*time.Millisecond, f, sym, sym)
+	p, err := NewProfiler(ebpf.Target{PID: 1234}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
@@ -27,17 +29,15 @@ func TestProfiler_StartStop_CallsBackend(t *testing.T) {
 		f.mu.Unlock()
 		t.Fatalf("backend.Start was not called")
 	}
-	if f.startArgs.targetPID != 1234 {
-		t.Fatalf("unexpected target pid: got %d", f.startArgs.targetPID)
+	if f.startArgs.target.PID != 1234 {
+		t.Fatalf("unexpected target pid: got %d", f.startArgs.target.PID)
 	}
-	if f.startArgs.samplingPeriod == 0 {
-		t.Fatalf("samplingPeriod not set")
+	if f.startArgs.sampleHz != 100 {
+		t.Fatalf("unexpected sampleHz: got %d", f.startArgs.sampleHz)
 	}
 	f.mu.Unlock()
 
-	if err := p.Stop(); err != nil {
-		t.Fatalf("Stop: %v", err)
-	}
+	stop(t, p)
 
 	f.mu.Lock()
 	if !f.stopCalled {
@@ -47,13 +47,118 @@ func TestProfiler_StartStop_CallsBackend(t *testing.T) {
 	f.mu.Unlock()
 }
 
+func TestProfiler_StartPassesProfileType(t *testing.T) {
+	f := &mockBackend{}
+	sym := &mockSymbolizer{}
+	p, err := NewProfiler(ebpf.Target{PID: 1234}, ebpf.OffCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer stop(t, p)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.startArgs.profileType != ebpf.OffCPU {
+		t.Fatalf("unexpected profile type: got %v", f.startArgs.profileType)
+	}
+}
+
+func TestProfiler_StartPassesEvent(t *testing.T) {
+	f := &mockBackend{}
+	sym := &mockSymbolizer{}
+	p, err := NewProfiler(ebpf.Target{PID: 1234}, ebpf.OnCPU, ebpf.PageFaults, 100, 20*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer stop(t, p)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.startArgs.event != ebpf.PageFaults {
+		t.Fatalf("unexpected event: got %v", f.startArgs.event)
+	}
+}
+
+func TestProfiler_ValueType(t *testing.T) {
+	tests := []struct {
+		profileType ebpf.ProfileType
+		event       ebpf.PerfEvent
+		wantName    string
+		wantUnit    string
+	}{
+		{ebpf.OnCPU, ebpf.CPUClock, "cpu-clock", "nanoseconds"},
+		{ebpf.OnCPU, ebpf.CacheMisses, "cache-misses", "count"},
+		{ebpf.OffCPU, ebpf.CPUClock, "off_cpu", "nanoseconds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantName, func(t *testing.T) {
+			p, err := NewProfiler(ebpf.Target{PID: 1}, tt.profileType, tt.event, 100, 20*time.Millisecond, &mockBackend{}, &mockUserSymbolizer{}, &mockSymbolizer{}, &mockCgroupResolver{}, &mockContainerResolver{})
+			if err != nil {
+				t.Fatalf("NewProfiler: %v", err)
+			}
+			name, unit := p.ValueType()
+			if name != tt.wantName || unit != tt.wantUnit {
+				t.Fatalf("unexpected value type: got %s/%s want %s/%s", name, unit, tt.wantName, tt.wantUnit)
+			}
+		})
+	}
+}
+
+func TestProfiler_Stats(t *testing.T) {
+	want := ebpf.Stats{Samples: 100, StackCollisions: 3, CountsEvicted: 1}
+	f := &mockBackend{stats: want}
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, &mockUserSymbolizer{}, &mockSymbolizer{}, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	got, err := p.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if got != want {
+		t.Fatalf("unexpected stats: got %+v want %+v", got, want)
+	}
+}
+
+func TestProfiler_StatsAfterStop(t *testing.T) {
+	want := ebpf.Stats{Samples: 100, LookupFailures: 2}
+	f := &mockBackend{stats: want}
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, time.Hour, f, &mockUserSymbolizer{}, &mockSymbolizer{}, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	stop(t, p)
+
+	got, err := p.Stats()
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if got != want {
+		t.Fatalf("unexpected stats: got %+v want %+v", got, want)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.statsFlushed {
+		t.Fatal("expected the stats to be taken after the final snapshot")
+	}
+}
+
 func TestProfiler_CollectorEmitsSamples(t *testing.T) {
 	userID := uint32(7)
 	kernID := uint32(3)
-	key := packKey(userID, kernID)
+	key := ebpf.CountKey{PID: 99, TID: 100, Comm: "worker", CgroupID: 1234, UserStackID: userID, KernelStackID: kernID}
 
 	f := &mockBackend{
-		snapshots: []map[uint64]uint64{
+		snapshots: []map[ebpf.CountKey]uint64{
 			{key: 42},
 		},
 		stacks: map[uint32][]uint64{
@@ -68,7 +173,9 @@ func TestProfiler_CollectorEmitsSamples(t *testing.T) {
 		},
 	}
 
-	p, err := NewProfiler(1, 100, 20*time.Millisecond, f, sym, sym)
+	userSym := &mockUserSymbolizer{sym: sym}
+	ctr := container.Metadata{ContainerID: "abc", ContainerName: "app", PodName: "web", Namespace: "shop"}
+	p, err := NewProfiler(ebpf.Target{PID: ebpf.AllProcesses}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, userSym, sym, &mockCgroupResolver{paths: map[uint64]string{1234: "/kubepods/pod1/abc"}}, &mockContainerResolver{containers: map[string]container.Metadata{"/kubepods/pod1/abc": ctr}})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
@@ -76,7 +183,7 @@ func TestProfiler_CollectorEmitsSamples(t *testing.T) {
 	if err := p.Start(); err != nil {
 		t.Fatalf("Start: %v", err)
 	}
-	defer p.Stop()
+	defer stop(t, p)
 
 	select {
 	case samples := <-p.Samples():
@@ -90,16 +197,34 @@ func TestProfiler_CollectorEmitsSamples(t *testing.T) {
 		if len(s.UserStack) != 2 || s.UserStack[0].Name != "f1" || s.UserStack[1].Name != "f2" {
 			t.Fatalf("unexpected user stack: %#v", s.UserStack)
 		}
+		if s.Event != "cpu-clock" || s.Unit != "nanoseconds" {
+			t.Fatalf("unexpected value type: %s/%s", s.Event, s.Unit)
+		}
+		if s.PID != 99 || s.TID != 100 || s.Comm != "worker" {
+			t.Fatalf("unexpected process attribution: pid=%d tid=%d comm=%q", s.PID, s.TID, s.Comm)
+		}
+		if s.CgroupID != 1234 || s.CgroupPath != "/kubepods/pod1/abc" {
+			t.Fatalf("unexpected cgroup: id=%d path=%q", s.CgroupID, s.CgroupPath)
+		}
+		if s.Container != ctr {
+			t.Fatalf("unexpected container: %+v", s.Container)
+		}
+		userSym.mu.Lock()
+		if len(userSym.pids) == 0 || userSym.pids[0] != 99 {
+			userSym.mu.Unlock()
+			t.Fatalf("user stack should be symbolized in the address space of pid 99, got %v", userSym.pids)
+		}
+		userSym.mu.Unlock()
 	case <-time.After(500 * time.Millisecond):
 		t.Fatalf("timed out waiting for sample")
 	}
 }
 
-func TestProfiler_CollectorDropsWhenConsumerBusy(t *testing.T) {
+func TestProfiler_CollectorWaitsForBusyConsumer(t *testing.T) {
 	userID := uint32(5)
-	key := packKey(userID, 0)
+	key := ebpf.CountKey{UserStackID: userID}
 	f := &mockBackend{
-		snapshots: []map[uint64]uint64{
+		snapshots: []map[ebpf.CountKey]uint64{
 			{key: 1},
 		},
 		stacks: map[uint32][]uint64{
@@ -111,7 +236,7 @@ func TestProfiler_CollectorDropsWhenConsumerBusy(t *testing.T) {
 		sMap: map[uint64]symbolizer.Symbol{0x10: {Name: "f"}},
 	}
 
-	p, err := NewProfiler(1, 100, 20*time.Millisecond, f, sym, sym)
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
@@ -120,9 +245,10 @@ func TestProfiler_CollectorDropsWhenConsumerBusy(t *testing.T) {
 		t.Fatalf("Start: %v", err)
 	}
 
-	// read the first sample to fill the buffer
+	var received int
 	select {
-	case <-p.Samples():
+	case batch := <-p.Samples():
+		received += len(batch)
 	case <-time.After(500 * time.Millisecond):
 		t.Fatalf("timed out waiting for first sample")
 	}
@@ -130,14 +256,39 @@ func TestProfiler_CollectorDropsWhenConsumerBusy(t *testing.T) {
 	// and now we fail to read samples for a while
 	time.Sleep(3 * p.collectInterval)
 
-	select {
-	case <-p.Samples():
-	default:
+	received += len(stop(t, p))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// every snapshot holds one sample, none of which may have been dropped
+	if received != f.snapshotCalls {
+		t.Fatalf("received %d samples from %d snapshots", received, f.snapshotCalls)
 	}
+}
 
-	// stop should return without being blocked
-	if err := p.Stop(); err != nil {
-		t.Fatalf("Stop: %v", err)
+// a command that exits before the first tick still has its samples collected
+func TestProfiler_StopCollectsLastInterval(t *testing.T) {
+	key := ebpf.CountKey{PID: 99, UserStackID: 7}
+	f := &mockBackend{
+		snapshots: []map[ebpf.CountKey]uint64{{key: 42}},
+		stacks:    map[uint32][]uint64{7: {0x1000}},
+	}
+	sym := &mockSymbolizer{sMap: map[uint64]symbolizer.Symbol{0x1000: {Name: "f1"}}}
+	p, err := NewProfiler(ebpf.Target{PID: 99}, ebpf.OnCPU, ebpf.CPUClock, 100, time.Hour, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	samples := stop(t, p)
+	if len(samples) != 1 || samples[0].Count != 42 || samples[0].UserStack[0].Name != "f1" {
+		t.Fatalf("expected the counts since the last tick, got %+v", samples)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.snapshotCalls != 1 || !f.flushed {
+		t.Fatalf("expected 1 snapshot flushing the held back counts, got %d (flushed: %v)", f.snapshotCalls, f.flushed)
 	}
 }
 
@@ -147,7 +298,7 @@ func TestProfiler_HandlesSnapshotError(t *testing.T) {
 	}
 
 	sym := &mockSymbolizer{}
-	p, err := NewProfiler(1, 100, 20*time.Millisecond, f, sym, sym)
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
@@ -155,7 +306,7 @@ func TestProfiler_HandlesSnapshotError(t *testing.T) {
 	if err := p.Start(); err != nil {
 		t.Fatalf("Start: %v", err)
 	}
-	defer p.Stop()
+	defer stop(t, p)
 
 	var samples []Sample
 	select {
@@ -171,7 +322,7 @@ func TestProfiler_HandlesSnapshotError(t *testing.T) {
 func TestProfiler_StartNotIdempotent(t *testing.T) {
 	f := &mockBackend{}
 	sym := &mockSymbolizer{}
-	p, err := NewProfiler(1, 100, 20*time.Millisecond, f, sym, sym)
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
@@ -183,27 +334,25 @@ func TestProfiler_StartNotIdempotent(t *testing.T) {
 	if err := p.Start(); err == nil {
 		t.Fatalf("expected error on second Start, got nil")
 	}
-	if err := p.Stop(); err != nil {
-		t.Fatalf("Stop: %v", err)
-	}
+	stop(t, p)
 }
 
 func TestProfiler_HandlesLookupStacksError(t *testing.T) {
 	userID := uint32(9)
-	key := packKey(userID, 0)
+	key := ebpf.CountKey{UserStackID: userID}
 	f := &mockBackend{
-		snapshots: []map[uint64]uint64{{key: 5}},
+		snapshots: []map[ebpf.CountKey]uint64{{key: 5}},
 		stacks:    nil,
 	}
 	sym := &mockSymbolizer{}
-	p, err := NewProfiler(1, 100, 10*time.Millisecond, f, sym, sym)
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 10*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
 	if err := p.Start(); err != nil {
 		t.Fatalf("Start: %v", err)
 	}
-	defer p.Stop()
+	defer stop(t, p)
 
 	select {
 	case samples := <-p.Samples():
@@ -217,20 +366,20 @@ func TestProfiler_HandlesLookupStacksError(t *testing.T) {
 
 func TestProfiler_HandlesSymbolizerError(t *testing.T) {
 	userID := uint32(11)
-	key := packKey(userID, 0)
+	key := ebpf.CountKey{UserStackID: userID}
 	f := &mockBackend{
-		snapshots: []map[uint64]uint64{{key: 3}},
+		snapshots: []map[ebpf.CountKey]uint64{{key: 3}},
 		stacks:    map[uint32][]uint64{userID: {0x1}},
 	}
 	sym := &mockSymbolizer{sErr: fmt.Errorf("boom")}
-	p, err := NewProfiler(1, 100, 10*time.Millisecond, f, sym, sym)
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 10*time.Millisecond, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
 	if err != nil {
 		t.Fatalf("NewProfiler: %v", err)
 	}
 	if err := p.Start(); err != nil {
 		t.Fatalf("Start: %v", err)
 	}
-	defer p.Stop()
+	defer stop(t, p)
 
 	select {
 	case samples := <-p.Samples():
@@ -242,32 +391,181 @@ func TestProfiler_HandlesSymbolizerError(t *testing.T) {
 	}
 }
 
+func TestProfiler_KeepsSamplesOfExitedProcesses(t *testing.T) {
+	key := ebpf.CountKey{PID: 99, UserStackID: 7}
+	f := &mockBackend{
+		snapshots: []map[ebpf.CountKey]uint64{{key: 3}},
+		stacks:    map[uint32][]uint64{7: {0x1000, 0x2000}},
+	}
+	sym := &mockSymbolizer{}
+	userSym := &mockUserSymbolizer{sym: sym, err: errors.New("open /proc/99/maps: no such file or directory")}
+	p, err := NewProfiler(ebpf.Target{PID: ebpf.AllProcesses}, ebpf.OnCPU, ebpf.CPUClock, 100, time.Hour, f, userSym, sym, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	samples := stop(t, p)
+	if len(samples) != 1 || samples[0].Count != 3 {
+		t.Fatalf("expected the sample to be kept, got %+v", samples)
+	}
+	want := []symbolizer.Symbol{{Name: symbolizer.UnknownFrame, Addr: 0x1000}, {Name: symbolizer.UnknownFrame, Addr: 0x2000}}
+	if got := samples[0].UserStack; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("unexpected user stack: %+v", got)
+	}
+}
+
+func TestProfiler_StreamsRawSamples(t *testing.T) {
+	key := ebpf.CountKey{PID: 99, TID: 100, Comm: "worker", UserStackID: 7, KernelStackID: 3}
+	f := &mockBackend{
+		stacks:     map[uint32][]uint64{7: {0x1000}},
+		rawSamples: make(chan ebpf.RawSample, 2),
+	}
+	sym := &mockSymbolizer{sMap: map[uint64]symbolizer.Symbol{0x1000: {Name: "f1"}}}
+	p, err := NewProfiler(ebpf.Target{PID: 99}, ebpf.OnCPU, ebpf.CPUClock, 100, time.Hour, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	ts := time.Unix(1700000000, 123)
+	f.rawSamples <- ebpf.RawSample{CountKey: key, Time: ts, CPU: 2, Value: 10101010}
+	// samples whose stacks can't be looked up are skipped
+	f.rawSamples <- ebpf.RawSample{CountKey: ebpf.CountKey{PID: 99, UserStackID: 8}, Time: ts, CPU: 1, Value: 1}
+
+	select {
+	case s := <-p.RawSamples():
+		if !s.Timestamp.Equal(ts) || s.CPU != 2 || s.Count != 10101010 {
+			t.Fatalf("unexpected sample: time=%v cpu=%d count=%d", s.Timestamp, s.CPU, s.Count)
+		}
+		if s.PID != 99 || s.TID != 100 || s.Comm != "worker" || s.Event != "cpu-clock" {
+			t.Fatalf("unexpected sample: %+v", s)
+		}
+		if len(s.UserStack) != 1 || s.UserStack[0].Name != "f1" {
+			t.Fatalf("unexpected user stack: %#v", s.UserStack)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("timed out waiting for raw sample")
+	}
+
+	stop(t, p)
+	if s, ok := <-p.RawSamples(); ok {
+		t.Fatalf("expected the stream to be closed, got %+v", s)
+	}
+}
+
+// what the backend streamed before it stopped still reaches the consumer
+func TestProfiler_StopForwardsStreamedRawSamples(t *testing.T) {
+	f := &mockBackend{
+		stacks:     map[uint32][]uint64{7: {0x1000}},
+		rawSamples: make(chan ebpf.RawSample, 3),
+	}
+	sym := &mockSymbolizer{sMap: map[uint64]symbolizer.Symbol{0x1000: {Name: "f1"}}}
+	p, err := NewProfiler(ebpf.Target{PID: 99}, ebpf.OnCPU, ebpf.CPUClock, 100, time.Hour, f, &mockUserSymbolizer{sym: sym}, sym, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	for range 3 {
+		f.rawSamples <- ebpf.RawSample{CountKey: ebpf.CountKey{PID: 99, UserStackID: 7}, Value: 1}
+	}
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range p.RawSamples() {
+			n++
+		}
+		received <- n
+	}()
+	go func() {
+		for range p.Samples() {
+		}
+	}()
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if n := <-received; n != 3 {
+		t.Fatalf("expected all 3 streamed samples, got %d", n)
+	}
+}
+
+func TestProfiler_RawSamplesClosedWithoutStreaming(t *testing.T) {
+	p, err := NewProfiler(ebpf.Target{PID: 1}, ebpf.OnCPU, ebpf.CPUClock, 100, 20*time.Millisecond, &mockBackend{}, &mockUserSymbolizer{}, &mockSymbolizer{}, &mockCgroupResolver{}, &mockContainerResolver{})
+	if err != nil {
+		t.Fatalf("NewProfiler: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	stop(t, p)
+	if _, ok := <-p.RawSamples(); ok {
+		t.Fatalf("expected the stream to be closed")
+	}
+}
+
+// stops p while receiving its samples until the channels are closed, like the exporters do; returns what was received
+// on Samples
+func stop(t *testing.T, p *Profiler) []Sample {
+	t.Helper()
+	received := make(chan []Sample)
+	go func() {
+		for range p.RawSamples() {
+		}
+	}()
+	go func() {
+		var all []Sample
+		for batch := range p.Samples() {
+			all = append(all, batch...)
+		}
+		received <- all
+	}()
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	return <-received
+}
+
 type mockBackend struct {
 	mu sync.Mutex
 
 	startErr error
 	stopErr  error
 
-	snapshots     []map[uint64]uint64
+	snapshots     []map[ebpf.CountKey]uint64
 	stacks        map[uint32][]uint64
 	snapshotError bool
 
 	startCalled bool
 	stopCalled  bool
 	startArgs   struct {
-		targetPID      int
-		samplingPeriod uint64
+		target      ebpf.Target
+		profileType ebpf.ProfileType
+		event       ebpf.PerfEvent
+		sampleHz    uint64
 	}
 
 	snapshotCalls int
+	flushed       bool
+	statsFlushed  bool // whether the last Stats call came after FlushCounts
+	stats         ebpf.Stats
+	rawSamples    chan ebpf.RawSample // closed by Stop, like the real backend does
 }
 
-func (f *mockBackend) Start(targetPID int, samplingPeriodNs uint64) error {
+func (f *mockBackend) Start(target ebpf.Target, profileType ebpf.ProfileType, event ebpf.PerfEvent, sampleHz uint64) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.startCalled = true
-	f.startArgs.targetPID = targetPID
-	f.startArgs.samplingPeriod = samplingPeriodNs
+	f.startArgs.target = target
+	f.startArgs.profileType = profileType
+	f.startArgs.event = event
+	f.startArgs.sampleHz = sampleHz
 	return f.startErr
 }
 
@@ -275,10 +573,13 @@ func (f *mockBackend) Stop() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.stopCalled = true
+	if f.rawSamples != nil {
+		close(f.rawSamples)
+	}
 	return f.stopErr
 }
 
-func (f *mockBackend) SnapshotCounts() (map[uint64]uint64, error) {
+func (f *mockBackend) SnapshotCounts() (map[ebpf.CountKey]uint64, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.snapshotCalls++
@@ -288,7 +589,7 @@ func (f *mockBackend) SnapshotCounts() (map[uint64]uint64, error) {
 	}
 
 	if len(f.snapshots) == 0 {
-		return map[uint64]uint64{}, nil
+		return map[ebpf.CountKey]uint64{}, nil
 	}
 
 	idx := f.snapshotCalls - 1
@@ -296,13 +597,20 @@ func (f *mockBackend) SnapshotCounts() (map[uint64]uint64, error) {
 		idx = len(f.snapshots) - 1
 	}
 
-	out := make(map[uint64]uint64, len(f.snapshots[idx]))
+	out := make(map[ebpf.CountKey]uint64, len(f.snapshots[idx]))
 	for k, v := range f.snapshots[idx] {
 		out[k] = v
 	}
 	return out, nil
 }
 
+func (f *mockBackend) FlushCounts() (map[ebpf.CountKey]uint64, error) {
+	f.mu.Lock()
+	f.flushed = true
+	f.mu.Unlock()
+	return f.SnapshotCounts()
+}
+
 func (f *mockBackend) LookupStacks(userID uint32, kernID uint32) ([]uint64, []uint64, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
@@ -320,6 +628,23 @@ func (f *mockBackend) LookupStacks(userID uint32, kernID uint32) ([]uint64, []ui
 	return uf, nil, nil
 }
 
+func (f *mockBackend) Stats() (ebpf.Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopCalled {
+		return ebpf.Stats{}, errors.New("profiler not started")
+	}
+	f.statsFlushed = f.flushed
+	return f.stats, nil
+}
+
+func (f *mockBackend) RawSamples() <-chan ebpf.RawSample {
+	if f.rawSamples == nil {
+		return nil
+	}
+	return f.rawSamples
+}
+
 type mockSymbolizer struct {
 	sErr error
 	sMap map[uint64]symbolizer.Symbol
@@ -340,6 +665,39 @@ func (m *mockSymbolizer) Symbolize(stack []uint64) ([]symbolizer.Symbol, error)
 	return s, nil
 }
 
-func packKey(user, kern uint32) uint64 {
-	return (uint64(user) << 32) | uint64(kern)
+type mockUserSymbolizer struct {
+	sym *mockSymbolizer
+	err error // e.g. for processes that exited
+
+	mu   sync.Mutex
+	pids []int
+}
+
+func (m *mockUserSymbolizer) Symbolize(pid int, stack []uint64) ([]symbolizer.Symbol, error) {
+	m.mu.Lock()
+	m.pids = append(m.pids, pid)
+	m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.sym.Symbolize(stack)
+}
+
+type mockCgroupResolver struct {
+	paths map[uint64]string
+}
+
+func (m *mockCgroupResolver) Path(id uint64) (string, error) {
+	if p, ok := m.paths[id]; ok {
+		return p, nil
+	}
+	return "", fmt.Errorf("cgroup %d not found", id)
+}
+
+type mockContainerResolver struct {
+	containers map[string]container.Metadata
+}
+
+func (m *mockContainerResolver) Resolve(cgroupPath string) (container.Metadata, error) {
+	return m.containers[cgroupPath], nil
 }
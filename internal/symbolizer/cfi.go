@@ -0,0 +1,617 @@
+package symbolizer
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Call frame information (.eh_frame, and .debug_frame as described in section 6.4 of the DWARF 5 spec) tells, for
+// every instruction of a function, how to find the frame of its caller: where the canonical frame address (CFA, the
+// value of the stack pointer in the caller) is, and where the caller's registers have been saved.
+
+var errTruncatedCFI = errors.New("truncated call frame information")
+
+// pointer encodings (DW_EH_PE_*) of .eh_frame, from the LSB spec
+const (
+	dwEhPeAbsptr   = 0x00
+	dwEhPeUleb128  = 0x01
+	dwEhPeUdata2   = 0x02
+	dwEhPeUdata4   = 0x03
+	dwEhPeUdata8   = 0x04
+	dwEhPeSleb128  = 0x09
+	dwEhPeSdata2   = 0x0a
+	dwEhPeSdata4   = 0x0b
+	dwEhPeSdata8   = 0x0c
+	dwEhPePcrel    = 0x10
+	dwEhPeIndirect = 0x80
+	dwEhPeOmit     = 0xff
+)
+
+// call frame instructions (DW_CFA_*); the first three keep their operand in the low 6 bits of the opcode
+const (
+	dwCfaAdvanceLoc                = 0x1 << 6
+	dwCfaOffset                    = 0x2 << 6
+	dwCfaRestore                   = 0x3 << 6
+	dwCfaNop                       = 0x00
+	dwCfaSetLoc                    = 0x01
+	dwCfaAdvanceLoc1               = 0x02
+	dwCfaAdvanceLoc2               = 0x03
+	dwCfaAdvanceLoc4               = 0x04
+	dwCfaOffsetExtended            = 0x05
+	dwCfaRestoreExtended           = 0x06
+	dwCfaUndefined                 = 0x07
+	dwCfaSameValue                 = 0x08
+	dwCfaRegister                  = 0x09
+	dwCfaRememberState             = 0x0a
+	dwCfaRestoreState              = 0x0b
+	dwCfaDefCfa                    = 0x0c
+	dwCfaDefCfaRegister            = 0x0d
+	dwCfaDefCfaOffset              = 0x0e
+	dwCfaDefCfaExpression          = 0x0f
+	dwCfaExpression                = 0x10
+	dwCfaOffsetExtendedSf          = 0x11
+	dwCfaDefCfaSf                  = 0x12
+	dwCfaDefCfaOffsetSf            = 0x13
+	dwCfaValOffset                 = 0x14
+	dwCfaValOffsetSf               = 0x15
+	dwCfaValExpression             = 0x16
+	dwCfaGNUArgsSize               = 0x2e
+	dwCfaGNUNegativeOffsetExtended = 0x2f
+)
+
+type ruleKind int
+
+const (
+	ruleUndefined  ruleKind = iota // not saved; for the return address this marks the outermost frame
+	ruleSameValue                  // unchanged from the callee
+	ruleOffset                     // saved at CFA+offset
+	ruleValOffset                  // the value is CFA+offset
+	ruleRegister                   // saved in another register
+	ruleExpression                 // computed by a DWARF expression, which we don't evaluate
+)
+
+type regRule struct {
+	kind   ruleKind
+	offset int64
+	reg    uint64
+}
+
+// the rules that apply at one instruction
+type unwindRow struct {
+	cfaReg    uint64
+	cfaOffset int64
+	cfaExpr   bool // the CFA is computed by a DWARF expression, e.g. in PLT entries
+	regs      map[uint64]regRule
+}
+
+func (r *unwindRow) clone() *unwindRow {
+	c := *r
+	c.regs = make(map[uint64]regRule, len(r.regs))
+	for reg, rule := range r.regs {
+		c.regs[reg] = rule
+	}
+	return &c
+}
+
+// registers no instruction mentions keep their value, which is what compilers assume for callee-saved registers
+func (r *unwindRow) rule(reg uint64) regRule {
+	if rule, ok := r.regs[reg]; ok {
+		return rule
+	}
+	return regRule{kind: ruleSameValue}
+}
+
+// common information entry: what the FDEs referring to it share
+type cie struct {
+	codeAlign    uint64
+	dataAlign    int64
+	raReg        uint64 // the column of the return address
+	fdeEncoding  byte
+	augData      bool // FDEs carry augmentation data ('z')
+	order        binary.ByteOrder
+	instructions []byte
+}
+
+// frame description entry: the instructions describing the frames of one function
+type fde struct {
+	cie          *cie
+	start, end   uint64
+	instructions []byte
+}
+
+// the call frame information of one ELF file, with the addresses of its loadable segments to translate runtime
+// addresses into the file's virtual addresses
+type frameTable struct {
+	fdes  []fde // sorted by start
+	loads elfLoads
+}
+
+// reads .eh_frame and .debug_frame; .eh_frame is present in almost every binary, as it is needed for C++ exceptions
+// and is not removed by strip, while .debug_frame is what Go binaries (and some -fno-asynchronous-unwind-tables
+// builds) have instead
+func loadFrameTable(ef *elf.File) (*frameTable, error) {
+	t := &frameTable{loads: readELFLoads(ef)}
+	for _, name := range []string{".eh_frame", ".debug_frame"} {
+		s := ef.Section(name)
+		if s == nil || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		fdes, err := parseFrameSection(data, s.Addr, name == ".eh_frame", ef.ByteOrder)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", name, err)
+		}
+		t.fdes = append(t.fdes, fdes...)
+	}
+	if len(t.fdes) == 0 {
+		return nil, errors.New("no call frame information in ELF")
+	}
+	sort.SliceStable(t.fdes, func(i, j int) bool { return t.fdes[i].start < t.fdes[j].start })
+	return t, nil
+}
+
+// FDEs don't overlap (or describe the same function, when both .eh_frame and .debug_frame are present), so only the
+// last one starting at or before pc can contain it
+func (t *frameTable) find(pc uint64) *fde {
+	i := sort.Search(len(t.fdes), func(i int) bool { return t.fdes[i].start > pc }) - 1
+	if i < 0 || pc >= t.fdes[i].end {
+		return nil
+	}
+	return &t.fdes[i]
+}
+
+// returns the rules that apply at pc, a virtual address of the file
+func (t *frameTable) rowFor(pc uint64) (*unwindRow, error) {
+	f := t.find(pc)
+	if f == nil {
+		return nil, fmt.Errorf("no FDE for pc %#x", pc)
+	}
+	row := &unwindRow{regs: make(map[uint64]regRule)}
+	if err := runCFA(f.cie.instructions, f.cie, f.start, ^uint64(0), row, nil); err != nil {
+		return nil, fmt.Errorf("CIE instructions: %w", err)
+	}
+	initial := row.clone()
+	if err := runCFA(f.instructions, f.cie, f.start, pc, row, initial); err != nil {
+		return nil, fmt.Errorf("FDE instructions at %#x: %w", f.start, err)
+	}
+	return row, nil
+}
+
+// executes the call frame instructions from loc up to pc, updating row. initial holds the rules set up by the CIE,
+// which DW_CFA_restore goes back to.
+func runCFA(program []byte, c *cie, loc, pc uint64, row *unwindRow, initial *unwindRow) error {
+	r := &cfiReader{b: program, order: c.order}
+	var remembered []*unwindRow
+	for r.off < len(r.b) && r.err == nil {
+		op := r.u8()
+		switch op & 0xc0 {
+		case dwCfaAdvanceLoc:
+			loc += uint64(op&0x3f) * c.codeAlign
+			if loc > pc {
+				return nil
+			}
+			continue
+		case dwCfaOffset:
+			row.regs[uint64(op&0x3f)] = regRule{kind: ruleOffset, offset: int64(r.uleb()) * c.dataAlign}
+			continue
+		case dwCfaRestore:
+			restore(row, initial, uint64(op&0x3f))
+			continue
+		}
+
+		switch op {
+		case dwCfaNop:
+		case dwCfaAdvanceLoc1, dwCfaAdvanceLoc2, dwCfaAdvanceLoc4:
+			var delta uint64
+			switch op {
+			case dwCfaAdvanceLoc1:
+				delta = uint64(r.u8())
+			case dwCfaAdvanceLoc2:
+				delta = uint64(r.u16())
+			default:
+				delta = uint64(r.u32())
+			}
+			loc += delta * c.codeAlign
+			if loc > pc {
+				return r.err
+			}
+		case dwCfaOffsetExtended:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleOffset, offset: int64(r.uleb()) * c.dataAlign}
+		case dwCfaOffsetExtendedSf:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleOffset, offset: r.sleb() * c.dataAlign}
+		case dwCfaGNUNegativeOffsetExtended:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleOffset, offset: -int64(r.uleb()) * c.dataAlign}
+		case dwCfaValOffset:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleValOffset, offset: int64(r.uleb()) * c.dataAlign}
+		case dwCfaValOffsetSf:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleValOffset, offset: r.sleb() * c.dataAlign}
+		case dwCfaRestoreExtended:
+			restore(row, initial, r.uleb())
+		case dwCfaUndefined:
+			row.regs[r.uleb()] = regRule{kind: ruleUndefined}
+		case dwCfaSameValue:
+			row.regs[r.uleb()] = regRule{kind: ruleSameValue}
+		case dwCfaRegister:
+			reg := r.uleb()
+			row.regs[reg] = regRule{kind: ruleRegister, reg: r.uleb()}
+		case dwCfaExpression, dwCfaValExpression:
+			reg := r.uleb()
+			r.bytes(int(r.uleb()))
+			row.regs[reg] = regRule{kind: ruleExpression}
+		case dwCfaRememberState:
+			remembered = append(remembered, row.clone())
+		case dwCfaRestoreState:
+			if len(remembered) == 0 {
+				return errors.New("DW_CFA_restore_state without remembered state")
+			}
+			*row = *remembered[len(remembered)-1]
+			remembered = remembered[:len(remembered)-1]
+		case dwCfaDefCfa:
+			row.cfaReg = r.uleb()
+			row.cfaOffset = int64(r.uleb())
+			row.cfaExpr = false
+		case dwCfaDefCfaSf:
+			row.cfaReg = r.uleb()
+			row.cfaOffset = r.sleb() * c.dataAlign
+			row.cfaExpr = false
+		case dwCfaDefCfaRegister:
+			row.cfaReg = r.uleb()
+			row.cfaExpr = false
+		case dwCfaDefCfaOffset:
+			row.cfaOffset = int64(r.uleb())
+		case dwCfaDefCfaOffsetSf:
+			row.cfaOffset = r.sleb() * c.dataAlign
+		case dwCfaDefCfaExpression:
+			r.bytes(int(r.uleb()))
+			row.cfaExpr = true
+		case dwCfaGNUArgsSize:
+			r.uleb()
+		case dwCfaSetLoc:
+			// only emitted by toolchains for segmented architectures, and its operand is relative to the section
+			return errors.New("DW_CFA_set_loc is not supported")
+		default:
+			return fmt.Errorf("unknown call frame instruction %#x", op)
+		}
+	}
+	return r.err
+}
+
+func restore(row, initial *unwindRow, reg uint64) {
+	if initial == nil {
+		delete(row.regs, reg)
+		return
+	}
+	if rule, ok := initial.regs[reg]; ok {
+		row.regs[reg] = rule
+	} else {
+		delete(row.regs, reg)
+	}
+}
+
+// parses the CIEs and FDEs of a .eh_frame or .debug_frame section loaded at addr. The two formats differ in how CIEs
+// are told apart and referred to, and in the encoding of addresses. FDEs whose CIE can't be parsed (e.g. because of
+// unknown augmentations) are skipped.
+func parseFrameSection(data []byte, addr uint64, ehFrame bool, order binary.ByteOrder) ([]fde, error) {
+	cies := make(map[int]*cie)
+	cieAt := func(off int) (*cie, error) {
+		if c, ok := cies[off]; ok {
+			return c, nil
+		}
+		e, err := readEntry(data, off, order)
+		if err != nil {
+			return nil, err
+		}
+		if !e.isCIE(ehFrame) {
+			return nil, fmt.Errorf("entry at %#x is not a CIE", off)
+		}
+		c, err := parseCIE(e.body)
+		cies[off] = c // unsupported CIEs are not tried again
+		return c, err
+	}
+
+	var fdes []fde
+	for off := 0; off < len(data); {
+		e, err := readEntry(data, off, order)
+		if err != nil {
+			return nil, err
+		}
+		if e.length == 0 {
+			if ehFrame {
+				break // terminator
+			}
+			off = e.end
+			continue
+		}
+		if !e.isCIE(ehFrame) {
+			cieOff := int(e.id)
+			if ehFrame {
+				cieOff = e.idOff - int(e.id) // relative to the CIE pointer itself
+			}
+			if c, err := cieAt(cieOff); err == nil && c != nil {
+				if f, err := parseFDE(e.body, c, addr); err == nil {
+					fdes = append(fdes, f)
+				}
+			}
+		}
+		off = e.end
+	}
+	return fdes, nil
+}
+
+type frameEntry struct {
+	length uint64
+	id     uint64 // CIE id, or the CIE pointer of FDEs
+	idOff  int    // section offset of the id
+	is64   bool
+	body   *cfiReader // positioned after the id and limited to the entry
+	end    int
+}
+
+func readEntry(data []byte, off int, order binary.ByteOrder) (frameEntry, error) {
+	r := &cfiReader{b: data, off: off, order: order}
+	e := frameEntry{length: uint64(r.u32())}
+	if e.length == 0xffffffff {
+		e.length = r.u64()
+		e.is64 = true
+	}
+	if r.err != nil {
+		return e, r.err
+	}
+	if e.length > uint64(len(data)-r.off) {
+		return e, errTruncatedCFI
+	}
+	e.end = r.off + int(e.length)
+	if e.length == 0 {
+		return e, nil
+	}
+	e.idOff = r.off
+	if e.is64 {
+		e.id = r.u64()
+	} else {
+		e.id = uint64(r.u32())
+	}
+	// the entry's offsets stay relative to the section, which pc-relative pointers need
+	e.body = &cfiReader{b: data[:e.end], off: r.off, order: order}
+	return e, r.err
+}
+
+func (e frameEntry) isCIE(ehFrame bool) bool {
+	if ehFrame {
+		return e.id == 0
+	}
+	if e.is64 {
+		return e.id == 0xffffffffffffffff
+	}
+	return e.id == 0xffffffff
+}
+
+func parseCIE(r *cfiReader) (*cie, error) {
+	version := r.u8()
+	if version != 1 && version != 3 && version != 4 {
+		return nil, fmt.Errorf("unsupported CIE version %d", version)
+	}
+	aug := r.cstring()
+	if version == 4 {
+		r.u8() // address_size
+		r.u8() // segment_selector_size
+	}
+	c := &cie{fdeEncoding: dwEhPeAbsptr, order: r.order}
+	c.codeAlign = r.uleb()
+	c.dataAlign = r.sleb()
+	if version == 1 {
+		c.raReg = uint64(r.u8())
+	} else {
+		c.raReg = r.uleb()
+	}
+
+	if strings.HasPrefix(aug, "z") {
+		c.augData = true
+		ad := &cfiReader{b: r.bytes(int(r.uleb())), order: r.order}
+		for _, ch := range aug[1:] {
+			switch ch {
+			case 'R':
+				c.fdeEncoding = ad.u8()
+			case 'P': // personality routine
+				ad.skipPointer(ad.u8())
+			case 'L': // the LSDA pointers in the FDE's augmentation data get skipped as a whole
+				ad.u8()
+			case 'S', 'B', 'G': // signal frames, aarch64 pointer authentication and memory tagging
+			default:
+				return nil, fmt.Errorf("unsupported CIE augmentation %q", aug)
+			}
+		}
+		if ad.err != nil {
+			return nil, ad.err
+		}
+	} else if aug != "" {
+		return nil, fmt.Errorf("unsupported CIE augmentation %q", aug)
+	}
+	c.instructions = r.b[r.off:]
+	return c, r.err
+}
+
+func parseFDE(r *cfiReader, c *cie, sectionAddr uint64) (fde, error) {
+	start, err := r.pointer(c.fdeEncoding, sectionAddr)
+	if err != nil {
+		return fde{}, err
+	}
+	// the range is just a size, so it is never relative to anything
+	size, err := r.pointer(c.fdeEncoding&0x0f, 0)
+	if err != nil {
+		return fde{}, err
+	}
+	if c.augData {
+		r.bytes(int(r.uleb()))
+	}
+	if r.err != nil {
+		return fde{}, r.err
+	}
+	return fde{cie: c, start: start, end: start + size, instructions: r.b[r.off:]}, nil
+}
+
+// reads the encoded integers of call frame information; errors stick, so they can be checked once at the end
+type cfiReader struct {
+	b     []byte
+	off   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *cfiReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b)-r.off {
+		r.err = errTruncatedCFI
+		r.off = len(r.b)
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *cfiReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *cfiReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return r.order.Uint16(b)
+	}
+	return 0
+}
+
+func (r *cfiReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return r.order.Uint32(b)
+	}
+	return 0
+}
+
+func (r *cfiReader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return r.order.Uint64(b)
+	}
+	return 0
+}
+
+func (r *cfiReader) uleb() uint64 {
+	var v uint64
+	var shift uint
+	for {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			v |= uint64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *cfiReader) sleb() int64 {
+	var v int64
+	var shift uint
+	var b byte
+	for {
+		b = r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			v |= int64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if shift < 64 && b&0x40 != 0 {
+		v |= -1 << shift // sign extend
+	}
+	return v
+}
+
+func (r *cfiReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.b[r.off:], 0)
+	if i < 0 {
+		r.err = errTruncatedCFI
+		return ""
+	}
+	s := string(r.b[r.off : r.off+i])
+	r.off += i + 1
+	return s
+}
+
+// reads a pointer in one of the DW_EH_PE_* encodings; sectionAddr is the address the section is loaded at, which
+// pc-relative pointers are relative to (together with their offset in it)
+func (r *cfiReader) pointer(enc byte, sectionAddr uint64) (uint64, error) {
+	if enc == dwEhPeOmit {
+		return 0, nil
+	}
+	if enc&dwEhPeIndirect != 0 {
+		return 0, fmt.Errorf("unsupported indirect pointer encoding %#x", enc)
+	}
+	fieldAddr := sectionAddr + uint64(r.off)
+	var v uint64
+	switch enc & 0x0f {
+	case dwEhPeAbsptr, dwEhPeUdata8, dwEhPeSdata8:
+		v = r.u64()
+	case dwEhPeUleb128:
+		v = r.uleb()
+	case dwEhPeUdata2:
+		v = uint64(r.u16())
+	case dwEhPeUdata4:
+		v = uint64(r.u32())
+	case dwEhPeSleb128:
+		v = uint64(r.sleb())
+	case dwEhPeSdata2:
+		v = uint64(int64(int16(r.u16())))
+	case dwEhPeSdata4:
+		v = uint64(int64(int32(r.u32())))
+	default:
+		return 0, fmt.Errorf("unsupported pointer encoding %#x", enc)
+	}
+	switch enc & 0x70 {
+	case 0:
+	case dwEhPePcrel:
+		v += fieldAddr
+	default:
+		return 0, fmt.Errorf("unsupported pointer encoding %#x", enc)
+	}
+	return v, r.err
+}
+
+func (r *cfiReader) skipPointer(enc byte) {
+	if enc == dwEhPeOmit {
+		return
+	}
+	// whatever the pointer is relative to doesn't change its size
+	if _, err := r.pointer(enc&0x0f, 0); err != nil && r.err == nil {
+		r.err = err
+	}
+}
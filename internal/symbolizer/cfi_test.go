@@ -0,0 +1,169 @@
+package symbolizer
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"runtime"
+	"testing"
+)
+
+type testFDE struct {
+	start, size  uint64
+	instructions []byte
+}
+
+// assembles an .eh_frame section loaded at sectionAddr, with the CIE gcc emits on x86-64 (CFA=rsp+8 and the return
+// address at CFA-8 on function entry) and an FDE per function
+func buildEhFrame(sectionAddr uint64, fdes []testFDE) []byte {
+	le := binary.LittleEndian
+	cie := []byte{0, 0, 0, 0, 1, 'z', 'R', 0, 1, 0x78, 16, 1, dwEhPePcrel | dwEhPeSdata4,
+		dwCfaDefCfa, x86RegSP, 8, dwCfaOffset | x86RegRA, 1}
+	b := le.AppendUint32(nil, uint32(len(cie)))
+	b = append(b, cie...)
+	for _, f := range fdes {
+		start := len(b)
+		b = le.AppendUint32(b, 0)              // length, filled in below
+		b = le.AppendUint32(b, uint32(len(b))) // CIE pointer, relative to itself
+		b = le.AppendUint32(b, uint32(int32(int64(f.start)-int64(sectionAddr+uint64(len(b))))))
+		b = le.AppendUint32(b, uint32(f.size))
+		b = append(b, 0) // no augmentation data
+		b = append(b, f.instructions...)
+		le.PutUint32(b[start:], uint32(len(b)-start-4))
+	}
+	return le.AppendUint32(b, 0) // terminator
+}
+
+// push %rbp; mov %rsp,%rbp; ...; pop %rbp; ret
+var framePointerPrologue = []byte{
+	dwCfaAdvanceLoc | 1, dwCfaDefCfaOffset, 16, dwCfaOffset | x86RegBP, 2,
+	dwCfaAdvanceLoc | 3, dwCfaDefCfaRegister, x86RegBP,
+	dwCfaAdvanceLoc1, 0x20, dwCfaRememberState, dwCfaDefCfa, x86RegSP, 8,
+	dwCfaAdvanceLoc | 1, dwCfaRestoreState,
+}
+
+func TestParseFrameSection(t *testing.T) {
+	data := buildEhFrame(0x2000, []testFDE{
+		{start: 0x1000, size: 0x40, instructions: framePointerPrologue},
+		{start: 0x1040, size: 0x10},
+	})
+	fdes, err := parseFrameSection(data, 0x2000, true, binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("parseFrameSection: %v", err)
+	}
+	if len(fdes) != 2 {
+		t.Fatalf("expected 2 FDEs, got %d", len(fdes))
+	}
+	if fdes[0].start != 0x1000 || fdes[0].end != 0x1040 || fdes[1].start != 0x1040 || fdes[1].end != 0x1050 {
+		t.Fatalf("unexpected FDE ranges: %#x-%#x, %#x-%#x", fdes[0].start, fdes[0].end, fdes[1].start, fdes[1].end)
+	}
+	if fdes[0].cie != fdes[1].cie || fdes[0].cie.dataAlign != -8 || fdes[0].cie.raReg != x86RegRA {
+		t.Fatalf("unexpected CIE: %+v", fdes[0].cie)
+	}
+}
+
+func TestParseFrameSection_Truncated(t *testing.T) {
+	data := buildEhFrame(0, []testFDE{{start: 0x1000, size: 0x40}})
+	if _, err := parseFrameSection(data[:len(data)-8], 0, true, binary.LittleEndian); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFrameTable_RowFor(t *testing.T) {
+	fdes, err := parseFrameSection(buildEhFrame(0, []testFDE{{start: 0x1000, size: 0x40, instructions: framePointerPrologue}}), 0, true, binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("parseFrameSection: %v", err)
+	}
+	table := &frameTable{fdes: fdes}
+
+	tests := []struct {
+		name      string
+		pc        uint64
+		cfaReg    uint64
+		cfaOffset int64
+		bp        regRule
+	}{
+		{"entry", 0x1000, x86RegSP, 8, regRule{kind: ruleSameValue}},
+		{"after push", 0x1001, x86RegSP, 16, regRule{kind: ruleOffset, offset: -16}},
+		{"body", 0x1010, x86RegBP, 16, regRule{kind: ruleOffset, offset: -16}},
+		{"after pop", 0x1024, x86RegSP, 8, regRule{kind: ruleOffset, offset: -16}},
+		{"restored state", 0x1025, x86RegBP, 16, regRule{kind: ruleOffset, offset: -16}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row, err := table.rowFor(tt.pc)
+			if err != nil {
+				t.Fatalf("rowFor: %v", err)
+			}
+			if row.cfaReg != tt.cfaReg || row.cfaOffset != tt.cfaOffset {
+				t.Fatalf("unexpected CFA: reg %d offset %d", row.cfaReg, row.cfaOffset)
+			}
+			if got := row.rule(x86RegRA); got != (regRule{kind: ruleOffset, offset: -8}) {
+				t.Fatalf("unexpected return address rule: %+v", got)
+			}
+			if got := row.rule(x86RegBP); got != tt.bp {
+				t.Fatalf("unexpected frame pointer rule: %+v", got)
+			}
+		})
+	}
+
+	if _, err := table.rowFor(0x1040); err == nil {
+		t.Fatal("expected error for pc without FDE")
+	}
+}
+
+func TestCfiReader_LEB128(t *testing.T) {
+	r := &cfiReader{b: []byte{0xe5, 0x8e, 0x26, 0x7f, 0x80, 0x7f}, order: binary.LittleEndian}
+	if v := r.uleb(); v != 624485 {
+		t.Fatalf("uleb: got %d", v)
+	}
+	if v := r.sleb(); v != -1 {
+		t.Fatalf("sleb: got %d", v)
+	}
+	if v := r.sleb(); v != -128 {
+		t.Fatalf("sleb: got %d", v)
+	}
+	if r.uleb(); r.err == nil {
+		t.Fatal("expected error reading past the end")
+	}
+}
+
+// glibc is built without frame pointers, which is what the call frame information is needed for
+func TestLoadFrameTable_Libc(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("call frame information is only checked on amd64")
+	}
+	ef, err := elf.Open("/lib/x86_64-linux-gnu/libc.so.6")
+	if err != nil {
+		t.Skipf("libc not found: %v", err)
+	}
+	defer ef.Close()
+
+	table, err := loadFrameTable(ef)
+	if err != nil {
+		t.Fatalf("loadFrameTable: %v", err)
+	}
+	syms, err := ef.DynamicSymbols()
+	if err != nil {
+		t.Fatalf("DynamicSymbols: %v", err)
+	}
+	var malloc uint64
+	for _, s := range syms {
+		if s.Name == "malloc" {
+			malloc = s.Value
+		}
+	}
+	if malloc == 0 {
+		t.Skip("malloc not found in libc")
+	}
+
+	row, err := table.rowFor(malloc)
+	if err != nil {
+		t.Fatalf("rowFor: %v", err)
+	}
+	if row.cfaReg != x86RegSP || row.cfaOffset != 8 {
+		t.Fatalf("expected CFA=rsp+8 on function entry, got reg %d offset %d", row.cfaReg, row.cfaOffset)
+	}
+	if got := row.rule(x86RegRA); got != (regRule{kind: ruleOffset, offset: -8}) {
+		t.Fatalf("unexpected return address rule: %+v", got)
+	}
+}
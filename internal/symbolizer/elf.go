@@ -1,6 +1,7 @@
 package symbolizer
 
 import (
+	"cmp"
 	"debug/dwarf"
 	"debug/elf"
 	"debug/gosym"
@@ -8,76 +9,114 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
 // use this interface to resolve symbols from ELF files
 type SymbolResolver interface {
-	ResolvePC(path string, pc uint64, slide uint64) (*Symbol, error)
+	// resolves pc, a runtime address in the mapping region of pid, to the function it is in and the functions
+	// inlined into it there, innermost first. For return addresses, pc should be the address of the call, i.e. one less.
+	ResolvePC(pid int, region *MapRegion, pc uint64) ([]Symbol, error)
 }
 
 type SymbolLoader interface {
-	LoadFrom(path string) (internalSymbolResolver, error)
+	// loads the symbols of path, as mapped by pid
+	LoadFrom(pid int, path string) (*loadedBinary, error)
 }
 
-// The standard SymbolResolver implementation that decorates concrete resolvers that rely on different symbols, and adds caching
+// the symbols of an ELF file, with its loadable segments to find the load bias of the regions it is mapped in
+type loadedBinary struct {
+	resolver internalSymbolResolver
+	loads    elfLoads
+}
+
+// The standard SymbolResolver implementation that decorates concrete resolvers that rely on different symbols, and adds caching.
+// The binaries are shared by all processes that map them, and dropped by evictUnused once they are no longer used.
 type CachingSymbolResolver struct {
-	// TODO: we lazy load and cache symbols without any LRU eviction - we should add it in the future
-	cache        map[string]internalSymbolResolver
+	cache        map[mappedFile]*cachedBinary
 	symbolLoader SymbolLoader
 	mu           sync.RWMutex
-	pid          int
 }
 
+type cachedBinary struct {
+	*loadedBinary
+	usedAt time.Time
+}
+
+// resolves symbols by the addresses the linker assigned: pc minus the load bias of its mapping
 type internalSymbolResolver interface {
-	ResolvePC(pc uint64, slide uint64) (*Symbol, error)
+	ResolvePC(pc uint64, bias uint64) ([]Symbol, error)
 }
 
-func NewCachingSymbolResolver(pid int, symbolLoader SymbolLoader) *CachingSymbolResolver {
-	return &CachingSymbolResolver{pid: pid, symbolLoader: symbolLoader, cache: make(map[string]internalSymbolResolver)}
+func NewCachingSymbolResolver(symbolLoader SymbolLoader) *CachingSymbolResolver {
+	return &CachingSymbolResolver{symbolLoader: symbolLoader, cache: make(map[mappedFile]*cachedBinary)}
 }
 
-func (c *CachingSymbolResolver) ResolvePC(path string, pc uint64, slide uint64) (*Symbol, error) {
+func (c *CachingSymbolResolver) ResolvePC(pid int, region *MapRegion, pc uint64) ([]Symbol, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if resolver, ok := c.cache[path]; ok {
-		return resolver.ResolvePC(pc, slide)
+	file := mappedFile{path: region.Path, dev: region.Dev, inode: region.Inode}
+	cached, ok := c.cache[file]
+	if !ok {
+		loaded, err := c.symbolLoader.LoadFrom(pid, region.Path)
+		if err != nil {
+			return nil, err
+		}
+		cached = &cachedBinary{loadedBinary: loaded}
+		c.cache[file] = cached
 	}
-	resolver, err := c.symbolLoader.LoadFrom(path)
+	cached.usedAt = time.Now()
+	bias, err := cached.loads.loadBias(region, pc)
 	if err != nil {
 		return nil, err
 	}
-	c.cache[path] = resolver
-	return resolver.ResolvePC(pc, slide)
+	return cached.resolver.ResolvePC(pc, bias)
+}
+
+// drops the binaries nothing was resolved in for unused
+func (c *CachingSymbolResolver) evictUnused(unused time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for file, cached := range c.cache {
+		if time.Since(cached.usedAt) >= unused {
+			delete(c.cache, file)
+		}
+	}
 }
 
 type elfSymbolResolover struct {
-	elfSymbols []elf.Symbol
+	funcs []elf.Symbol // the function symbols, by address
 }
 
 func newElfSymbolResolver(elfSymbols []elf.Symbol) *elfSymbolResolover {
-	return &elfSymbolResolover{elfSymbols: elfSymbols}
+	var funcs []elf.Symbol
+	for _, s := range elfSymbols {
+		// undefined symbols have no address, and objects or section and file symbols aren't code
+		if typ := elf.ST_TYPE(s.Info); s.Value != 0 && (typ == elf.STT_FUNC || typ == elf.STT_GNU_IFUNC) {
+			funcs = append(funcs, s)
+		}
+	}
+	slices.SortFunc(funcs, func(a, b elf.Symbol) int { return cmp.Compare(a.Value, b.Value) })
+	return &elfSymbolResolover{funcs: funcs}
 }
 
-func (e *elfSymbolResolover) ResolvePC(pc uint64, slide uint64) (*Symbol, error) {
-	slog.Debug("Resolving PC from ELF symbols", "pc", pc, "slide", slide)
-	target := pc - slide
-	var best *elf.Symbol
-	for _, s := range e.elfSymbols {
-		if s.Value == 0 {
-			continue
-		}
-		if s.Value <= target {
-			if best == nil || s.Value > best.Value {
-				best = &s
-			}
-		}
+func (e *elfSymbolResolover) ResolvePC(pc uint64, bias uint64) ([]Symbol, error) {
+	slog.Debug("Resolving PC from ELF symbols", "pc", pc, "bias", bias)
+	target := pc - bias
+	// the last function starting at or before target
+	i, _ := slices.BinarySearchFunc(e.funcs, target+1, func(s elf.Symbol, t uint64) int { return cmp.Compare(s.Value, t) })
+	if i == 0 {
+		return nil, errors.New("no matching symbol")
 	}
-	if best == nil {
+	best := e.funcs[i-1]
+	// past the end of the function, e.g. in padding or code without a symbol, which gets a placeholder instead
+	if best.Size > 0 && target >= best.Value+best.Size {
 		return nil, errors.New("no matching symbol")
 	}
-	return &Symbol{Name: best.Name, Addr: pc, Offset: target - best.Value}, nil
+	return []Symbol{{Name: best.Name, Addr: pc, Offset: target - best.Value}}, nil
 }
 
 type dwarfSymbolResolver struct {
@@ -88,11 +127,12 @@ func newDwarfSymbolResolver(dwarfData *dwarf.Data) *dwarfSymbolResolver {
 	return &dwarfSymbolResolver{dwarfData: dwarfData}
 }
 
-func (d *dwarfSymbolResolver) ResolvePC(pc uint64, slide uint64) (*Symbol, error) {
-	slog.Debug("Resolving PC from DWARF data", "pc", pc, "slide", slide)
-	target := pc - slide
+func (d *dwarfSymbolResolver) ResolvePC(pc uint64, bias uint64) ([]Symbol, error) {
+	slog.Debug("Resolving PC from DWARF data", "pc", pc, "bias", bias)
+	target := pc - bias
 
 	rdr := d.dwarfData.Reader()
+	var cu *dwarf.Entry // the compilation unit the entries are in, with the line table
 	for {
 		ent, err := rdr.Next()
 		if err != nil {
@@ -101,69 +141,160 @@ func (d *dwarfSymbolResolver) ResolvePC(pc uint64, slide uint64) (*Symbol, error
 		if ent == nil {
 			break
 		}
-		if ent.Tag != dwarf.TagSubprogram {
+		if ent.Tag == dwarf.TagCompileUnit {
+			cu = ent
+		}
+		if ent.Tag != dwarf.TagSubprogram || !d.contains(ent, target) {
 			continue
 		}
 
-		// Prefer explicit ranges API (handles DWARF v5 rnglists and v2/v4 ranges)
-		inRange := false
-		if ranges, err := d.dwarfData.Ranges(ent); err == nil && len(ranges) > 0 {
-			for _, r := range ranges {
-				if target >= r[0] && target < r[1] {
-					inRange = true
-					break
-				}
-			}
-		} else {
-			// Fallback to lowpc/highpc if present
-			lowpcVal := ent.Val(dwarf.AttrLowpc)
-			highpcVal := ent.Val(dwarf.AttrHighpc)
-			var lowpc, highpc uint64
-			if v, ok := lowpcVal.(uint64); ok {
-				lowpc = v
+		chain := []*dwarf.Entry{ent}
+		if ent.Children {
+			if chain, err = d.inlinedChain(rdr, target, chain); err != nil {
+				return nil, err
 			}
-			switch v := highpcVal.(type) {
-			case uint64:
-				highpc = v
-			case int64:
-				if lowpc != 0 && v > 0 {
-					highpc = lowpc + uint64(v)
-				}
-			}
-			if lowpc != 0 && highpc != 0 && target >= lowpc && target < highpc {
-				inRange = true
+		}
+		return d.symbols(cu, chain, pc, target)
+	}
+	return nil, errors.New("pc not found in DWARF")
+}
+
+// whether the code of a subprogram, inlined subroutine or lexical block covers pc
+func (d *dwarfSymbolResolver) contains(ent *dwarf.Entry, pc uint64) bool {
+	// Prefer explicit ranges API (handles DWARF v5 rnglists and v2/v4 ranges)
+	if ranges, err := d.dwarfData.Ranges(ent); err == nil && len(ranges) > 0 {
+		for _, r := range ranges {
+			if pc >= r[0] && pc < r[1] {
+				return true
 			}
 		}
-		if !inRange {
-			continue
+		return false
+	}
+	// Fallback to lowpc/highpc if present
+	lowpc, _ := ent.Val(dwarf.AttrLowpc).(uint64)
+	var highpc uint64
+	switch v := ent.Val(dwarf.AttrHighpc).(type) {
+	case uint64:
+		highpc = v
+	case int64:
+		if lowpc != 0 && v > 0 {
+			highpc = lowpc + uint64(v)
 		}
+	}
+	return lowpc != 0 && highpc != 0 && pc >= lowpc && pc < highpc
+}
 
-		name := ""
-		if v := ent.Val(dwarf.AttrLinkageName); v != nil {
-			if s, ok := v.(string); ok && s != "" {
-				name = s
+// appends the inlined subroutines that pc is in to chain, outermost first, reading the children of the last entry of
+// chain from rdr. Inlined subroutines nest, also inside lexical blocks, so only the children of the entries covering
+// pc have to be looked at.
+func (d *dwarfSymbolResolver) inlinedChain(rdr *dwarf.Reader, pc uint64, chain []*dwarf.Entry) ([]*dwarf.Entry, error) {
+	for depth := 1; depth > 0; {
+		ent, err := rdr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if ent == nil {
+			break
+		}
+		if ent.Tag == 0 {
+			depth-- // the end of a list of children
+			continue
+		}
+		if (ent.Tag == dwarf.TagInlinedSubroutine || ent.Tag == dwarf.TagLexDwarfBlock) && d.contains(ent, pc) {
+			if ent.Tag == dwarf.TagInlinedSubroutine {
+				chain = append(chain, ent)
 			}
+			if ent.Children {
+				depth++
+			}
+			continue
+		}
+		if ent.Children {
+			rdr.SkipChildren()
 		}
+	}
+	return chain, nil
+}
+
+// the frames of the chain of a subprogram and the subroutines inlined into it, innermost first. The line of the
+// innermost frame is where pc is, the lines of the others are where they call the next frame.
+func (d *dwarfSymbolResolver) symbols(cu *dwarf.Entry, chain []*dwarf.Entry, pc, target uint64) ([]Symbol, error) {
+	var lr *dwarf.LineReader
+	if cu != nil {
+		lr, _ = d.dwarfData.LineReader(cu)
+	}
+	file, line := lineFor(lr, target)
+
+	syms := make([]Symbol, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		ent := chain[i]
+		name, startLine := d.declaration(ent)
 		if name == "" {
-			if v := ent.Val(dwarf.AttrName); v != nil {
-				if s, ok := v.(string); ok {
-					name = s
-				}
-			}
+			return nil, errors.New("dwarf subprogram without name")
 		}
 		// Compute offset from entry if we have lowpc. Otherwise set 0
 		var offset uint64
-		if v := ent.Val(dwarf.AttrLowpc); v != nil {
-			if low, ok := v.(uint64); ok && target >= low {
-				offset = target - low
-			}
+		if low, ok := ent.Val(dwarf.AttrLowpc).(uint64); ok && target >= low {
+			offset = target - low
 		}
+		syms = append(syms, Symbol{Name: name, Addr: pc, Offset: offset, File: file, Line: line, StartLine: startLine, Inlined: i > 0})
+		file, line = callSite(lr, ent)
+	}
+	return syms, nil
+}
+
+// the name and declaration line of a subprogram or inlined subroutine. Inlined subroutines, and the out-of-line
+// copies of inlined functions, only refer to the abstract instance they were made from (AttrAbstractOrigin), and C++
+// member functions to their declaration (AttrSpecification).
+func (d *dwarfSymbolResolver) declaration(ent *dwarf.Entry) (name string, line int) {
+	for i := 0; i < 4 && ent != nil; i++ { // origins don't chain deeply, but a malformed binary mustn't loop forever
 		if name == "" {
-			return nil, errors.New("dwarf subprogram without name")
+			name, _ = ent.Val(dwarf.AttrLinkageName).(string)
+		}
+		if name == "" {
+			name, _ = ent.Val(dwarf.AttrName).(string)
 		}
-		return &Symbol{Name: name, Addr: pc, Offset: offset}, nil
+		if v, ok := ent.Val(dwarf.AttrDeclLine).(int64); ok && line == 0 {
+			line = int(v)
+		}
+		if name != "" && line != 0 {
+			break
+		}
+		origin, ok := ent.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		if !ok {
+			if origin, ok = ent.Val(dwarf.AttrSpecification).(dwarf.Offset); !ok {
+				break
+			}
+		}
+		rdr := d.dwarfData.Reader()
+		rdr.Seek(origin)
+		ent, _ = rdr.Next()
 	}
-	return nil, errors.New("pc not found in DWARF")
+	return name, line
+}
+
+// the source position of pc in the line table of its compilation unit; empty if it has none
+func lineFor(lr *dwarf.LineReader, pc uint64) (string, int) {
+	if lr == nil {
+		return "", 0
+	}
+	var entry dwarf.LineEntry
+	if err := lr.SeekPC(pc, &entry); err != nil || entry.File == nil {
+		return "", 0
+	}
+	return entry.File.Name, entry.Line
+}
+
+// where an inlined subroutine was inlined; empty for subprograms
+func callSite(lr *dwarf.LineReader, ent *dwarf.Entry) (string, int) {
+	line, _ := ent.Val(dwarf.AttrCallLine).(int64)
+	var file string
+	if idx, ok := ent.Val(dwarf.AttrCallFile).(int64); ok && lr != nil {
+		if files := lr.Files(); idx >= 0 && int(idx) < len(files) && files[idx] != nil {
+			file = files[idx].Name
+		}
+	}
+	return file, int(line)
 }
 
 type goSymbolResolver struct {
@@ -174,10 +305,11 @@ func newGoSymbolResolver(goSymTab *gosym.Table) *goSymbolResolver {
 	return &goSymbolResolver{goSymTab: goSymTab}
 }
 
-func (g *goSymbolResolver) ResolvePC(pc uint64, slide uint64) (*Symbol, error) {
-	slog.Debug("Resolving PC from Go symbol table", "pc", pc, "slide", slide)
+// gosym doesn't expose the inlining tree of .gopclntab, so Go frames come without the functions inlined into them
+func (g *goSymbolResolver) ResolvePC(pc uint64, bias uint64) ([]Symbol, error) {
+	slog.Debug("Resolving PC from Go symbol table", "pc", pc, "bias", bias)
 
-	target := pc - slide
+	target := pc - bias
 	fn := g.goSymTab.PCToFunc(target)
 	if fn == nil {
 		return nil, errors.New("pc not found in gopclntab")
@@ -187,54 +319,165 @@ func (g *goSymbolResolver) ResolvePC(pc uint64, slide uint64) (*Symbol, error) {
 	if target >= fn.Entry {
 		offset = target - fn.Entry
 	}
-	return &Symbol{Name: fn.Name, Addr: pc, Offset: offset}, nil
+	file, line, _ := g.goSymTab.PCToLine(target)
+	// the entry is attributed to the line of the func keyword
+	_, startLine, _ := g.goSymTab.PCToLine(fn.Entry)
+	return []Symbol{{Name: fn.Name, Addr: pc, Offset: offset, File: file, Line: line, StartLine: startLine}}, nil
 }
 
-type CascadingSymbolLoader struct {
-	pid int
-}
+type CascadingSymbolLoader struct{}
 
-func NewCascadingSymbolLoader(pid int) *CascadingSymbolLoader {
-	return &CascadingSymbolLoader{pid: pid}
+func NewCascadingSymbolLoader() *CascadingSymbolLoader {
+	return &CascadingSymbolLoader{}
 }
 
-func (c *CascadingSymbolLoader) LoadFrom(path string) (internalSymbolResolver, error) {
-	ef, err := openELF(c.pid, path)
+func (c *CascadingSymbolLoader) LoadFrom(pid int, path string) (*loadedBinary, error) {
+	ef, err := openELF(pid, path)
 	if err != nil {
 		return nil, err
 	}
 	defer ef.Close()
 
-	pcln := ef.Section(".gopclntab")
-	if pcln != nil {
-		slog.Debug("Found .gopclntab section, will use GoSymbolResolver", "path", path)
-		goSymTab, err := readGoSymbolTable(ef, pcln)
-		if err != nil {
-			slog.Warn("Failed to read Go symbol table despite having .gopclntab section, will fall back from GoSymbolResolver", "path", path, "error", err)
-		} else {
-			return newGoSymbolResolver(goSymTab), nil
-		}
+	resolver, err := loadSymbolResolver(ef, path)
+	if err != nil {
+		return nil, err
+	}
+	return &loadedBinary{resolver: resolver, loads: readELFLoads(ef)}, nil
+}
 
-		slog.Debug("Could not use .gopclntab section or not found, will try to use DWARF symbols if available", "path", path)
-		dwarfData, err := ef.DWARF()
-		if err == nil {
-			slog.Debug("Found DWARF data, will use DwarfSymbolResolver", "path", path)
-			return newDwarfSymbolResolver(dwarfData), nil
-		}
+// where the symbols of a binary come from, in the order they are tried
+type SymbolSource int
+
+const (
+	SourceNone       SymbolSource = iota // not resolved from a symbol table, e.g. placeholders and kernel frames
+	SourceGoPclntab                      // .gopclntab, only covering the Go code of a binary
+	SourceDWARF                          // .debug_info, which may only cover some compilation units
+	SourceELFSymbols                     // .symtab and .dynsym; with only .dynsym, static functions are attributed to the exported one before them
+)
 
-		slog.Debug("Could not use .gopclntab section or not found, and DWARF data not available, will try to use ELF symbols", "path", path)
-		elfSymbols, err := readElfSymbols(ef)
+func (s SymbolSource) String() string {
+	switch s {
+	case SourceNone:
+		return "none"
+	case SourceGoPclntab:
+		return ".gopclntab"
+	case SourceDWARF:
+		return "DWARF"
+	case SourceELFSymbols:
+		return ".symtab/.dynsym"
+	default:
+		return fmt.Sprintf("SymbolSource(%d)", int(s))
+	}
+}
+
+// the symbol sources the binary has, in the order they are tried
+func (b BinarySymbols) Sources() []SymbolSource {
+	var sources []SymbolSource
+	if b.GoPclntab {
+		sources = append(sources, SourceGoPclntab)
+	}
+	if b.DWARF {
+		sources = append(sources, SourceDWARF)
+	}
+	if b.Symtab || b.Dynsym {
+		sources = append(sources, SourceELFSymbols)
+	}
+	return sources
+}
+
+// tries the symbol sources of a binary in turn, so that e.g. the C code of a cgo binary, which .gopclntab doesn't
+// cover, is still resolved from .symtab
+type cascadingSymbolResolver struct {
+	sources   []SymbolSource
+	resolvers []internalSymbolResolver
+}
+
+func (c *cascadingSymbolResolver) add(source SymbolSource, resolver internalSymbolResolver) {
+	c.sources = append(c.sources, source)
+	c.resolvers = append(c.resolvers, resolver)
+}
+
+func (c *cascadingSymbolResolver) ResolvePC(pc uint64, bias uint64) ([]Symbol, error) {
+	var errs []error
+	for i, r := range c.resolvers {
+		syms, err := r.ResolvePC(pc, bias)
 		if err == nil {
-			slog.Debug("Found ELF symbols, will use ElfSymbolResolver", "path", path)
-			return newElfSymbolResolver(elfSymbols), nil
+			for j := range syms {
+				syms[j].Source = c.sources[i]
+			}
+			return syms, nil
 		}
+		errs = append(errs, fmt.Errorf("%v: %w", c.sources[i], err))
+	}
+	return nil, errors.Join(errs...)
+}
 
-		slog.Debug("Could not use .gopclntab section or not found, and DWARF data not available, and ELF symbols not available, will return error", "path", path)
+// reads every symbol source the binary has; sources that turn out to be unreadable are skipped
+func loadSymbolResolver(ef *elf.File, path string) (*cascadingSymbolResolver, error) {
+	resolver := &cascadingSymbolResolver{}
+	for _, source := range inspectELF(ef).Sources() {
+		switch source {
+		case SourceGoPclntab:
+			goSymTab, err := readGoSymbolTable(ef, ef.Section(".gopclntab"))
+			if err != nil {
+				slog.Warn("Failed to read Go symbol table despite having .gopclntab section", "path", path, "error", err)
+				continue
+			}
+			resolver.add(source, newGoSymbolResolver(goSymTab))
+		case SourceDWARF:
+			dwarfData, err := ef.DWARF()
+			if err != nil {
+				slog.Warn("Failed to read DWARF data", "path", path, "error", err)
+				continue
+			}
+			resolver.add(source, newDwarfSymbolResolver(dwarfData))
+		case SourceELFSymbols:
+			elfSymbols, err := readElfSymbols(ef)
+			if err != nil {
+				slog.Warn("Failed to read ELF symbols", "path", path, "error", err)
+				continue
+			}
+			resolver.add(source, newElfSymbolResolver(elfSymbols))
+		}
+	}
+	if len(resolver.resolvers) == 0 {
 		return nil, errors.New("no symbol data available")
 	}
-	return nil, errors.New("no symbol data available")
+	// tells why the frames of a binary resolve poorly, e.g. a library with only .dynsym
+	slog.Debug("Loaded symbols", "path", path, "sources", resolver.sources)
+	return resolver, nil
+}
+
+// which symbol tables a binary has, to tell up front how well its frames can be symbolized
+type BinarySymbols struct {
+	GoPclntab bool // .gopclntab, which Go binaries keep even when stripped
+	DWARF     bool // .debug_info, e.g. from a build with -g
+	Symtab    bool // .symtab, which strip removes
+	Dynsym    bool // .dynsym, only the exported symbols
+}
+
+// inspects the binary at path, mapped by pid, the way the symbolizer would open it
+func InspectBinary(pid int, path string) (BinarySymbols, error) {
+	ef, err := openELF(pid, path)
+	if err != nil {
+		return BinarySymbols{}, err
+	}
+	defer ef.Close()
+	return inspectELF(ef), nil
+}
+
+func inspectELF(ef *elf.File) BinarySymbols {
+	return BinarySymbols{
+		GoPclntab: ef.Section(".gopclntab") != nil,
+		DWARF:     ef.Section(".debug_info") != nil || ef.Section(".zdebug_info") != nil,
+		Symtab:    ef.Section(".symtab") != nil,
+		Dynsym:    ef.Section(".dynsym") != nil,
+	}
 }
 
+// opens the binary mapped by pid at path. Paths in /proc/<pid>/maps are in the mount namespace of the process, so in
+// containers they are opened through its root; the host path is only tried if that fails, e.g. for a process that
+// exited.
 func openELF(pid int, path string) (*elf.File, error) {
 	if path == "" || path == "[vdso]" || path == "[vsyscall]" || strings.HasPrefix(path, "[") {
 		exe := fmt.Sprintf("/proc/%d/exe", pid)
@@ -245,6 +488,13 @@ func openELF(pid int, path string) (*elf.File, error) {
 			path = exe
 		}
 	}
+	if strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "/proc/") {
+		ef, err := elf.Open(fmt.Sprintf("/proc/%d/root%s", pid, path))
+		if err == nil {
+			return ef, nil
+		}
+		slog.Debug("Failed to open binary in the root of the process, trying the host path", "pid", pid, "path", path, "error", err)
+	}
 	ef, err := elf.Open(path)
 	if err != nil {
 		return nil, err
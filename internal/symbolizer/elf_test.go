@@ -1,7 +1,13 @@
 package symbolizer
 
 import (
+	"debug/elf"
 	"errors"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -11,43 +17,56 @@ type mockInternalResolver struct {
 	mu        sync.Mutex
 	calls     int
 	lastPC    uint64
-	lastSlide uint64
+	lastBias  uint64
 	retSymbol *Symbol
 	retErr    error
 }
 
-func (m *mockInternalResolver) ResolvePC(pc uint64, slide uint64) (*Symbol, error) {
+func (m *mockInternalResolver) ResolvePC(pc uint64, bias uint64) ([]Symbol, error) {
 	m.mu.Lock()
 	m.calls++
 	m.lastPC = pc
-	m.lastSlide = slide
+	m.lastBias = bias
 	retSym := m.retSymbol
 	retErr := m.retErr
 	m.mu.Unlock()
-	return retSym, retErr
+	if retSym == nil {
+		return nil, retErr
+	}
+	return []Symbol{*retSym}, retErr
 }
 
 type mockSymbolLoader struct {
 	mu        sync.Mutex
 	calls     int
+	pids      []int // the pids the files were loaded for
 	resolvers map[string]internalSymbolResolver
+	loads     elfLoads // by default, the whole file is laid out at address 0
 	err       error
 	delay     time.Duration
 }
 
-func (m *mockSymbolLoader) LoadFrom(path string) (internalSymbolResolver, error) {
+func (m *mockSymbolLoader) LoadFrom(pid int, path string) (*loadedBinary, error) {
 	if m.delay > 0 {
 		time.Sleep(m.delay)
 	}
 	m.mu.Lock()
 	m.calls++
+	m.pids = append(m.pids, pid)
 	res := m.resolvers[path]
 	err := m.err
 	m.mu.Unlock()
-	if res == nil && err == nil {
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
 		return nil, errors.New("no resolver for path")
 	}
-	return res, err
+	loads := m.loads
+	if loads == nil {
+		loads = elfLoads{{Off: 0, Vaddr: 0, Filesz: math.MaxUint64}}
+	}
+	return &loadedBinary{resolver: res, loads: loads}, nil
 }
 
 func (m *mockSymbolLoader) Calls() int {
@@ -65,22 +84,22 @@ func TestCachingSymbolResolver_CachesResolver(t *testing.T) {
 	r := &mockInternalResolver{retSymbol: &Symbol{Name: "foo", Offset: 0x5}}
 	loader.resolvers["/bin/test"] = r
 
-	c := NewCachingSymbolResolver(123, loader)
+	c := NewCachingSymbolResolver(loader)
 	c.symbolLoader = loader
 
-	sym, err := c.ResolvePC("/bin/test", 0x1010, 0)
+	syms, err := c.ResolvePC(1, &MapRegion{Path: "/bin/test"}, 0x1010)
 	if err != nil {
 		t.Fatalf("unexpected error on first ResolvePC: %v", err)
 	}
-	if sym == nil || sym.Name != "foo" {
-		t.Fatalf("unexpected symbol from first ResolvePC: %+v", sym)
+	if len(syms) != 1 || syms[0].Name != "foo" {
+		t.Fatalf("unexpected symbols from first ResolvePC: %+v", syms)
 	}
 
 	if loader.Calls() != 1 {
 		t.Fatalf("loader called %d times after first resolve; want 1", loader.Calls())
 	}
 
-	_, err = c.ResolvePC("/bin/test", 0x1020, 0)
+	_, err = c.ResolvePC(1, &MapRegion{Path: "/bin/test"}, 0x1020)
 	if err != nil {
 		t.Fatalf("unexpected error on second ResolvePC: %v", err)
 	}
@@ -96,15 +115,15 @@ func TestCachingSymbolResolver_LoaderErrorNotCached(t *testing.T) {
 		err:       errors.New("open failed"),
 	}
 
-	c := NewCachingSymbolResolver(1, loader)
+	c := NewCachingSymbolResolver(loader)
 	c.symbolLoader = loader
 
-	_, err := c.ResolvePC("/bad", 0x0, 0)
+	_, err := c.ResolvePC(1, &MapRegion{Path: "/bad"}, 0x0)
 	if err == nil {
 		t.Fatalf("expected error from loader")
 	}
 
-	_, err = c.ResolvePC("/bad", 0x0, 0)
+	_, err = c.ResolvePC(1, &MapRegion{Path: "/bad"}, 0x0)
 	if err == nil {
 		t.Fatalf("expected error on second call as well")
 	}
@@ -121,63 +140,121 @@ func TestCachingSymbolResolver_DifferentPathsIndependent(t *testing.T) {
 	loader.resolvers["/bin/A"] = resA
 	loader.resolvers["/bin/B"] = resB
 
-	c := NewCachingSymbolResolver(1, loader)
+	c := NewCachingSymbolResolver(loader)
 	c.symbolLoader = loader
 
-	sa, err := c.ResolvePC("/bin/A", 0x2000, 0)
+	sa, err := c.ResolvePC(1, &MapRegion{Path: "/bin/A"}, 0x2000)
 	if err != nil {
 		t.Fatalf("unexpected error resolving A: %v", err)
 	}
-	if sa.Name != "A" {
-		t.Fatalf("expected A, got %v", sa.Name)
+	if len(sa) != 1 || sa[0].Name != "A" {
+		t.Fatalf("expected A, got %+v", sa)
 	}
 
-	sb, err := c.ResolvePC("/bin/B", 0x3000, 0)
+	sb, err := c.ResolvePC(1, &MapRegion{Path: "/bin/B"}, 0x3000)
 	if err != nil {
 		t.Fatalf("unexpected error resolving B: %v", err)
 	}
-	if sb.Name != "B" {
-		t.Fatalf("expected B, got %v", sb.Name)
+	if len(sb) != 1 || sb[0].Name != "B" {
+		t.Fatalf("expected B, got %+v", sb)
 	}
 
 	if loader.Calls() != 2 {
 		t.Fatalf("expected loader called 2 times, got %d", loader.Calls())
 	}
 
-	_, _ = c.ResolvePC("/bin/A", 0x2001, 0)
-	_, _ = c.ResolvePC("/bin/B", 0x3001, 0)
+	_, _ = c.ResolvePC(1, &MapRegion{Path: "/bin/A"}, 0x2001)
+	_, _ = c.ResolvePC(1, &MapRegion{Path: "/bin/B"}, 0x3001)
 	if loader.Calls() != 2 {
 		t.Fatalf("expected loader still called 2 times after cached resolves, got %d", loader.Calls())
 	}
 }
 
-func TestCachingSymbolResolver_ResolverReceivesPCAndSlide(t *testing.T) {
+// processes share the binaries they map, but processes in different containers can map different files at the same path
+func TestCachingSymbolResolver_SharedByFile(t *testing.T) {
+	loader := &mockSymbolLoader{resolvers: map[string]internalSymbolResolver{
+		"/bin/app": &mockInternalResolver{retSymbol: &Symbol{Name: "main"}},
+	}}
+	c := NewCachingSymbolResolver(loader)
+
+	for _, pid := range []int{1, 2, 3} {
+		inode := uint64(100)
+		if pid == 3 {
+			inode = 200
+		}
+		region := &MapRegion{Start: 0x1000, End: 0x2000, Dev: "00:2f", Inode: inode, Path: "/bin/app"}
+		if _, err := c.ResolvePC(pid, region, 0x1010); err != nil {
+			t.Fatalf("ResolvePC(%d): %v", pid, err)
+		}
+	}
+	loader.mu.Lock()
+	defer loader.mu.Unlock()
+	if want := []int{1, 3}; !slices.Equal(loader.pids, want) {
+		t.Fatalf("expected the binaries to be loaded by pids %v, got %v", want, loader.pids)
+	}
+}
+
+func TestCachingSymbolResolver_EvictsUnused(t *testing.T) {
+	loader := &mockSymbolLoader{resolvers: map[string]internalSymbolResolver{
+		"/bin/app": &mockInternalResolver{retSymbol: &Symbol{Name: "main"}},
+	}}
+	c := NewCachingSymbolResolver(loader)
+	region := &MapRegion{Path: "/bin/app"}
+
+	if _, err := c.ResolvePC(1, region, 0x1010); err != nil {
+		t.Fatalf("ResolvePC: %v", err)
+	}
+	c.evictUnused(time.Hour)
+	if _, err := c.ResolvePC(1, region, 0x1010); err != nil {
+		t.Fatalf("ResolvePC: %v", err)
+	}
+	if loader.Calls() != 1 {
+		t.Fatalf("expected a recently used binary to be kept, got %d loads", loader.Calls())
+	}
+
+	c.evictUnused(0)
+	if _, err := c.ResolvePC(1, region, 0x1010); err != nil {
+		t.Fatalf("ResolvePC: %v", err)
+	}
+	if loader.Calls() != 2 {
+		t.Fatalf("expected the evicted binary to be loaded again, got %d loads", loader.Calls())
+	}
+}
+
+func TestCachingSymbolResolver_ResolverReceivesPCAndBias(t *testing.T) {
 	loader := &mockSymbolLoader{
 		resolvers: map[string]internalSymbolResolver{},
+		// a PIE executable, linked at 0
+		loads: elfLoads{{Off: 0, Vaddr: 0, Filesz: 0x1000}, {Off: 0x1000, Vaddr: 0x1000, Filesz: 0x5000}},
 	}
 	mockRes := &mockInternalResolver{retSymbol: &Symbol{Name: "Z"}}
 	loader.resolvers["/bin/z"] = mockRes
 
-	c := NewCachingSymbolResolver(1, loader)
+	c := NewCachingSymbolResolver(loader)
 	c.symbolLoader = loader
 
-	pc := uint64(0xdeadbeef)
-	slide := uint64(0x1000)
-	_, err := c.ResolvePC("/bin/z", pc, slide)
+	pc := uint64(0x55d4b2001234)
+	region := &MapRegion{Start: 0x55d4b2001000, End: 0x55d4b2006000, Offset: 0x1000, Path: "/bin/z"}
+	_, err := c.ResolvePC(1, region, pc)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	mockRes.mu.Lock()
 	gotPC := mockRes.lastPC
-	gotSlide := mockRes.lastSlide
+	gotBias := mockRes.lastBias
 	mockRes.mu.Unlock()
 
 	if gotPC != pc {
 		t.Fatalf("resolver received pc %x; want %x", gotPC, pc)
 	}
-	if gotSlide != slide {
-		t.Fatalf("resolver received slide %x; want %x", gotSlide, slide)
+	if gotBias != 0x55d4b2000000 {
+		t.Fatalf("resolver received bias %x; want %x", gotBias, 0x55d4b2000000)
+	}
+
+	// past the end of what the file has to offer, e.g. in .bss
+	if _, err := c.ResolvePC(1, region, 0x55d4b2006000); err == nil {
+		t.Fatal("expected an error for a pc outside of the loaded segments")
 	}
 }
 
@@ -190,7 +267,7 @@ func TestCachingSymbolResolver_ConcurrentLoadOnlyOnce(t *testing.T) {
 	r := &mockInternalResolver{retSymbol: &Symbol{Name: "concurrent"}}
 	loader.resolvers["/concurrent"] = r
 
-	c := NewCachingSymbolResolver(1, loader)
+	c := NewCachingSymbolResolver(loader)
 	c.symbolLoader = loader
 
 	const goroutines = 10
@@ -202,7 +279,7 @@ func TestCachingSymbolResolver_ConcurrentLoadOnlyOnce(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			<-start
-			_, _ = c.ResolvePC("/concurrent", 0x1000, 0)
+			_, _ = c.ResolvePC(1, &MapRegion{Path: "/concurrent"}, 0x1000)
 		}()
 	}
 
@@ -213,3 +290,217 @@ func TestCachingSymbolResolver_ConcurrentLoadOnlyOnce(t *testing.T) {
 		t.Fatalf("expected loader called once, got %d", loader.Calls())
 	}
 }
+
+func TestInspectBinary(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms, err := InspectBinary(os.Getpid(), exe)
+	if err != nil {
+		t.Fatalf("InspectBinary: %v", err)
+	}
+	// Go binaries keep .gopclntab, even when built without DWARF or stripped
+	if !syms.GoPclntab {
+		t.Fatalf("expected the test binary to have .gopclntab, got %+v", syms)
+	}
+
+	if _, err := InspectBinary(os.Getpid(), "/nonexistent"); err == nil {
+		t.Fatal("expected an error for a missing binary")
+	}
+}
+
+// the root of our own process is the host's, while a process that exited has none left and the host path is used
+func TestOpenELF_ProcessRoot(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range []int{os.Getpid(), math.MaxInt32} {
+		ef, err := openELF(pid, exe)
+		if err != nil {
+			t.Fatalf("openELF(%d): %v", pid, err)
+		}
+		ef.Close()
+	}
+}
+
+func TestCascadingSymbolResolver_FallsBack(t *testing.T) {
+	goRes := &mockInternalResolver{retErr: errors.New("pc not found in gopclntab")}
+	elfRes := &mockInternalResolver{retSymbol: &Symbol{Name: "crosscall2"}}
+	c := &cascadingSymbolResolver{}
+	c.add(SourceGoPclntab, goRes)
+	c.add(SourceELFSymbols, elfRes)
+
+	syms, err := c.ResolvePC(0x1010, 0x1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(syms) != 1 || syms[0].Name != "crosscall2" || goRes.calls != 1 || elfRes.lastPC != 0x1010 || elfRes.lastBias != 0x1000 {
+		t.Fatalf("expected the ELF symbols to resolve the pc, got %+v", syms)
+	}
+	if syms[0].Source != SourceELFSymbols {
+		t.Fatalf("expected the frame to be attributed to the ELF symbols, got %v", syms[0].Source)
+	}
+
+	elfRes.retErr = errors.New("no matching symbol")
+	_, err = c.ResolvePC(0x1010, 0x1000)
+	if err == nil || !strings.Contains(err.Error(), ".gopclntab: pc not found") || !strings.Contains(err.Error(), ".symtab/.dynsym: no matching symbol") {
+		t.Fatalf("expected the errors of every source, got %v", err)
+	}
+}
+
+func TestElfSymbolResolver_ResolvePC(t *testing.T) {
+	fn := elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+	r := newElfSymbolResolver([]elf.Symbol{
+		{Name: "unsized", Info: fn, Value: 0x3000},
+		{Name: "sized", Info: fn, Value: 0x1000, Size: 0x10},
+		{Name: "data", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Value: 0x1008, Size: 0x8},
+		{Name: "ifunc", Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_GNU_IFUNC), Value: 0x2000, Size: 0x20},
+		{Name: "undefined", Info: fn},
+		{Name: "section", Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), Value: 0x2010},
+	})
+
+	tests := []struct {
+		pc     uint64
+		name   string // empty if there is no matching symbol
+		offset uint64
+	}{
+		{0x1000, "sized", 0},
+		{0x100c, "sized", 0xc},
+		{0x1010, "", 0}, // past its end
+		{0x2018, "ifunc", 0x18},
+		{0x3100, "unsized", 0x100},
+		{0x800, "", 0},
+	}
+	for _, tt := range tests {
+		syms, err := r.ResolvePC(tt.pc+0x400000, 0x400000)
+		if tt.name == "" {
+			if err == nil {
+				t.Errorf("%#x: expected no matching symbol, got %+v", tt.pc, syms)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#x: unexpected error: %v", tt.pc, err)
+			continue
+		}
+		if len(syms) != 1 || syms[0].Name != tt.name || syms[0].Offset != tt.offset || syms[0].Addr != tt.pc+0x400000 {
+			t.Errorf("%#x: got %+v, want %s+%#x", tt.pc, syms, tt.name, tt.offset)
+		}
+	}
+}
+
+func TestBinarySymbols_Sources(t *testing.T) {
+	tests := []struct {
+		syms BinarySymbols
+		want []SymbolSource
+	}{
+		{BinarySymbols{GoPclntab: true, DWARF: true, Symtab: true}, []SymbolSource{SourceGoPclntab, SourceDWARF, SourceELFSymbols}},
+		{BinarySymbols{Dynsym: true}, []SymbolSource{SourceELFSymbols}},
+		{BinarySymbols{}, nil},
+	}
+	for _, tt := range tests {
+		if got := tt.syms.Sources(); !slices.Equal(got, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.syms, got, tt.want)
+		}
+	}
+}
+
+// returns where it is in the test binary
+//
+//go:noinline
+func lineTestFunc() (pc uint64, line int) {
+	callerPC, _, line, _ := runtime.Caller(0)
+	return uint64(callerPC), line
+}
+
+func TestGoSymbolResolver_Lines(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps, err := NewProcMaps(NewProcMapsReader(os.Getpid()))
+	if err != nil {
+		t.Fatalf("NewProcMaps: %v", err)
+	}
+	pc, line := lineTestFunc()
+	region := maps.FindRegion(pc)
+	if region == nil || region.Path != exe {
+		t.Fatalf("expected %#x to be mapped from %s, got %+v", pc, exe, region)
+	}
+
+	syms, err := NewCachingSymbolResolver(NewCascadingSymbolLoader()).ResolvePC(os.Getpid(), region, pc)
+	if err != nil || len(syms) != 1 {
+		t.Fatalf("ResolvePC: %+v, %v", syms, err)
+	}
+	sym := syms[0]
+	if !strings.HasSuffix(sym.File, "/elf_test.go") || sym.Line != line || sym.StartLine != line-1 {
+		t.Fatalf("got %s at %s:%d (starting at line %d), want elf_test.go:%d starting at line %d", sym.Name, sym.File, sym.Line, sym.StartLine, line, line-1)
+	}
+}
+
+// see testdata/lines.c
+func TestDwarfSymbolResolver_Lines(t *testing.T) {
+	c := NewCachingSymbolResolver(NewCascadingSymbolLoader())
+	region := &MapRegion{Start: 0x401000, End: 0x402000, Offset: 0x1000, Perms: "r-xp", Path: "testdata/lines.elf"}
+	tests := []struct {
+		pc        uint64
+		name      string
+		line      int
+		startLine int
+	}{
+		{0x401009, "leaf", 9, 6},
+		{0x401024, "_start", 14, 12},
+	}
+	for _, tt := range tests {
+		syms, err := c.ResolvePC(os.Getpid(), region, tt.pc)
+		if err != nil || len(syms) != 1 {
+			t.Fatalf("ResolvePC(%#x): %+v, %v", tt.pc, syms, err)
+		}
+		sym := syms[0]
+		if sym.Name != tt.name || !strings.HasSuffix(sym.File, "lines.c") || sym.Line != tt.line || sym.StartLine != tt.startLine {
+			t.Errorf("%#x: got %s at %s:%d (starting at line %d), want %s at lines.c:%d (starting at line %d)", tt.pc, sym.Name, sym.File, sym.Line, sym.StartLine, tt.name, tt.line, tt.startLine)
+		}
+	}
+}
+
+// see testdata/inline.c
+func TestDwarfSymbolResolver_InlinedFrames(t *testing.T) {
+	c := NewCachingSymbolResolver(NewCascadingSymbolLoader())
+	region := &MapRegion{Start: 0x401000, End: 0x402000, Offset: 0x1000, Perms: "r-xp", Path: "testdata/inline.elf"}
+	type frame struct {
+		name            string
+		line, startLine int
+		inlined         bool
+	}
+	tests := []struct {
+		pc   uint64
+		want []frame
+	}{
+		// sink += i in add, inlined into the loop of accumulate, inlined into work
+		{0x401016, []frame{{"add", 8, 6, true}, {"accumulate", 14, 11, true}, {"work", 19, 17, false}}},
+		// sink = 0 in work itself
+		{0x401025, []frame{{"work", 20, 17, false}}},
+		// the call to record, the last instruction of flush inlined into step
+		{0x401044, []frame{{"flush", 31, 29, true}, {"step", 36, 34, false}}},
+		// the return address of that call is already past flush
+		{0x401045, []frame{{"step", 37, 34, false}}},
+	}
+	for _, tt := range tests {
+		syms, err := c.ResolvePC(os.Getpid(), region, tt.pc)
+		if err != nil {
+			t.Fatalf("ResolvePC(%#x): %v", tt.pc, err)
+		}
+		var got []frame
+		for _, sym := range syms {
+			if sym.Addr != tt.pc || !strings.HasSuffix(sym.File, "inline.c") || sym.Source != SourceDWARF {
+				t.Fatalf("%#x: unexpected address, file or source of %+v", tt.pc, sym)
+			}
+			got = append(got, frame{sym.Name, sym.Line, sym.StartLine, sym.Inlined})
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%#x: got %+v, want %+v", tt.pc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package symbolizer
+
+import (
+	"debug/elf"
+	"fmt"
+)
+
+// a loadable segment: Filesz bytes at Off in the file are mapped at Vaddr
+type elfLoad struct {
+	Off, Vaddr, Filesz uint64
+}
+
+// the PT_LOAD segments of an ELF file, which tell where the linker laid out each part of the file
+type elfLoads []elfLoad
+
+func readELFLoads(ef *elf.File) elfLoads {
+	var loads elfLoads
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_LOAD {
+			loads = append(loads, elfLoad{Off: p.Off, Vaddr: p.Vaddr, Filesz: p.Filesz})
+		}
+	}
+	return loads
+}
+
+// translates an offset into the file to the virtual address it is loaded at, as laid out by the linker
+func (l elfLoads) fileOffsetToVaddr(off uint64) (uint64, bool) {
+	for _, p := range l {
+		if off >= p.Off && off < p.Off+p.Filesz {
+			return off - p.Off + p.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// the load bias of the mapping r that pc is in: what the loader added to the addresses the linker assigned, i.e. what
+// has to be subtracted from pc to look it up in the file's symbols. It is 0 for executables that aren't position
+// independent, and wherever ASLR placed them for PIE executables and shared libraries.
+//
+// The file offset of r alone isn't enough: segments are mapped at page granularity, and the linker is free to lay a
+// segment out at a virtual address that differs from its offset in the file, as it does for the data segments of most
+// shared libraries.
+func (l elfLoads) loadBias(r *MapRegion, pc uint64) (uint64, error) {
+	vaddr, ok := l.fileOffsetToVaddr(pc - r.Start + r.Offset)
+	if !ok {
+		return 0, fmt.Errorf("pc %#x outside of the loaded segments of %s", pc, r.Path)
+	}
+	return pc - vaddr, nil
+}
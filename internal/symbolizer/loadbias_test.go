@@ -0,0 +1,144 @@
+package symbolizer
+
+import (
+	"debug/elf"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// the layouts of the three kinds of binaries, as linked by ld and mapped by the kernel and ld.so
+func TestElfLoads_LoadBias(t *testing.T) {
+	nonPIE := elfLoads{
+		{Off: 0, Vaddr: 0x400000, Filesz: 0x1000},       // headers, .rodata
+		{Off: 0x1000, Vaddr: 0x401000, Filesz: 0x95000}, // .text
+		{Off: 0x96000, Vaddr: 0x497000, Filesz: 0x8000}, // .data
+	}
+	pie := elfLoads{
+		{Off: 0, Vaddr: 0, Filesz: 0x1000},
+		{Off: 0x1000, Vaddr: 0x1000, Filesz: 0x5000},
+		{Off: 0x6dd0, Vaddr: 0x7dd0, Filesz: 0x250},
+	}
+	// libc: the data segment is laid out a page further than its offset in the file
+	sharedLib := elfLoads{
+		{Off: 0, Vaddr: 0, Filesz: 0x28000},
+		{Off: 0x28000, Vaddr: 0x28000, Filesz: 0x195000},
+		{Off: 0x1bd000, Vaddr: 0x1bd000, Filesz: 0x4f000},
+		{Off: 0x20c8f0, Vaddr: 0x20d8f0, Filesz: 0x6710},
+	}
+
+	tests := []struct {
+		name     string
+		loads    elfLoads
+		region   MapRegion
+		pc       uint64
+		wantBias uint64
+	}{
+		{"non-PIE text", nonPIE, MapRegion{Start: 0x401000, End: 0x496000, Offset: 0x1000}, 0x401234, 0},
+		{"non-PIE data", nonPIE, MapRegion{Start: 0x497000, End: 0x49f000, Offset: 0x96000}, 0x497010, 0},
+		{"PIE text", pie, MapRegion{Start: 0x55d4b2001000, End: 0x55d4b2006000, Offset: 0x1000}, 0x55d4b2001234, 0x55d4b2000000},
+		// the page holding the start of the segment is mapped from the page-aligned offset
+		{"PIE data", pie, MapRegion{Start: 0x55d4b2007000, End: 0x55d4b2008000, Offset: 0x6000}, 0x55d4b2007dd8, 0x55d4b2000000},
+		{"shared library text", sharedLib, MapRegion{Start: 0x7f8a9b028000, End: 0x7f8a9b1bd000, Offset: 0x28000}, 0x7f8a9b0a0c20, 0x7f8a9b000000},
+		{"shared library data", sharedLib, MapRegion{Start: 0x7f8a9b20d000, End: 0x7f8a9b211000, Offset: 0x20c000}, 0x7f8a9b20d900, 0x7f8a9b000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bias, err := tt.loads.loadBias(&tt.region, tt.pc)
+			if err != nil {
+				t.Fatalf("loadBias: %v", err)
+			}
+			if bias != tt.wantBias {
+				t.Fatalf("got bias %#x, want %#x", bias, tt.wantBias)
+			}
+		})
+	}
+
+	// .bss has no bytes in the file
+	if _, err := pie.loadBias(&MapRegion{Start: 0x55d4b2008000, End: 0x55d4b2009000, Offset: 0x7000}, 0x55d4b2008100); err == nil {
+		t.Fatal("expected an error for a pc outside of the loaded segments")
+	}
+}
+
+//go:noinline
+func loadBiasTestFunc() {}
+
+// the test binary, wherever the kernel mapped it
+func TestCachingSymbolResolver_TestBinary(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps, err := NewProcMaps(NewProcMapsReader(os.Getpid()))
+	if err != nil {
+		t.Fatalf("NewProcMaps: %v", err)
+	}
+	pc := uint64(reflect.ValueOf(loadBiasTestFunc).Pointer())
+	region := maps.FindRegion(pc)
+	if region == nil || region.Path != exe {
+		t.Fatalf("expected %#x to be mapped from %s, got %+v", pc, exe, region)
+	}
+
+	syms, err := NewCachingSymbolResolver(NewCascadingSymbolLoader()).ResolvePC(os.Getpid(), region, pc)
+	if err != nil || len(syms) != 1 {
+		t.Fatalf("ResolvePC: %+v, %v", syms, err)
+	}
+	sym := syms[0]
+	if want := "github.com/VladMinzatu/ebpf-profiler/internal/symbolizer.loadBiasTestFunc"; sym.Name != want || sym.Offset != 0 {
+		t.Fatalf("got %s+%#x, want %s+0", sym.Name, sym.Offset, want)
+	}
+}
+
+// libc as ld.so would map it at a random base
+func TestCachingSymbolResolver_SharedLibrary(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("libc is only looked for on amd64")
+	}
+	const path = "/lib/x86_64-linux-gnu/libc.so.6"
+	ef, err := elf.Open(path)
+	if err != nil {
+		t.Skipf("libc not found: %v", err)
+	}
+	defer ef.Close()
+	syms, err := ef.DynamicSymbols()
+	if err != nil {
+		t.Fatalf("DynamicSymbols: %v", err)
+	}
+	var malloc uint64
+	for _, s := range syms {
+		if s.Name == "malloc" {
+			malloc = s.Value
+		}
+	}
+	var text *elf.Prog
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0 {
+			text = p
+		}
+	}
+	if malloc == 0 || text == nil {
+		t.Skip("malloc or the text segment not found in libc")
+	}
+
+	const base = 0x7f8a9b000000
+	region := &MapRegion{
+		Start:  base + text.Vaddr&^0xfff,
+		End:    base + (text.Vaddr+text.Memsz+0xfff)&^0xfff,
+		Offset: text.Off &^ 0xfff,
+		Perms:  "r-xp",
+		Path:   path,
+	}
+	frames, err := NewCachingSymbolResolver(NewCascadingSymbolLoader()).ResolvePC(os.Getpid(), region, base+malloc+4)
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("ResolvePC: %+v, %v", frames, err)
+	}
+	sym := frames[0]
+	// malloc may have aliases, e.g. __libc_malloc
+	for _, s := range syms {
+		if s.Name == sym.Name && s.Value == malloc && sym.Offset == 4 {
+			return
+		}
+	}
+	t.Fatalf("got %s+%#x, want malloc+0x4", sym.Name, sym.Offset)
+}
@@ -3,15 +3,31 @@ package symbolizer
 import (
 	"fmt"
 	"log/slog"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type MapRegion struct {
 	Start, End uint64
 	Offset     uint64
 	Perms      string
-	Path       string
+	Dev        string // major:minor of the device the file is on, as in /proc/<pid>/maps
+	Inode      uint64
+	Path       string // in the mount namespace of the process
+}
+
+// the state kept per process is dropped once the process exited, which is checked every exitedProcessSweep; the
+// symbols and call frame information of files are dropped once nothing was resolved in them for unusedFileTTL
+const (
+	exitedProcessSweep = 30 * time.Second
+	unusedFileTTL      = 10 * time.Minute
+)
+
+func processExists(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return err == nil
 }
 
 type MapsReader interface {
@@ -54,6 +70,11 @@ func (m *procMaps) FindRegion(pc uint64) *MapRegion {
 	return nil
 }
 
+// returns the regions as of the last Refresh, in the order of the maps file
+func (m *procMaps) Regions() []MapRegion {
+	return m.regions
+}
+
 func (m *procMaps) Refresh() error {
 	lines, err := m.mapReader.ReadLines()
 	if err != nil {
@@ -102,8 +123,9 @@ func parseMapEntry(line string) (MapRegion, error) {
 	start, err1 := strconv.ParseUint(se[0], 16, 64)
 	end, err2 := strconv.ParseUint(se[1], 16, 64)
 	offv, err3 := strconv.ParseUint(off, 16, 64)
-	if err1 != nil || err2 != nil || err3 != nil {
+	inode, err4 := strconv.ParseUint(parts[4], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
 		return MapRegion{}, fmt.Errorf("failed to parse numeric addresses in line %s", line)
 	}
-	return MapRegion{Start: start, End: end, Offset: offv, Perms: perms, Path: path}, nil
+	return MapRegion{Start: start, End: end, Offset: offv, Perms: perms, Dev: parts[3], Inode: inode, Path: path}, nil
 }
@@ -32,6 +32,8 @@ func TestParseMapEntry(t *testing.T) {
 				End:    0x55d4b2021000,
 				Offset: 0x00000000,
 				Perms:  "r--p",
+				Dev:    "08:01",
+				Inode:  131073,
 				Path:   "/usr/bin/myprog",
 			},
 			wantErr: false,
@@ -44,6 +46,8 @@ func TestParseMapEntry(t *testing.T) {
 				End:    0x7f8a9b002000,
 				Offset: 0x00001000,
 				Perms:  "r-xp",
+				Dev:    "08:01",
+				Inode:  131074,
 				Path:   "",
 			},
 			wantErr: false,
@@ -56,6 +60,8 @@ func TestParseMapEntry(t *testing.T) {
 				End:    0x7f8a9b002000,
 				Offset: 0x00001000,
 				Perms:  "r-xp",
+				Dev:    "08:01",
+				Inode:  131074,
 				Path:   "/usr/lib/libc.so.6 (deleted)",
 			},
 			wantErr: false,
@@ -75,6 +81,11 @@ func TestParseMapEntry(t *testing.T) {
 			line:    "invalid-55d4b2021000 r--p 00000000 08:01 131073 /usr/bin/myprog",
 			wantErr: true,
 		},
+		{
+			name:    "invalid inode",
+			line:    "55d4b2000000-55d4b2021000 r--p 00000000 08:01 inode /usr/bin/myprog",
+			wantErr: true,
+		},
 		{
 			name:    "empty line",
 			line:    "",
@@ -102,6 +113,9 @@ func TestParseMapEntry(t *testing.T) {
 				if got.Perms != tt.want.Perms {
 					t.Errorf("parseMapEntry() Perms = %q, want %q", got.Perms, tt.want.Perms)
 				}
+				if got.Dev != tt.want.Dev || got.Inode != tt.want.Inode {
+					t.Errorf("parseMapEntry() Dev, Inode = %s, %d, want %s, %d", got.Dev, got.Inode, tt.want.Dev, tt.want.Inode)
+				}
 				if got.Path != tt.want.Path {
 					t.Errorf("parseMapEntry() Path = %q, want %q", got.Path, tt.want.Path)
 				}
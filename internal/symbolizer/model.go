@@ -4,4 +4,19 @@ type Symbol struct {
 	Name   string
 	Addr   uint64 // absolute address of the symbol
 	Offset uint64 // offset from function start
+
+	// where in the source the address is, if the binary has line tables (.gopclntab or DWARF); empty/0 otherwise
+	File      string
+	Line      int
+	StartLine int // line the function starts at
+
+	// the function was inlined into the next symbol of the stack, which is at the same address
+	Inlined bool
+
+	// the symbol table the frame was resolved from, which tells how much to trust it: e.g. a frame from .dynsym may
+	// be a static function attributed to the exported one before it
+	Source SymbolSource
+
+	// the mapping of the process the address is in; nil for kernel frames and addresses outside of any mapping
+	Mapping *MapRegion
 }
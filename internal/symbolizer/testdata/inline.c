@@ -0,0 +1,46 @@
+// The inlined frames fixture of the symbolizer tests, built with:
+//   gcc -g -O2 -nostdlib -static -ffile-prefix-map=$PWD=. -o inline.elf inline.c
+
+static volatile int sink;
+
+static inline __attribute__((always_inline)) void add(int i)
+{
+	sink += i;
+}
+
+static inline __attribute__((always_inline)) void accumulate(int n)
+{
+	for (int i = 0; i < n; i++)
+		add(i);
+}
+
+__attribute__((noinline)) void work(int n)
+{
+	accumulate(n);
+	sink = 0;
+}
+
+__attribute__((noinline)) void record(int n)
+{
+	sink = n;
+}
+
+// the call to record is the last instruction of flush, so the return address into step is already outside of it
+static inline __attribute__((always_inline)) void flush(int n)
+{
+	record(n);
+}
+
+__attribute__((noinline)) void step(int n)
+{
+	flush(n);
+	sink = 0;
+}
+
+void _start(void)
+{
+	work(10);
+	step(1);
+	for (;;)
+		;
+}
@@ -0,0 +1,17 @@
+// The DWARF fixture of the symbolizer tests, built with:
+//   gcc -g -O1 -nostdlib -static -ffile-prefix-map=$PWD=. -o lines.elf lines.c
+
+static volatile int sink;
+
+__attribute__((noinline)) void leaf(int n)
+{
+	for (int i = 0; i < n; i++)
+		sink += i;
+}
+
+void _start(void)
+{
+	leaf(10);
+	for (;;)
+		;
+}
@@ -0,0 +1,261 @@
+package symbolizer
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DWARF register numbers of x86-64, from the System V psABI
+const (
+	x86RegBP = 6
+	x86RegSP = 7
+	x86RegRA = 16 // the return address column
+)
+
+var (
+	errOutermostFrame = errors.New("outermost frame")
+	errStackExhausted = errors.New("frame outside of the copied stack")
+)
+
+// Unwinds copies of user stacks (see ebpf.Options.UserStackUnwinder) with the call frame information of the binaries
+// the process has mapped, which works for code built without frame pointers. Code without call frame information,
+// like JIT-compiled code, is unwound with frame pointers instead. Only x86-64 is supported.
+type DwarfUnwinder struct {
+	maxFrames int
+
+	newMaps    func(pid int) (ProcMapsProvider, error)
+	loadFrames func(pid int, path string) (*frameTable, error)
+
+	mu     sync.Mutex
+	maps   map[int]ProcMapsProvider
+	tables map[mappedFile]*cachedFrameTable
+
+	// the maps of processes that exited are dropped every sweepInterval, together with the frame tables no longer
+	// used
+	sweepInterval time.Duration
+	sweptAt       time.Time
+	exists        func(pid int) bool
+}
+
+type cachedFrameTable struct {
+	*frameTable // nil for files without usable call frame information
+	usedAt      time.Time
+}
+
+// identifies a mapped file across processes: the same path can be a different file in another container
+type mappedFile struct {
+	path  string
+	dev   string
+	inode uint64
+}
+
+func NewDwarfUnwinder(maxFrames int) *DwarfUnwinder {
+	return &DwarfUnwinder{
+		maxFrames: maxFrames,
+		newMaps: func(pid int) (ProcMapsProvider, error) {
+			return NewProcMaps(NewProcMapsReader(pid))
+		},
+		loadFrames:    loadProcFrameTable,
+		maps:          make(map[int]ProcMapsProvider),
+		tables:        make(map[mappedFile]*cachedFrameTable),
+		sweepInterval: exitedProcessSweep,
+		sweptAt:       time.Now(),
+		exists:        processExists,
+	}
+}
+
+func loadProcFrameTable(pid int, path string) (*frameTable, error) {
+	ef, err := openELF(pid, path)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+	if ef.Machine != elf.EM_X86_64 {
+		return nil, fmt.Errorf("unsupported machine %v", ef.Machine)
+	}
+	return loadFrameTable(ef)
+}
+
+// unwinds the stack of a thread of pid that was interrupted at ip, with sp and bp its stack and frame pointers, and
+// stack the copy of its stack from sp upwards. The frames that could be unwound are returned even if unwinding stops
+// early, together with the reason; reaching the outermost frame or maxFrames is not an error.
+func (u *DwarfUnwinder) Unwind(pid int, ip, sp, bp uint64, stack []byte) ([]uint64, error) {
+	if ip == 0 {
+		return nil, nil // no user space, e.g. kernel threads
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sweep()
+
+	base := sp
+	read := func(addr uint64) (uint64, bool) {
+		if addr < base || addr-base >= uint64(len(stack)) || addr-base+8 > uint64(len(stack)) {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint64(stack[addr-base:]), true
+	}
+
+	frames := []uint64{ip}
+	pc := ip
+	for len(frames) < u.maxFrames {
+		// return addresses point after the call, which may already be the first instruction of another function
+		lookupPC := pc
+		if len(frames) > 1 {
+			lookupPC--
+		}
+
+		var nextPC, nextSP, nextBP uint64
+		row, err := u.rowFor(pid, lookupPC)
+		if err == nil {
+			nextPC, nextSP, nextBP, err = stepWithCFI(row, sp, bp, read)
+		} else if bp != 0 {
+			cfiErr := err
+			if nextPC, nextSP, nextBP, err = stepWithFramePointer(sp, bp, read); err != nil {
+				err = fmt.Errorf("%w (frame pointers: %v)", cfiErr, err)
+			}
+		}
+		if errors.Is(err, errOutermostFrame) {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, fmt.Errorf("unwinding frame %d at %#x: %w", len(frames), pc, err)
+		}
+		if nextPC == 0 {
+			return frames, nil
+		}
+		if nextSP <= sp {
+			return frames, fmt.Errorf("unwinding frame %d at %#x: stack pointer did not advance", len(frames), pc)
+		}
+		pc, sp, bp = nextPC, nextSP, nextBP
+		frames = append(frames, pc)
+	}
+	return frames, nil
+}
+
+// computes the caller's registers from the rules of the callee's row
+func stepWithCFI(row *unwindRow, sp, bp uint64, read func(uint64) (uint64, bool)) (pc, cfa, callerBP uint64, err error) {
+	if row.cfaExpr {
+		return 0, 0, 0, errors.New("CFA computed by an expression")
+	}
+	switch row.cfaReg {
+	case x86RegSP:
+		cfa = sp + uint64(row.cfaOffset)
+	case x86RegBP:
+		cfa = bp + uint64(row.cfaOffset)
+	default:
+		return 0, 0, 0, fmt.Errorf("unsupported CFA register %d", row.cfaReg)
+	}
+
+	ra := row.rule(x86RegRA)
+	switch ra.kind {
+	case ruleUndefined:
+		return 0, 0, 0, errOutermostFrame
+	case ruleOffset:
+		var ok bool
+		if pc, ok = read(cfa + uint64(ra.offset)); !ok {
+			return 0, 0, 0, errStackExhausted
+		}
+	default:
+		return 0, 0, 0, fmt.Errorf("unsupported return address rule %d", ra.kind)
+	}
+
+	callerBP = bp
+	switch rule := row.rule(x86RegBP); rule.kind {
+	case ruleSameValue, ruleUndefined:
+	case ruleOffset:
+		var ok bool
+		if callerBP, ok = read(cfa + uint64(rule.offset)); !ok {
+			return 0, 0, 0, errStackExhausted
+		}
+	case ruleValOffset:
+		callerBP = cfa + uint64(rule.offset)
+	default:
+		return 0, 0, 0, fmt.Errorf("unsupported frame pointer rule %d", rule.kind)
+	}
+	return pc, cfa, callerBP, nil
+}
+
+// the caller's frame pointer is saved at bp, with the return address right above it
+func stepWithFramePointer(sp, bp uint64, read func(uint64) (uint64, bool)) (pc, callerSP, callerBP uint64, err error) {
+	if bp < sp {
+		return 0, 0, 0, errors.New("frame pointer below the stack pointer")
+	}
+	callerBP, ok1 := read(bp)
+	pc, ok2 := read(bp + 8)
+	if !ok1 || !ok2 {
+		return 0, 0, 0, errStackExhausted
+	}
+	return pc, bp + 16, callerBP, nil
+}
+
+// drops the maps of the processes that exited and the frame tables no longer used, at most every sweepInterval
+func (u *DwarfUnwinder) sweep() {
+	if time.Since(u.sweptAt) < u.sweepInterval {
+		return
+	}
+	u.sweptAt = time.Now()
+	for pid := range u.maps {
+		if !u.exists(pid) {
+			delete(u.maps, pid)
+		}
+	}
+	for file, t := range u.tables {
+		if time.Since(t.usedAt) >= unusedFileTTL {
+			delete(u.tables, file)
+		}
+	}
+}
+
+// finds the rules for pc, an address in pid
+func (u *DwarfUnwinder) rowFor(pid int, pc uint64) (*unwindRow, error) {
+	maps, ok := u.maps[pid]
+	if !ok {
+		var err error
+		if maps, err = u.newMaps(pid); err != nil {
+			return nil, err
+		}
+		u.maps[pid] = maps
+	}
+	r := maps.FindRegion(pc)
+	if r == nil {
+		// the process may have mapped something since we last read its maps
+		if err := maps.Refresh(); err != nil {
+			delete(u.maps, pid)
+			return nil, err
+		}
+		if r = maps.FindRegion(pc); r == nil {
+			return nil, fmt.Errorf("pc %#x not mapped", pc)
+		}
+	}
+	// anonymous memory (e.g. JIT-compiled code) and the vdso, which has no file we could read
+	if r.Path == "" || strings.HasPrefix(r.Path, "[") {
+		return nil, fmt.Errorf("no call frame information for %s", r.Path)
+	}
+
+	file := mappedFile{path: r.Path, dev: r.Dev, inode: r.Inode}
+	t, ok := u.tables[file]
+	if !ok {
+		loaded, err := u.loadFrames(pid, r.Path)
+		if err != nil {
+			slog.Debug("No call frame information, will fall back to frame pointers", "path", r.Path, "error", err)
+			loaded = nil
+		}
+		t = &cachedFrameTable{frameTable: loaded}
+		u.tables[file] = t
+	}
+	t.usedAt = time.Now()
+	if t.frameTable == nil {
+		return nil, fmt.Errorf("no call frame information in %s", r.Path)
+	}
+	bias, err := t.loads.loadBias(r, pc)
+	if err != nil {
+		return nil, err
+	}
+	return t.rowFor(pc - bias)
+}
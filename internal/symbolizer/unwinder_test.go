@@ -0,0 +1,183 @@
+package symbolizer
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+const (
+	testLeaf  = 0x401000 // no frame of its own
+	testMain  = 0x402000 // keeps a frame pointer
+	testStart = 0x403000 // the outermost frame
+)
+
+func testFrameTable(t *testing.T) *frameTable {
+	fdes, err := parseFrameSection(buildEhFrame(0x404000, []testFDE{
+		{start: testLeaf, size: 0x40},
+		{start: testMain, size: 0x100, instructions: framePointerPrologue},
+		{start: testStart, size: 0x40, instructions: []byte{dwCfaUndefined, x86RegRA}},
+	}), 0x404000, true, binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("parseFrameSection: %v", err)
+	}
+	return &frameTable{fdes: fdes, loads: elfLoads{{Off: 0, Vaddr: 0x400000, Filesz: 0x10000}}}
+}
+
+func newTestUnwinder(t *testing.T, regions []MapRegion, maxFrames int) *DwarfUnwinder {
+	table := testFrameTable(t)
+	u := NewDwarfUnwinder(maxFrames)
+	u.newMaps = func(pid int) (ProcMapsProvider, error) {
+		return &mockProcMapsProvider{regions: regions}, nil
+	}
+	u.loadFrames = func(pid int, path string) (*frameTable, error) {
+		if path != "/bin/app" {
+			return nil, errors.New("no such file")
+		}
+		return table, nil
+	}
+	return u
+}
+
+// lays out 64 bit words from sp upwards
+func testStack(words ...uint64) []byte {
+	var b []byte
+	for _, w := range words {
+		b = binary.LittleEndian.AppendUint64(b, w)
+	}
+	return b
+}
+
+const testSP = 0x7ffd0000
+
+// leaf called by main, called by start: main's frame pointer is at sp+0x20, with start's (0) and the return address
+// into start above it
+var testStackWords = []uint64{testMain + 0x50, 0, 0, 0, 0, testStart + 0x10}
+
+func TestDwarfUnwinder_Unwind(t *testing.T) {
+	u := newTestUnwinder(t, []MapRegion{{Start: 0x400000, End: 0x410000, Path: "/bin/app"}}, 127)
+
+	frames, err := u.Unwind(1, testLeaf+0x10, testSP, testSP+0x20, testStack(testStackWords...))
+	if err != nil {
+		t.Fatalf("Unwind: %v", err)
+	}
+	if want := []uint64{testLeaf + 0x10, testMain + 0x50, testStart + 0x10}; !slices.Equal(frames, want) {
+		t.Fatalf("unexpected frames: got %#x want %#x", frames, want)
+	}
+}
+
+func TestDwarfUnwinder_MaxFrames(t *testing.T) {
+	u := newTestUnwinder(t, []MapRegion{{Start: 0x400000, End: 0x410000, Path: "/bin/app"}}, 2)
+
+	frames, err := u.Unwind(1, testLeaf+0x10, testSP, testSP+0x20, testStack(testStackWords...))
+	if err != nil {
+		t.Fatalf("Unwind: %v", err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %#x", frames)
+	}
+}
+
+func TestDwarfUnwinder_StackCopyTooSmall(t *testing.T) {
+	u := newTestUnwinder(t, []MapRegion{{Start: 0x400000, End: 0x410000, Path: "/bin/app"}}, 127)
+
+	frames, err := u.Unwind(1, testLeaf+0x10, testSP, testSP+0x20, testStack(testStackWords[:4]...))
+	if !errors.Is(err, errStackExhausted) {
+		t.Fatalf("expected errStackExhausted, got %v", err)
+	}
+	if want := []uint64{testLeaf + 0x10, testMain + 0x50}; !slices.Equal(frames, want) {
+		t.Fatalf("expected the frames unwound so far, got %#x", frames)
+	}
+}
+
+func TestDwarfUnwinder_FramePointerFallback(t *testing.T) {
+	// JIT-compiled code in anonymous memory, called by main
+	jit := uint64(0x7f0000001000)
+	u := newTestUnwinder(t, []MapRegion{
+		{Start: 0x400000, End: 0x410000, Path: "/bin/app"},
+		{Start: 0x7f0000000000, End: 0x7f0000010000},
+	}, 127)
+
+	// the JIT frame's frame pointer is at sp+0x10, with main's frame pointer (sp+0x30) and the return address above
+	stack := testStack(0, 0, testSP+0x30, testMain+0x50, 0, 0, 0, testStart+0x10)
+	frames, err := u.Unwind(1, jit, testSP, testSP+0x10, stack)
+	if err != nil {
+		t.Fatalf("Unwind: %v", err)
+	}
+	if want := []uint64{jit, testMain + 0x50, testStart + 0x10}; !slices.Equal(frames, want) {
+		t.Fatalf("unexpected frames: got %#x want %#x", frames, want)
+	}
+}
+
+func TestDwarfUnwinder_UnmappedPC(t *testing.T) {
+	maps := &mockProcMapsProvider{regions: []MapRegion{{Start: 0x400000, End: 0x410000, Path: "/bin/app"}}}
+	u := newTestUnwinder(t, nil, 127)
+	u.newMaps = func(pid int) (ProcMapsProvider, error) { return maps, nil }
+
+	frames, err := u.Unwind(1, 0x500000, testSP, 0, testStack(testStackWords...))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if len(frames) != 1 || maps.refreshCalls != 1 {
+		t.Fatalf("expected only the first frame after refreshing the maps, got %#x and %d refreshes", frames, maps.refreshCalls)
+	}
+}
+
+func TestDwarfUnwinder_KernelThread(t *testing.T) {
+	u := newTestUnwinder(t, nil, 127)
+	frames, err := u.Unwind(1, 0, 0, 0, nil)
+	if err != nil || frames != nil {
+		t.Fatalf("expected no frames, got %#x, %v", frames, err)
+	}
+}
+
+// processes in different containers can map different files at the same path
+func TestDwarfUnwinder_FrameTablesByFile(t *testing.T) {
+	u := newTestUnwinder(t, nil, 127)
+	u.newMaps = func(pid int) (ProcMapsProvider, error) {
+		inode := uint64(100)
+		if pid == 3 {
+			inode = 200
+		}
+		return &mockProcMapsProvider{regions: []MapRegion{{Start: 0x400000, End: 0x410000, Dev: "00:2f", Inode: inode, Path: "/bin/app"}}}, nil
+	}
+	loadFrames := u.loadFrames
+	var loads []int
+	u.loadFrames = func(pid int, path string) (*frameTable, error) {
+		loads = append(loads, pid)
+		return loadFrames(pid, path)
+	}
+
+	for _, pid := range []int{1, 2, 3} {
+		if _, err := u.Unwind(pid, testLeaf+0x10, testSP, testSP+0x20, testStack(testStackWords...)); err != nil {
+			t.Fatalf("Unwind(%d): %v", pid, err)
+		}
+	}
+	if want := []int{1, 3}; !slices.Equal(loads, want) {
+		t.Fatalf("expected the frame tables to be loaded by pids %v, got %v", want, loads)
+	}
+}
+
+func TestDwarfUnwinder_SweepsExitedProcesses(t *testing.T) {
+	u := newTestUnwinder(t, []MapRegion{{Start: 0x400000, End: 0x410000, Path: "/bin/app"}}, 127)
+	exited := map[int]bool{}
+	u.exists = func(pid int) bool { return !exited[pid] }
+
+	for _, pid := range []int{1, 2} {
+		if _, err := u.Unwind(pid, testLeaf+0x10, testSP, testSP+0x20, testStack(testStackWords...)); err != nil {
+			t.Fatalf("Unwind(%d): %v", pid, err)
+		}
+	}
+	exited[1] = true
+	u.sweepInterval = 0
+	if _, err := u.Unwind(2, testLeaf+0x10, testSP, testSP+0x20, testStack(testStackWords...)); err != nil {
+		t.Fatalf("Unwind: %v", err)
+	}
+	if _, ok := u.maps[1]; ok || len(u.maps) != 1 {
+		t.Fatalf("expected the maps of the exited process to be dropped, got %v", u.maps)
+	}
+	if len(u.tables) != 1 {
+		t.Fatalf("expected the frame table still in use to be kept, got %d", len(u.tables))
+	}
+}
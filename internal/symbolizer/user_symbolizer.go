@@ -3,6 +3,8 @@ package symbolizer
 import (
 	"fmt"
 	"log/slog"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,7 +22,10 @@ type UserSymbolizer struct {
 
 	mapsCachedAt time.Time
 	mapsCacheTtl time.Duration
-	mapsMu       sync.RWMutex
+	// pcs outside of any mapping only trigger a reread of the maps if they are older than this, as anything that
+	// isn't code (e.g. a bogus return address) would otherwise have them read for every sample
+	mapsMissRefresh time.Duration
+	mapsMu          sync.RWMutex
 }
 
 func NewUserSymbolizer(pid int, procMapsProvider ProcMapsProvider, symbolResolver SymbolResolver) *UserSymbolizer {
@@ -29,8 +34,9 @@ func NewUserSymbolizer(pid int, procMapsProvider ProcMapsProvider, symbolResolve
 		symbolResolver: symbolResolver,
 		mapsProvider:   procMapsProvider,
 
-		mapsCachedAt: time.Unix(0, 0),
-		mapsCacheTtl: 5 * time.Second,
+		mapsCachedAt:    time.Unix(0, 0),
+		mapsCacheTtl:    5 * time.Second,
+		mapsMissRefresh: 1 * time.Second,
 	}
 }
 
@@ -39,32 +45,78 @@ func (s *UserSymbolizer) Symbolize(stack []uint64) ([]Symbol, error) {
 	if err != nil {
 		return nil, fmt.Errorf("symbolization failed due to failure to read proc maps: %v", err)
 	}
-	var symbols []Symbol
-	for _, pc := range stack {
-		r := maps.FindRegion(pc)
-		if r == nil {
+	symbols := make([]Symbol, 0, len(stack))
+	for i, pc := range stack {
+		// all but the leaf are return addresses, which point after the call: the instruction before it is the one in
+		// the function (or the inlined scope) that made the call, which the return address may well be outside of
+		lookup := pc
+		if i > 0 {
+			lookup = pc - 1
+		}
+		r := maps.FindRegion(lookup)
+		if r == nil && s.mapsOlderThan(s.mapsMissRefresh) {
 			slog.Debug("Did not find map region for PC, invalidating cache and retrying", "pc", pc)
 			err = s.refreshMapsProvider()
 			if err != nil {
 				return nil, fmt.Errorf("symbolization failed due to failure to read proc maps: %v", err)
 			}
 			maps = s.mapsProvider
-			r = maps.FindRegion(pc)
-			if r == nil {
-				slog.Warn("Did not find map region for PC after cache refresh", "pc", pc)
-				continue
-			}
+			r = maps.FindRegion(lookup)
+		}
+		if r == nil {
+			slog.Debug("Did not find map region for PC", "pid", s.pid, "pc", pc)
+			symbols = append(symbols, Symbol{Name: UnknownFrame, Addr: pc})
+			continue
 		}
 
-		symbol, err := s.symbolResolver.ResolvePC(r.Path, pc, r.Offset)
+		// anonymous memory (e.g. JIT-compiled code) and the vdso have no file to read symbols from
+		if r.Path == "" || strings.HasPrefix(r.Path, "[") {
+			symbols = append(symbols, unresolvedSymbol(r, pc))
+			continue
+		}
+		frames, err := s.symbolResolver.ResolvePC(s.pid, r, lookup)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve symbol for pc=%d: %v", pc, err)
+			slog.Debug("Failed to resolve symbol, using the mapping and offset instead", "pc", pc, "path", r.Path, "error", err)
+			symbols = append(symbols, unresolvedSymbol(r, pc))
+			continue
+		}
+		for _, f := range frames {
+			f.Addr, f.Offset = pc, f.Offset+pc-lookup
+			f.Mapping = r
+			symbols = append(symbols, f)
 		}
-		symbols = append(symbols, *symbol)
 	}
 	return symbols, nil
 }
 
+// the frame of a pc that isn't in any mapping
+const UnknownFrame = "[unknown]"
+
+// the frames of a stack that couldn't be symbolized at all, e.g. because the process exited
+func UnknownFrames(stack []uint64) []Symbol {
+	symbols := make([]Symbol, len(stack))
+	for i, pc := range stack {
+		symbols[i] = Symbol{Name: UnknownFrame, Addr: pc}
+	}
+	return symbols
+}
+
+// names the frame of a pc that couldn't be resolved after its mapping and the offset into the mapped file, e.g.
+// libfoo.so+0x1a2b, which can still be resolved offline, e.g. with addr2line
+func unresolvedSymbol(r *MapRegion, pc uint64) Symbol {
+	name := filepath.Base(r.Path)
+	if r.Path == "" {
+		name = "[anon]"
+	}
+	return Symbol{Name: fmt.Sprintf("%s+%#x", name, pc-r.Start+r.Offset), Addr: pc, Mapping: r}
+}
+
+func (s *UserSymbolizer) mapsOlderThan(d time.Duration) bool {
+	s.mapsMu.RLock()
+	defer s.mapsMu.RUnlock()
+	return time.Since(s.mapsCachedAt) >= d
+}
+
 func (s *UserSymbolizer) getMapsProvider() (ProcMapsProvider, error) {
 	s.mapsMu.RLock()
 	if time.Since(s.mapsCachedAt) < s.mapsCacheTtl {
@@ -92,3 +144,132 @@ func (s *UserSymbolizer) refreshMapsProvider() error {
 	s.mapsCachedAt = time.Now()
 	return nil
 }
+
+// Symbolizes user stacks of any process, lazily creating and caching one UserSymbolizer per PID.
+// This is what allows profiling more than one process (e.g. the whole host) with a single profiler.
+type MultiProcessUserSymbolizer struct {
+	symbolizers   map[int]*UserSymbolizer
+	newSymbolizer func(pid int) (*UserSymbolizer, error)
+	resolver      *CachingSymbolResolver // shared by the symbolizers, so that each binary is only loaded once
+	mu            sync.Mutex
+
+	// the symbolizers of processes that exited are dropped every sweepInterval, together with the binaries no
+	// longer used
+	sweepInterval time.Duration
+	sweptAt       time.Time
+	exists        func(pid int) bool
+
+	// processes whose maps couldn't be read, mostly because they exited, fail without rereading them until retryAfter
+	// passed, as they usually have many more samples left to symbolize
+	failures   map[int]failedSymbolizer
+	retryAfter time.Duration
+}
+
+type failedSymbolizer struct {
+	err error
+	at  time.Time
+}
+
+func NewMultiProcessUserSymbolizer() *MultiProcessUserSymbolizer {
+	resolver := NewCachingSymbolResolver(NewCascadingSymbolLoader())
+	return &MultiProcessUserSymbolizer{
+		symbolizers: make(map[int]*UserSymbolizer),
+		newSymbolizer: func(pid int) (*UserSymbolizer, error) {
+			procMapsProvider, err := NewProcMaps(NewProcMapsReader(pid))
+			if err != nil {
+				return nil, err
+			}
+			return NewUserSymbolizer(pid, procMapsProvider, resolver), nil
+		},
+		resolver:      resolver,
+		sweepInterval: exitedProcessSweep,
+		sweptAt:       time.Now(),
+		exists:        processExists,
+		failures:      make(map[int]failedSymbolizer),
+		retryAfter:    5 * time.Second,
+	}
+}
+
+func (m *MultiProcessUserSymbolizer) Symbolize(pid int, stack []uint64) ([]Symbol, error) {
+	if len(stack) == 0 {
+		return nil, nil
+	}
+
+	m.sweep()
+	if err := m.recentFailure(pid); err != nil {
+		return nil, err
+	}
+	s, err := m.symbolizerFor(pid)
+	if err != nil {
+		err = fmt.Errorf("failed to create symbolizer for pid %d: %v", pid, err)
+		m.failed(pid, err)
+		return nil, err
+	}
+	symbols, err := s.Symbolize(stack)
+	if err != nil {
+		// the process may have exited or exec'd, so start from scratch next time
+		m.mu.Lock()
+		delete(m.symbolizers, pid)
+		m.mu.Unlock()
+		m.failed(pid, err)
+		return nil, err
+	}
+	return symbols, nil
+}
+
+func (m *MultiProcessUserSymbolizer) recentFailure(pid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.failures[pid]
+	if !ok {
+		return nil
+	}
+	if time.Since(f.at) >= m.retryAfter {
+		delete(m.failures, pid)
+		return nil
+	}
+	return f.err
+}
+
+func (m *MultiProcessUserSymbolizer) failed(pid int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	// forget the processes that are gone for good
+	for p, f := range m.failures {
+		if now.Sub(f.at) >= m.retryAfter {
+			delete(m.failures, p)
+		}
+	}
+	m.failures[pid] = failedSymbolizer{err: err, at: now}
+}
+
+// drops the symbolizers of the processes that exited and the binaries no longer used, at most every sweepInterval
+func (m *MultiProcessUserSymbolizer) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.sweptAt) < m.sweepInterval {
+		return
+	}
+	m.sweptAt = time.Now()
+	for pid := range m.symbolizers {
+		if !m.exists(pid) {
+			delete(m.symbolizers, pid)
+		}
+	}
+	m.resolver.evictUnused(unusedFileTTL)
+}
+
+func (m *MultiProcessUserSymbolizer) symbolizerFor(pid int) (*UserSymbolizer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.symbolizers[pid]; ok {
+		return s, nil
+	}
+	s, err := m.newSymbolizer(pid)
+	if err != nil {
+		return nil, err
+	}
+	m.symbolizers[pid] = s
+	return s, nil
+}
@@ -2,6 +2,9 @@ package symbolizer
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"slices"
 	"testing"
 	"time"
 )
@@ -48,21 +51,22 @@ type mockSymbolResolver struct {
 	err     error
 }
 
-func (m *mockSymbolResolver) ResolvePC(path string, pc uint64, slide uint64) (*Symbol, error) {
+// resolves by file offset, as if every file was linked at 0
+func (m *mockSymbolResolver) ResolvePC(pid int, region *MapRegion, pc uint64) ([]Symbol, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
 	var symMap map[uint64]*Symbol
 	var ok bool
-	if symMap, ok = m.symbols[path]; !ok {
+	if symMap, ok = m.symbols[region.Path]; !ok {
 		return nil, errors.New("symbol data not found")
 	}
-	target := pc - slide
+	target := pc - region.Start + region.Offset
 	if sym, ok := symMap[target]; ok {
-		return sym, nil
+		return []Symbol{*sym}, nil
 	}
 
-	return &Symbol{Name: "unknown", Addr: target}, nil
+	return []Symbol{{Name: "unknown", Addr: target}}, nil
 }
 
 func TestUserSymbolizer_Symbolize(t *testing.T) {
@@ -72,12 +76,14 @@ func TestUserSymbolizer_Symbolize(t *testing.T) {
 		mapsProvider   *mockProcMapsProvider
 		symbolResolver *mockSymbolResolver
 		wantSymbols    int
+		wantNames      []string
 		wantErr        bool
 		errContains    string
 	}{
 		{
-			name:  "successful symbolization",
-			stack: []uint64{0x55d4b2000100, 0x7f8a9b000100},
+			name: "successful symbolization",
+			// the caller's frame is looked up at its return address - 1
+			stack: []uint64{0x55d4b2000100, 0x7f8a9b000101},
 			mapsProvider: &mockProcMapsProvider{
 				regions: []MapRegion{
 					{Start: 0x55d4b2000000, End: 0x55d4b2021000, Offset: 0x0, Path: "/usr/bin/myprog"},
@@ -90,15 +96,16 @@ func TestUserSymbolizer_Symbolize(t *testing.T) {
 						0x100: {Name: "main"},
 					},
 					"/usr/lib/libc.so.6": map[uint64]*Symbol{
-						0x100: {Name: "printf"},
+						0x1100: {Name: "printf"},
 					},
 				},
 			},
 			wantSymbols: 2,
+			wantNames:   []string{"main", "printf"},
 			wantErr:     false,
 		},
 		{
-			name:  "region not found - cache refresh and retry",
+			name:  "region not found",
 			stack: []uint64{0x55d4b2000100, 0xdeadbeef0000},
 			mapsProvider: &mockProcMapsProvider{
 				regions: []MapRegion{
@@ -112,7 +119,8 @@ func TestUserSymbolizer_Symbolize(t *testing.T) {
 					},
 				},
 			},
-			wantSymbols: 1,
+			wantSymbols: 2,
+			wantNames:   []string{"main", "[unknown]"},
 			wantErr:     false,
 		},
 		{
@@ -126,8 +134,8 @@ func TestUserSymbolizer_Symbolize(t *testing.T) {
 			symbolResolver: &mockSymbolResolver{
 				err: errors.New("provider error"),
 			},
-			wantErr:     true,
-			errContains: "failed to resolve symbol",
+			wantSymbols: 1,
+			wantNames:   []string{"myprog+0x100"},
 		},
 		{
 			name:  "symbol data not found for path",
@@ -140,8 +148,36 @@ func TestUserSymbolizer_Symbolize(t *testing.T) {
 			symbolResolver: &mockSymbolResolver{
 				symbols: map[string]map[uint64]*Symbol{},
 			},
-			wantErr:     true,
-			errContains: "failed to resolve symbol",
+			wantSymbols: 1,
+			wantNames:   []string{"myprog+0x100"},
+		},
+		{
+			name:  "shared library without symbols",
+			stack: []uint64{0x7f8a9b001a2b},
+			mapsProvider: &mockProcMapsProvider{
+				regions: []MapRegion{
+					{Start: 0x7f8a9b000000, End: 0x7f8a9b002000, Offset: 0x1000, Path: "/usr/lib/libfoo.so"},
+				},
+			},
+			symbolResolver: &mockSymbolResolver{
+				symbols: map[string]map[uint64]*Symbol{},
+			},
+			wantSymbols: 1,
+			wantNames:   []string{"libfoo.so+0x2a2b"},
+		},
+		{
+			name:  "vdso and anonymous memory",
+			stack: []uint64{0x7fff00000100, 0x7f0000000200},
+			mapsProvider: &mockProcMapsProvider{
+				regions: []MapRegion{
+					{Start: 0x7fff00000000, End: 0x7fff00002000, Path: "[vdso]"},
+					{Start: 0x7f0000000000, End: 0x7f0000100000},
+				},
+			},
+			// would resolve them from the executable
+			symbolResolver: &mockSymbolResolver{err: errors.New("unexpected")},
+			wantSymbols:    2,
+			wantNames:      []string{"[vdso]+0x100", "[anon]+0x200"},
 		},
 		{
 			name:  "empty stack",
@@ -179,10 +215,48 @@ func TestUserSymbolizer_Symbolize(t *testing.T) {
 			if len(symbols) != tt.wantSymbols {
 				t.Errorf("Symbolize() returned %d symbols, want %d", len(symbols), tt.wantSymbols)
 			}
+			for i, name := range tt.wantNames {
+				if i < len(symbols) && symbols[i].Name != name {
+					t.Errorf("Symbolize() frame %d = %q, want %q", i, symbols[i].Name, name)
+				}
+			}
+			// frames carry the mapping they are in, if any
+			for i, sym := range symbols {
+				if want := tt.mapsProvider.FindRegion(tt.stack[i]); sym.Mapping != want {
+					t.Errorf("Symbolize() frame %d in mapping %+v, want %+v", i, sym.Mapping, want)
+				}
+			}
 		})
 	}
 }
 
+// record, called from flush inlined into step, called from _start (see testdata/inline.c): the return address into
+// step is past the inlined flush, which only the call before it is in
+func TestUserSymbolizer_Symbolize_CallerInlinedAtEndOfScope(t *testing.T) {
+	maps := &mockProcMapsProvider{
+		regions: []MapRegion{{Start: 0x401000, End: 0x402000, Offset: 0x1000, Perms: "r-xp", Path: "testdata/inline.elf"}},
+	}
+	s := NewUserSymbolizer(os.Getpid(), maps, NewCachingSymbolResolver(NewCascadingSymbolLoader()))
+
+	symbols, err := s.Symbolize([]uint64{0x401030, 0x401045, 0x401064})
+	if err != nil {
+		t.Fatalf("Symbolize() error = %v", err)
+	}
+	type frame struct {
+		name string
+		addr uint64
+		line int
+	}
+	var got []frame
+	for _, sym := range symbols {
+		got = append(got, frame{sym.Name, sym.Addr, sym.Line})
+	}
+	want := []frame{{"record", 0x401030, 25}, {"flush", 0x401045, 31}, {"step", 0x401045, 36}, {"_start", 0x401064, 43}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
 func TestUserSymbolizer_getMapsProvider(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -401,6 +475,8 @@ func TestUserSymbolizer_Symbolize_WithCacheRefresh(t *testing.T) {
 	}
 
 	s := NewUserSymbolizer(1234, mockMaps, symbolResolver)
+	// still cached, but old enough to be reread on a miss
+	s.mapsCachedAt = time.Now().Add(-2 * s.mapsMissRefresh)
 
 	// This should trigger cache refresh and retry
 	symbols, err := s.Symbolize([]uint64{0x55d4b2000100})
@@ -408,14 +484,36 @@ func TestUserSymbolizer_Symbolize_WithCacheRefresh(t *testing.T) {
 		t.Fatalf("Symbolize() error = %v", err)
 	}
 
-	// Should eventually get a symbol after refresh
-	if len(symbols) == 0 {
-		t.Error("expected at least one symbol after cache refresh")
+	// Should get the symbol after refresh
+	if len(symbols) != 1 || symbols[0].Name != "main" {
+		t.Errorf("expected main after cache refresh, got %+v", symbols)
 	}
 
 	// Verify refresh was called
-	if mockMaps.refreshCalls == 0 {
-		t.Error("expected refresh to be called when region not found")
+	if mockMaps.refreshCalls != 1 {
+		t.Errorf("expected refresh to be called once when region not found, got %d", mockMaps.refreshCalls)
+	}
+}
+
+// pcs outside of any mapping don't have the maps reread over and over
+func TestUserSymbolizer_Symbolize_MissDoesNotRereadFreshMaps(t *testing.T) {
+	maps := &mockProcMapsProvider{
+		regions: []MapRegion{{Start: 0x55d4b2000000, End: 0x55d4b2021000, Path: "/usr/bin/myprog"}},
+	}
+	s := NewUserSymbolizer(1234, maps, &mockSymbolResolver{symbols: map[string]map[uint64]*Symbol{}})
+
+	for range 3 {
+		symbols, err := s.Symbolize([]uint64{0xdead0000, 0xbeef0000})
+		if err != nil {
+			t.Fatalf("Symbolize() error = %v", err)
+		}
+		if len(symbols) != 2 || symbols[0].Name != UnknownFrame || symbols[1].Name != UnknownFrame {
+			t.Fatalf("expected unknown frames, got %+v", symbols)
+		}
+	}
+	// only read once, when the cache was first filled
+	if maps.refreshCalls != 1 {
+		t.Errorf("expected the maps to be read once, got %d", maps.refreshCalls)
 	}
 }
 
@@ -450,6 +548,133 @@ func TestNewUserSymbolizer(t *testing.T) {
 	}
 }
 
+func TestMultiProcessUserSymbolizer_PerPIDSymbolizers(t *testing.T) {
+	created := map[int]int{}
+	m := NewMultiProcessUserSymbolizer()
+	m.newSymbolizer = func(pid int) (*UserSymbolizer, error) {
+		created[pid]++
+		path := fmt.Sprintf("/bin/prog%d", pid)
+		maps := &mockProcMapsProvider{
+			regions: []MapRegion{{Start: 0x1000, End: 0x2000, Offset: 0x1000, Path: path}},
+		}
+		resolver := &mockSymbolResolver{
+			symbols: map[string]map[uint64]*Symbol{
+				path: {0x1100: {Name: fmt.Sprintf("main%d", pid)}},
+			},
+		}
+		return NewUserSymbolizer(pid, maps, resolver), nil
+	}
+
+	for _, pid := range []int{1, 2, 1} {
+		symbols, err := m.Symbolize(pid, []uint64{0x1100})
+		if err != nil {
+			t.Fatalf("Symbolize(pid=%d) error = %v", pid, err)
+		}
+		if len(symbols) != 1 || symbols[0].Name != fmt.Sprintf("main%d", pid) {
+			t.Fatalf("Symbolize(pid=%d) = %+v", pid, symbols)
+		}
+	}
+
+	if created[1] != 1 || created[2] != 1 {
+		t.Errorf("expected one symbolizer per pid, got %v", created)
+	}
+}
+
+func TestMultiProcessUserSymbolizer_SweepsExitedProcesses(t *testing.T) {
+	m := NewMultiProcessUserSymbolizer()
+	m.newSymbolizer = func(pid int) (*UserSymbolizer, error) {
+		maps := &mockProcMapsProvider{regions: []MapRegion{{Start: 0x1000, End: 0x2000, Path: "/bin/prog"}}}
+		resolver := &mockSymbolResolver{symbols: map[string]map[uint64]*Symbol{"/bin/prog": {0x1100: {Name: "main"}}}}
+		return NewUserSymbolizer(pid, maps, resolver), nil
+	}
+	exited := map[int]bool{}
+	m.exists = func(pid int) bool { return !exited[pid] }
+
+	for _, pid := range []int{1, 2} {
+		if _, err := m.Symbolize(pid, []uint64{0x1100}); err != nil {
+			t.Fatalf("Symbolize(pid=%d) error = %v", pid, err)
+		}
+	}
+	exited[1] = true
+	if _, err := m.Symbolize(2, []uint64{0x1100}); err != nil {
+		t.Fatalf("Symbolize() error = %v", err)
+	}
+	if len(m.symbolizers) != 2 {
+		t.Fatalf("expected no sweep before sweepInterval passed, got %d symbolizers", len(m.symbolizers))
+	}
+
+	m.sweepInterval = 0
+	if _, err := m.Symbolize(2, []uint64{0x1100}); err != nil {
+		t.Fatalf("Symbolize() error = %v", err)
+	}
+	if _, ok := m.symbolizers[1]; ok || len(m.symbolizers) != 1 {
+		t.Fatalf("expected the symbolizer of the exited process to be dropped, got %v", m.symbolizers)
+	}
+}
+
+func TestMultiProcessUserSymbolizer_EmptyStack(t *testing.T) {
+	m := NewMultiProcessUserSymbolizer()
+	m.newSymbolizer = func(pid int) (*UserSymbolizer, error) {
+		t.Fatalf("no symbolizer should be created for an empty stack")
+		return nil, nil
+	}
+	symbols, err := m.Symbolize(1, nil)
+	if err != nil || symbols != nil {
+		t.Fatalf("Symbolize() = %v, %v; want nil, nil", symbols, err)
+	}
+}
+
+func TestMultiProcessUserSymbolizer_Errors(t *testing.T) {
+	m := NewMultiProcessUserSymbolizer()
+	m.newSymbolizer = func(pid int) (*UserSymbolizer, error) {
+		return nil, errors.New("no such process")
+	}
+	if _, err := m.Symbolize(1, []uint64{0x1000}); err == nil {
+		t.Fatal("expected error when the symbolizer cannot be created")
+	}
+	if len(m.symbolizers) != 0 {
+		t.Errorf("failed symbolizers must not be cached")
+	}
+
+	m.newSymbolizer = func(pid int) (*UserSymbolizer, error) {
+		maps := &mockProcMapsProvider{refreshErr: errors.New("process exited")}
+		return NewUserSymbolizer(pid, maps, &mockSymbolResolver{}), nil
+	}
+	if _, err := m.Symbolize(2, []uint64{0x1000}); err == nil {
+		t.Fatal("expected error when symbolization fails")
+	}
+	if len(m.symbolizers) != 0 {
+		t.Errorf("symbolizer should be evicted after failing")
+	}
+}
+
+// the maps of a process that exited aren't reread for each of its remaining samples
+func TestMultiProcessUserSymbolizer_CachesFailures(t *testing.T) {
+	created := 0
+	m := NewMultiProcessUserSymbolizer()
+	m.newSymbolizer = func(pid int) (*UserSymbolizer, error) {
+		created++
+		return nil, errors.New("no such process")
+	}
+
+	for range 3 {
+		if _, err := m.Symbolize(1, []uint64{0x1000}); err == nil {
+			t.Fatal("expected error when the symbolizer cannot be created")
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected the failure to be cached, got %d attempts", created)
+	}
+
+	m.retryAfter = 0
+	if _, err := m.Symbolize(1, []uint64{0x1000}); err == nil {
+		t.Fatal("expected error when the symbolizer cannot be created")
+	}
+	if created != 2 {
+		t.Fatalf("expected a retry once the failure expired, got %d attempts", created)
+	}
+}
+
 // Helper function
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -8,109 +13,353 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/VladMinzatu/ebpf-profiler/internal/cgroup"
+	"github.com/VladMinzatu/ebpf-profiler/internal/container"
+	"github.com/VladMinzatu/ebpf-profiler/internal/discovery"
 	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
 	"github.com/VladMinzatu/ebpf-profiler/internal/exporter"
 	"github.com/VladMinzatu/ebpf-profiler/internal/profiler"
 	"github.com/VladMinzatu/ebpf-profiler/internal/symbolizer"
 )
 
+// how often /proc is scanned for processes to profile with --exe, --cmdline and --unit
+const discoveryInterval = time.Second
+
 func main() {
-	backend, err := ebpf.NewEbpfBackend()
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(doctor(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	cfg, err := parseConfig(os.Args[1:], os.Stderr)
 	if err != nil {
-		slog.Error("Failed to initialise ebpf backend", "error", err)
-		os.Exit(1)
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		slog.Error("Invalid arguments", "error", err)
+		os.Exit(2)
 	}
 
-	pid := os.Getpid()
-	procMapsProvider, _ := symbolizer.NewProcMaps(symbolizer.NewProcMapsReader(pid))
-	symbolDataProvider := symbolizer.NewCachingSymbolResolver(pid, symbolizer.NewCascadingSymbolLoader(pid))
-	userSymbolizer := symbolizer.NewUserSymbolizer(pid, procMapsProvider, symbolDataProvider)
-	kernelSymbolizer := symbolizer.NewKernelSymbolizer(symbolizer.NewKallsymsReader())
-	p, err := profiler.NewProfiler(pid, 1000_000, 1*time.Second, backend, userSymbolizer, kernelSymbolizer)
+	if cfg.command != nil {
+		exitCode, err := record(cfg)
+		if err != nil {
+			slog.Error("Failed to record command", "command", cfg.command, "error", err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+	}
+
+	target, err := resolveTarget(cfg)
 	if err != nil {
-		slog.Error("Failed to initialise profiler", "error", err)
+		slog.Error("Invalid target", "error", err)
 		os.Exit(1)
 	}
-
-	err = p.Start()
+	s, err := startSession(cfg, target)
 	if err != nil {
-		slog.Error("Failed to start profiler", "error", err)
+		slog.Error("Failed to start profiling", "pid", target.PID, "cgroup", cfg.cgroup, "error", err)
 		os.Exit(1)
 	}
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	var writePprof sync.WaitGroup
+	var timeout <-chan time.Time
+	if cfg.duration > 0 {
+		timeout = time.After(cfg.duration)
+	}
+
+	var sig os.Signal
+	select {
+	case sig = <-stop:
+	case <-timeout:
+	}
+	if cfg.mapSizes.PinPath != "" && sig != syscall.SIGTERM {
+		// SIGTERM is what the agent gets when it is restarted or upgraded, after which the next one takes over the
+		// pinned programs; anything else ends profiling for good
+		if err := s.backend.Unpin(); err != nil {
+			slog.Warn("Failed to unpin BPF objects", "path", cfg.mapSizes.PinPath, "error", err)
+		}
+	}
+	s.finish()
+}
+
+func resolveTarget(cfg *config) (ebpf.Target, error) {
+	switch {
+	case cfg.systemWide:
+		return ebpf.Target{PID: ebpf.AllProcesses}, nil
+	case !cfg.discover.IsZero():
+		// every process is a candidate, and the discovery watcher allows the matching ones
+		return ebpf.Target{PID: ebpf.AllProcesses, AllowedOnly: true}, nil
+	case cfg.cgroup != "":
+		if err := cgroup.CheckV2(cgroup.DefaultRoot); err != nil {
+			return ebpf.Target{}, err
+		}
+		cg, err := cgroup.Lookup(cgroup.DefaultRoot, cfg.cgroup)
+		if err != nil {
+			return ebpf.Target{}, err
+		}
+		return ebpf.Target{PID: ebpf.AllProcesses, CgroupID: cg.ID, CgroupLevel: cg.Level}, nil
+	default:
+		return ebpf.Target{PID: cfg.pid}, nil
+	}
+}
+
+// a running profiler together with the goroutines that collect its samples and write them out once it stops, and
+// that stream its raw samples while it runs
+type session struct {
+	backend     *ebpf.EbpfBackend
+	p           *profiler.Profiler
+	writeOutput sync.WaitGroup
 
-	writePprof.Add(1)
+	stopDiscovery context.CancelFunc // nil unless processes are discovered
+	discovery     sync.WaitGroup
+}
+
+func startSession(cfg *config, target ebpf.Target) (*session, error) {
+	opts := cfg.mapSizes
+	if cfg.unwind == unwindDwarf {
+		opts.UserStackUnwinder = symbolizer.NewDwarfUnwinder(opts.StackFrames)
+	}
+	var samplesFile *os.File
+	if cfg.samplesOutput != "" {
+		opts.StreamSamples = true
+		f, err := os.Create(cfg.samplesOutput)
+		if err != nil {
+			return nil, fmt.Errorf("creating samples output: %w", err)
+		}
+		samplesFile = f
+	}
+	backend, err := ebpf.NewEbpfBackend(opts)
+	if err != nil {
+		closeFile(samplesFile)
+		reportVerifierLog(err, opts.VerboseVerifierLog)
+		return nil, fmt.Errorf("initialising ebpf backend: %w", err)
+	}
+
+	if err := applyFilters(backend, cfg); err != nil {
+		backend.Stop()
+		closeFile(samplesFile)
+		return nil, err
+	}
+	if target.PID != ebpf.AllProcesses {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", target.PID)); err != nil {
+			backend.Stop()
+			closeFile(samplesFile)
+			return nil, fmt.Errorf("target process not found: %w", err)
+		}
+	}
+	userSymbolizer := symbolizer.NewMultiProcessUserSymbolizer()
+	kernelSymbolizer := symbolizer.NewKernelSymbolizer(symbolizer.NewKallsymsReader())
+	cgroupResolver := cgroup.NewResolver(cgroup.DefaultRoot)
+	var containerSource container.Source // container ids are still reported without one
+	if cfg.kubeletURL != "" {
+		containerSource = container.NewKubeletSource(cfg.kubeletURL, container.ServiceAccountTokenFile, cfg.kubeletInsecureTLS)
+	}
+	containerResolver := container.NewResolver(containerSource)
+	p, err := profiler.NewProfiler(target, cfg.profileType, cfg.event, cfg.frequency, cfg.collectInterval, backend, userSymbolizer, kernelSymbolizer, cgroupResolver, containerResolver)
+	if err != nil {
+		backend.Stop()
+		closeFile(samplesFile)
+		return nil, fmt.Errorf("initialising profiler: %w", err)
+	}
+
+	if err := p.Start(); err != nil {
+		backend.Stop()
+		closeFile(samplesFile)
+		return nil, fmt.Errorf("starting profiler: %w", err)
+	}
+	slog.Info("Profiling started", "pid", target.PID, "cgroup", cfg.cgroup, "type", cfg.profileType, "event", cfg.event, "frequency", cfg.frequency, "duration", cfg.duration)
+
+	s := &session{backend: backend, p: p}
+	if !cfg.discover.IsZero() {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopDiscovery = cancel
+		w := discovery.NewWatcher(cfg.discover, discoveryInterval, filterHandler{backend})
+		s.discovery.Add(1)
+		go func() {
+			defer s.discovery.Done()
+			w.Run(ctx)
+		}()
+	}
+	s.writeOutput.Add(1)
 	go func() {
-		defer writePprof.Done()
+		defer s.writeOutput.Done()
 		var collectedSamples []profiler.Sample
 		samples := p.Samples()
-		for s := range samples {
-			for _, sample := range s {
-				collectedSamples = append(collectedSamples, sample)
-			}
+		for batch := range samples {
+			collectedSamples = append(collectedSamples, batch...)
 		}
-		writeSamplesAsOltp(collectedSamples)
-	}()
-
-	go func() {
-		done := time.Now().Add(10 * time.Second)
-		for time.Now().Before(done) {
-			hotCaller()
+		typ, unit := p.ValueType()
+		if err := writeSamples(cfg, typ, unit, collectedSamples); err != nil {
+			slog.Error("Failed to write profile", "format", cfg.format, "output", cfg.output, "error", err)
+			return
 		}
+		slog.Info("Profile written", "format", cfg.format, "output", cfg.output)
 	}()
+	if samplesFile != nil {
+		s.writeOutput.Add(1)
+		go func() {
+			defer s.writeOutput.Done()
+			streamRawSamples(p.RawSamples(), cfg.stacks, samplesFile)
+		}()
+	}
+	return s, nil
+}
 
-	<-stop
-	p.Stop() // stop the profiler - should close the samples channel
+// allows the discovered processes to be sampled
+type filterHandler struct {
+	backend *ebpf.EbpfBackend
+}
 
-	writePprof.Wait()
+func (h filterHandler) Attach(pid int) error {
+	return h.backend.SetFilter(ebpf.Filter{PID: pid}, ebpf.FilterAllow)
 }
 
-func writeSamplesAsPprof(samples []profiler.Sample) {
-	prof, err := exporter.BuildPprofProfile(samples, "cpu", "nanoseconds")
-	if err != nil {
-		slog.Error("Failed to build pprof Profile from the collected samples")
-		return
+func (h filterHandler) Detach(pid int) error {
+	return h.backend.RemoveFilter(ebpf.Filter{PID: pid})
+}
+
+// narrows down the sampled processes by comm
+func applyFilters(backend *ebpf.EbpfBackend, cfg *config) error {
+	for action, prefixes := range map[ebpf.FilterAction][]string{ebpf.FilterAllow: cfg.allowComms, ebpf.FilterDeny: cfg.denyComms} {
+		for _, prefix := range prefixes {
+			if err := backend.SetFilter(ebpf.Filter{CommPrefix: prefix}, action); err != nil {
+				return fmt.Errorf("setting filters: %w", err)
+			}
+		}
 	}
+	return nil
+}
 
-	err = exporter.WriteProfile(prof, "profile.pb")
-	if err != nil {
-		slog.Error("Failed to write profile to output")
+// writes raw samples to f as JSON Lines until the stream is closed, then closes f
+func streamRawSamples(samples <-chan profiler.Sample, sel exporter.StackSelection, f *os.File) {
+	bw := bufio.NewWriter(f)
+	w := exporter.NewSampleWriter(bw)
+	var written uint64
+	var writeErr error
+	for s := range samples {
+		if writeErr != nil {
+			continue // keep draining, so the profiler isn't held up
+		}
+		if writeErr = w.Write(selectStacks([]profiler.Sample{s}, sel)[0]); writeErr != nil {
+			slog.Error("Failed to write samples", "output", f.Name(), "error", writeErr)
+			continue
+		}
+		written++
+	}
+	if err := bw.Flush(); err != nil && writeErr == nil {
+		slog.Error("Failed to write samples", "output", f.Name(), "error", err)
+	}
+	if err := f.Close(); err != nil {
+		slog.Error("Failed to close samples output", "output", f.Name(), "error", err)
+	}
+	slog.Info("Samples written", "output", f.Name(), "samples", written)
+}
+
+// prints the verifier's log if the kernel rejected the BPF programs, or tells how to get it
+func reportVerifierLog(err error, verbose bool) {
+	var le *ebpf.LoadError
+	if !errors.As(err, &le) || len(le.VerifierLog) == 0 {
+		return
+	}
+	if !verbose {
+		slog.Info("The BPF verifier rejected the programs, rerun with --verifier-log for its complete log")
 		return
 	}
+	fmt.Fprintln(os.Stderr, "BPF verifier log:")
+	for _, line := range le.VerifierLog {
+		fmt.Fprintln(os.Stderr, "\t"+line)
+	}
 }
 
-func writeSamplesAsOltp(samples []profiler.Sample) {
-	prof := exporter.BuildOltpProfile(samples, func() uint64 { return uint64(time.Now().UnixNano()) })
+func closeFile(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
 
-	err := exporter.WriteOltpProfile(prof, "profile.pb")
+// stops the profiler and waits for the output to be written
+func (s *session) finish() {
+	if s.stopDiscovery != nil {
+		s.stopDiscovery()
+		s.discovery.Wait()
+	}
+	s.p.Stop() // stop the profiler - should close the samples channel
+	logStats(s.p)
+	s.writeOutput.Wait()
+}
+
+// warns about anything that makes the profile less trustworthy
+func logStats(p *profiler.Profiler) {
+	stats, err := p.Stats()
 	if err != nil {
-		slog.Error("Failed to write profile to output")
+		slog.Warn("Failed to read profiling stats", "error", err)
 		return
 	}
+	attrs := []any{
+		"samples", stats.Samples,
+		"samples_dropped", stats.SamplesDropped,
+		"stack_collisions", stats.StackCollisions,
+		"stack_map_full", stats.StackMapFull,
+		"stack_errors", stats.StackErrors,
+		"counts_evicted", stats.CountsEvicted,
+		"counts_errors", stats.CountsErrors,
+		"lookup_failures", stats.LookupFailures,
+		"user_stacks_lost", stats.UserStacksLost,
+		"user_stacks_truncated", stats.UserStacksTruncated, // common for deep stacks, which don't fit the copy
+		"raw_samples_lost", stats.RawSamplesLost,
+	}
+	if stats.SamplesDropped+stats.StackCollisions+stats.StackMapFull+stats.StackErrors+stats.CountsEvicted+stats.CountsErrors+stats.LookupFailures+stats.UserStacksLost+stats.RawSamplesLost > 0 {
+		slog.Warn("Some samples or stacks were lost, the profile may be incomplete", attrs...)
+		return
+	}
+	slog.Info("Profiling stats", attrs...)
 }
 
-func writeSamplesAsFoldedStacks(samples []profiler.Sample, sel exporter.StackSelection) {
-	stacks := exporter.BuildFoldedStacks(samples, sel)
+// typ and unit describe the sample values (see Profiler.ValueType)
+func writeSamples(cfg *config, typ, unit string, samples []profiler.Sample) error {
+	switch cfg.format {
+	case formatPprof:
+		return writeSamplesAsPprof(selectStacks(samples, cfg.stacks), typ, unit, cfg.output)
+	case formatOtlp:
+		return writeSamplesAsOltp(selectStacks(samples, cfg.stacks), typ, unit, cfg.output)
+	case formatFolded:
+		return writeSamplesAsFoldedStacks(samples, cfg.stacks, cfg.output)
+	}
+	return errors.New("unknown output format " + cfg.format)
+}
 
-	err := exporter.WriteFoldedStacksToFile(stacks, "stacks.txt")
-	if err != nil {
-		slog.Error("Failed to create output file for profile")
-		return
+// drops the stacks that were not selected, so exporters that always emit both stacks only see the requested ones
+func selectStacks(samples []profiler.Sample, sel exporter.StackSelection) []profiler.Sample {
+	if sel == exporter.Both {
+		return samples
+	}
+	out := make([]profiler.Sample, 0, len(samples))
+	for _, s := range samples {
+		switch sel {
+		case exporter.User:
+			s.KernelStack = nil
+		case exporter.Kernel:
+			s.UserStack = nil
+		}
+		out = append(out, s)
 	}
+	return out
 }
 
-//go:noinline
-func hotFunc() {
-	for i := 0; i < 1000; i++ {
-		_ = i * i
+func writeSamplesAsPprof(samples []profiler.Sample, sampleTypeName, sampleTypeUnit string, filename string) error {
+	prof, err := exporter.BuildPprofProfile(samples, sampleTypeName, sampleTypeUnit)
+	if err != nil {
+		return err
 	}
+	return exporter.WriteProfile(prof, filename)
 }
 
-//go:noinline
-func hotCaller() {
-	hotFunc()
+func writeSamplesAsOltp(samples []profiler.Sample, sampleTypeName, sampleTypeUnit string, filename string) error {
+	prof := exporter.BuildOltpProfile(samples, sampleTypeName, sampleTypeUnit, func() uint64 { return uint64(time.Now().UnixNano()) })
+	return exporter.WriteOltpProfile(prof, filename)
+}
+
+func writeSamplesAsFoldedStacks(samples []profiler.Sample, sel exporter.StackSelection, filename string) error {
+	stacks := exporter.BuildFoldedStacks(samples, sel)
+	return exporter.WriteFoldedStacksToFile(stacks, filename)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"github.com/VladMinzatu/ebpf-profiler/internal/ebpf"
+)
+
+// launches cfg.command, profiles it from its very first instruction and returns its exit code once it terminates.
+//
+// The child is started under ptrace, which makes the kernel stop it with SIGTRAP right after execve, i.e. before the
+// dynamic loader or any of its own code has run. We attach the perf events while it is stopped and only then let it go.
+func record(cfg *config) (int, error) {
+	// ptrace requests have to come from the same OS thread that started the tracee
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cmd := exec.Command(cfg.command[0], cfg.command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("starting command: %w", err)
+	}
+	pid := cmd.Process.Pid
+
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, 0, nil); err != nil {
+		_ = cmd.Process.Kill()
+		return 0, fmt.Errorf("waiting for command to stop after exec: %w", err)
+	}
+	if !ws.Stopped() {
+		return 0, fmt.Errorf("command terminated before it could be profiled (status %v)", ws)
+	}
+
+	s, err := startSession(cfg, ebpf.Target{PID: pid})
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return 0, err
+	}
+
+	if err := syscall.PtraceDetach(pid); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		s.finish()
+		return 0, fmt.Errorf("resuming command: %w", err)
+	}
+
+	// SIGINT from the terminal already reaches the child through the foreground process group, so we just keep
+	// waiting for it to exit. SIGTERM is usually aimed at us alone, so we pass it on.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGTERM {
+				_ = cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	waitErr := cmd.Wait()
+	s.finish()
+
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		return 0, fmt.Errorf("waiting for command: %w", waitErr)
+	}
+	code := exitCode(cmd.ProcessState)
+	slog.Info("Command exited", "pid", pid, "exit_code", code)
+	return code, nil
+}
+
+// follows the shell convention of 128+n for children killed by signal n
+func exitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}